@@ -0,0 +1,114 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// backlogChannelSize is the buffer of the channels returned by BacklogChannel.
+const backlogChannelSize = 100
+
+// BacklogRow is a backlog row streamed by BacklogChannel.
+type BacklogRow struct {
+	// Values are the values of the row as returned by pgx.Rows.Values.
+	Values []any
+
+	// Notification is the notification the row was converted into by the handler registered with HandleUnified.
+	Notification *pgconn.Notification
+
+	// Err is set on the last BacklogRow if the scan failed, and Values and Notification are nil then.
+	Err error
+}
+
+// BacklogChannel runs the backlog query of channel, which must have been registered with HandleUnified, and streams its
+// rows to the returned Go channel, for callers that prefer to pull the backlog themselves rather than have the handler
+// called for each row. The rows are converted like HandleBacklog does, and rows rejected by BacklogFilter are skipped,
+// but no handler is called and BacklogMaxPerRun does not apply, so nothing is marked handled unless the caller does
+// so. BacklogChannel gets its own connection from Connect, so it neither needs Listen to be running nor pauses it, and
+// closes it when the scan is done.
+//
+// The returned channel is buffered, so the query is read ahead of the caller by at most a bounded number of rows, and
+// is closed once all rows have been sent. If the scan fails, e.g. because channel has no such handler or the query
+// fails, a last BacklogRow carrying the error is sent first. If ctx is cancelled the scan stops and the channel is
+// closed without sending the rows read ahead, so callers that stop ranging early should cancel ctx.
+func (l *Listener) BacklogChannel(ctx context.Context, channel string) <-chan BacklogRow {
+	channel = l.channelName(channel)
+
+	rowChan := make(chan BacklogRow, backlogChannelSize)
+	go func() {
+		defer close(rowChan)
+		if err := l.streamBacklog(ctx, channel, rowChan); err != nil && ctx.Err() == nil {
+			select {
+			case rowChan <- BacklogRow{Err: err}:
+			case <-ctx.Done():
+			}
+		}
+	}()
+	return rowChan
+}
+
+// streamBacklog sends the backlog rows of channel to rowChan until they are exhausted or ctx is done.
+func (l *Listener) streamBacklog(ctx context.Context, channel string, rowChan chan<- BacklogRow) error {
+	var h *unifiedHandler
+	if reg := l.route(&pgconn.Notification{Channel: channel}); reg != nil {
+		h, _ = unwrapSource(reg.handler).(*unifiedHandler)
+	}
+	if h == nil {
+		return fmt.Errorf("BacklogChannel: %w: %s is not registered with HandleUnified", ErrNoBacklogHandler, channel)
+	}
+	if l.Connect == nil {
+		return errors.New("BacklogChannel: Connect is nil")
+	}
+
+	conn, err := l.Connect(ctx)
+	if err != nil {
+		return fmt.Errorf("connect: %w", err)
+	}
+	defer func() {
+		if err := conn.Close(context.WithoutCancel(ctx)); err != nil {
+			l.logError(ctx, err)
+		}
+	}()
+
+	rows, err := conn.Query(ctx, h.query)
+	if err != nil {
+		return fmt.Errorf("query backlog: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if l.BacklogFilter != nil {
+			ok, err := l.BacklogFilter(channel, rows)
+			if err != nil {
+				return fmt.Errorf("filter backlog row: %w", err)
+			}
+			if !ok {
+				l.stats.backlogFiltered.Add(1)
+				continue
+			}
+		}
+		values, err := rows.Values()
+		if err != nil {
+			return fmt.Errorf("read backlog row: %w", err)
+		}
+		notification, err := h.rowToNotification(rows)
+		if err != nil {
+			return fmt.Errorf("convert backlog row: %w", err)
+		}
+		if notification.Channel == "" {
+			notification.Channel = channel
+		}
+
+		select {
+		case rowChan <- BacklogRow{Values: values, Notification: notification}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query backlog: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package pgxlisten
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+)
+
+// Backoff decides how long Listen waits before reconnecting. See Listener.ReconnectBackoff. A Backoff is used by one
+// Listener at a time.
+type Backoff interface {
+	// Next returns the delay before the next attempt to connect and listen.
+	Next() time.Duration
+
+	// Reset is called when Listen has subscribed on a new connection, so the delays start over once it is lost.
+	Reset()
+}
+
+// ErrInvalidBackoff is returned when a Backoff is constructed with invalid parameters.
+var ErrInvalidBackoff = errors.New("invalid backoff")
+
+func checkBackoff(minDelay, maxDelay time.Duration) error {
+	if minDelay <= 0 {
+		return fmt.Errorf("%w: min %v is not positive", ErrInvalidBackoff, minDelay)
+	}
+	if maxDelay < minDelay {
+		return fmt.Errorf("%w: max %v is less than min %v", ErrInvalidBackoff, maxDelay, minDelay)
+	}
+	return nil
+}
+
+// FullJitterBackoff is the "full jitter" exponential backoff: each delay is chosen uniformly at random between 0 and a
+// ceiling that starts at the minimum delay and doubles with every attempt up to the maximum. Spreading reconnects over
+// the whole range keeps many listeners that lost their connections at the same time from reconnecting in lockstep.
+type FullJitterBackoff struct {
+	min, max time.Duration
+	ceiling  time.Duration
+	rand     *rand.Rand
+}
+
+// NewFullJitterBackoff returns a FullJitterBackoff whose ceiling starts at minDelay and grows to maxDelay. minDelay
+// must be positive and not greater than maxDelay.
+func NewFullJitterBackoff(minDelay, maxDelay time.Duration) (*FullJitterBackoff, error) {
+	if err := checkBackoff(minDelay, maxDelay); err != nil {
+		return nil, err
+	}
+	return &FullJitterBackoff{min: minDelay, max: maxDelay, rand: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}, nil
+}
+
+// Next implements Backoff.
+func (b *FullJitterBackoff) Next() time.Duration {
+	if b.ceiling == 0 {
+		b.ceiling = b.min
+	} else {
+		b.ceiling = min(b.ceiling*2, b.max)
+		if b.ceiling < 0 {
+			b.ceiling = b.max
+		}
+	}
+	// Unsigned so that a ceiling of math.MaxInt64 does not overflow.
+	return time.Duration(b.rand.Uint64N(uint64(b.ceiling) + 1))
+}
+
+// Reset implements Backoff.
+func (b *FullJitterBackoff) Reset() {
+	b.ceiling = 0
+}
+
+// DecorrelatedJitterBackoff is the "decorrelated jitter" backoff: each delay is chosen uniformly at random between the
+// minimum delay and three times the previous delay, capped at the maximum. It grows about as fast as
+// FullJitterBackoff but never waits less than the minimum.
+type DecorrelatedJitterBackoff struct {
+	min, max time.Duration
+	prev     time.Duration
+	rand     *rand.Rand
+}
+
+// NewDecorrelatedJitterBackoff returns a DecorrelatedJitterBackoff with delays between minDelay and maxDelay.
+// minDelay must be positive and not greater than maxDelay.
+func NewDecorrelatedJitterBackoff(minDelay, maxDelay time.Duration) (*DecorrelatedJitterBackoff, error) {
+	if err := checkBackoff(minDelay, maxDelay); err != nil {
+		return nil, err
+	}
+	return &DecorrelatedJitterBackoff{min: minDelay, max: maxDelay, rand: rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))}, nil
+}
+
+// Next implements Backoff.
+func (b *DecorrelatedJitterBackoff) Next() time.Duration {
+	prev := max(b.prev, b.min)
+	upper := min(prev*3, b.max)
+	if upper < prev {
+		upper = b.max
+	}
+	b.prev = b.min + time.Duration(b.rand.Int64N(int64(upper-b.min)+1))
+	return b.prev
+}
+
+// Reset implements Backoff.
+func (b *DecorrelatedJitterBackoff) Reset() {
+	b.prev = 0
+}
@@ -0,0 +1,150 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestBackoffValidation(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		min, max time.Duration
+	}{
+		{name: "zero min", min: 0, max: time.Second},
+		{name: "negative min", min: -time.Second, max: time.Second},
+		{name: "max less than min", min: 2 * time.Second, max: time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := pgxlisten.NewFullJitterBackoff(tt.min, tt.max)
+			require.ErrorIs(t, err, pgxlisten.ErrInvalidBackoff)
+			_, err = pgxlisten.NewDecorrelatedJitterBackoff(tt.min, tt.max)
+			require.ErrorIs(t, err, pgxlisten.ErrInvalidBackoff)
+		})
+	}
+
+	_, err := pgxlisten.NewFullJitterBackoff(time.Second, time.Second)
+	require.NoError(t, err)
+}
+
+// sampleBackoff returns the delays of the first attempts of runs sequences of b, indexed by attempt.
+func sampleBackoff(b pgxlisten.Backoff, runs, attempts int) [][]time.Duration {
+	delays := make([][]time.Duration, attempts)
+	for range runs {
+		b.Reset()
+		for attempt := range attempts {
+			delays[attempt] = append(delays[attempt], b.Next())
+		}
+	}
+	return delays
+}
+
+func mean(delays []time.Duration) time.Duration {
+	var sum time.Duration
+	for _, d := range delays {
+		sum += d
+	}
+	return sum / time.Duration(len(delays))
+}
+
+func TestFullJitterBackoff(t *testing.T) {
+	const minDelay, maxDelay = 10 * time.Millisecond, time.Second
+	b, err := pgxlisten.NewFullJitterBackoff(minDelay, maxDelay)
+	require.NoError(t, err)
+
+	ceiling := minDelay
+	for attempt, delays := range sampleBackoff(b, 2000, 12) {
+		for _, d := range delays {
+			require.GreaterOrEqual(t, d, time.Duration(0))
+			require.LessOrEqual(t, d, ceiling, "attempt %d", attempt+1)
+		}
+		// Delays are spread evenly below the ceiling.
+		require.InDelta(t, float64(ceiling/2), float64(mean(delays)), float64(ceiling)/10, "attempt %d", attempt+1)
+		ceiling = min(ceiling*2, maxDelay)
+	}
+}
+
+func TestBackoffMaxDuration(t *testing.T) {
+	const maxDelay = time.Duration(math.MaxInt64)
+	full, err := pgxlisten.NewFullJitterBackoff(time.Second, maxDelay)
+	require.NoError(t, err)
+	decorrelated, err := pgxlisten.NewDecorrelatedJitterBackoff(time.Second, maxDelay)
+	require.NoError(t, err)
+
+	// The delays reach the maximum without overflowing.
+	for _, b := range []pgxlisten.Backoff{full, decorrelated} {
+		for _, delays := range sampleBackoff(b, 10, 100) {
+			for _, d := range delays {
+				require.GreaterOrEqual(t, d, time.Duration(0))
+			}
+		}
+	}
+}
+
+func TestDecorrelatedJitterBackoff(t *testing.T) {
+	const minDelay, maxDelay = 10 * time.Millisecond, time.Second
+	b, err := pgxlisten.NewDecorrelatedJitterBackoff(minDelay, maxDelay)
+	require.NoError(t, err)
+
+	samples := sampleBackoff(b, 2000, 12)
+	for _, delays := range samples {
+		for _, d := range delays {
+			require.GreaterOrEqual(t, d, minDelay)
+			require.LessOrEqual(t, d, maxDelay)
+		}
+	}
+
+	// The first delay is between min and three times min, and later ones grow until they approach the cap.
+	require.InDelta(t, float64(2*minDelay), float64(mean(samples[0])), float64(minDelay)/5)
+	require.Greater(t, mean(samples[4]), mean(samples[1]))
+	require.Greater(t, mean(samples[11]), maxDelay/5)
+	require.Greater(t, slices.Max(samples[11]), maxDelay*9/10)
+}
+
+// recordingBackoff returns a fixed delay and records how it is used.
+type recordingBackoff struct {
+	calls []string
+}
+
+func (b *recordingBackoff) Next() time.Duration {
+	b.calls = append(b.calls, "next")
+	return time.Millisecond
+}
+
+func (b *recordingBackoff) Reset() {
+	b.calls = append(b.calls, "reset")
+}
+
+func TestListenerReconnectBackoff(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	errUnavailable := errors.New("database unavailable")
+	backoff := &recordingBackoff{}
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, errUnavailable
+		},
+		LogError:             func(ctx context.Context, err error) {},
+		ReconnectDelay:       time.Hour,
+		ReconnectBackoff:     backoff,
+		MaxReconnectAttempts: 3,
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	// The backoff's delays are used instead of ReconnectDelay.
+	err := listener.Listen(ctx)
+	require.ErrorIs(t, err, pgxlisten.ErrMaxReconnectAttempts)
+	require.Equal(t, []string{"next", "next"}, backoff.calls)
+}
@@ -0,0 +1,67 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const defaultBreakerCooldown = 5 * time.Minute
+
+// BreakerState is the state of the Listener's reconnect circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed is the normal state. Reconnects are attempted every ReconnectDelay.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen means too many consecutive reconnects failed. Listen is waiting BreakerCooldown before probing.
+	BreakerOpen
+
+	// BreakerHalfOpen means Listen is probing the database with a single attempt after the cooldown.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+// BreakerState returns the current state of the reconnect circuit breaker. It is always BreakerClosed when
+// BreakerThreshold is 0.
+func (l *Listener) BreakerState() BreakerState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.breakerState
+}
+
+func (l *Listener) breakerCooldown() time.Duration {
+	if l.BreakerCooldown == 0 {
+		return defaultBreakerCooldown
+	}
+	return l.BreakerCooldown
+}
+
+func (l *Listener) setBreakerState(ctx context.Context, state BreakerState) {
+	l.mu.Lock()
+	changed := l.breakerState != state
+	l.breakerState = state
+	l.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	l.logDebug(ctx, fmt.Sprintf("circuit breaker %s", state))
+	if l.OnBreakerStateChange != nil {
+		l.OnBreakerStateChange(ctx, state)
+	}
+}
@@ -0,0 +1,149 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// CatchUpMode is a Handler and BacklogHandler that implements the safe startup sequence of event-sourced consumers.
+// Events are identified by int64 positions that are carried in the payload of their notifications. Each time Listen
+// connects CatchUpMode goes through these steps for its channel:
+//
+//  1. Listener issues LISTEN, so events committed from then on are notified and their notifications are buffered.
+//  2. HandleBacklog replays the events after the channel's position with Fetch and Process until Fetch returns none.
+//  3. The notifications buffered during the replay are handled. Those of events that were already replayed are
+//     skipped, the others are processed from their notification.
+//  4. From then on every notification is processed live as it arrives.
+//
+// Since LISTEN is issued before the replay starts, every event is either replayed or notified, so none is missed.
+// Since the position is advanced after every event and notifications at or before it are skipped, none is processed
+// twice. A live notification whose event does not directly follow the channel's position, because events in between
+// were not notified or failed, replays those events with Fetch and Process first, so no gap is left behind; Fetch is
+// therefore called for every live notification when positions are not consecutive. Events are processed in ascending
+// position order. This relies on positions becoming visible in increasing order, as for ReliableMode. An event may be
+// processed again after a restart if Store is not set, or if the process stops or SaveWatermark fails after it was
+// processed.
+//
+// Listener.BacklogInterval should not be set, since the backlog of a channel is only replayed when Listen connects. The
+// whole backlog is replayed regardless of Listener.BacklogMaxPerRun, since live events can only be processed once the
+// replay is complete. An event whose notification is lost, e.g. because its payload does not parse, or whose Process
+// fails is picked up when the next notification on the channel arrives, or by the replay after the next reconnect.
+//
+// conn is the connection passed to the handler by the Listener. It is nil for notifications when
+// Listener.MaxConcurrency or Listener.Semaphore is set, in which case Fetch and Process must get their own connection.
+type CatchUpMode struct {
+	// Fetch returns the positions of the events on channel after the position after in ascending order. It may return
+	// a limited batch; it is called again until it returns none. Fetch is required.
+	Fetch func(ctx context.Context, conn *pgx.Conn, channel string, after int64) ([]int64, error)
+
+	// Process processes the event at position on channel. notification is the notification of the event if it is
+	// processed live, and nil if it is replayed. If Process returns an error the position is not advanced and the
+	// event is tried again by the next replay. Process is required.
+	Process func(ctx context.Context, conn *pgx.Conn, channel string, position int64, notification *pgconn.Notification) error
+
+	// Position returns the position of the event carried in the payload of notification. Position is required.
+	Position func(notification *pgconn.Notification) (int64, error)
+
+	// Store persists the position of each channel so a restarted process continues where it stopped. If nil,
+	// positions are kept in memory and all events are replayed when the process starts. Store is optional.
+	Store WatermarkStore
+
+	channels reliableChannels
+}
+
+// CaughtUpTo returns the position of the last event processed on channel.
+func (c *CatchUpMode) CaughtUpTo(ctx context.Context, channel string) (int64, error) {
+	rc := c.channels.get(channel)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.load(ctx, c.Store, channel)
+}
+
+// HandleNotification implements Handler. It processes the event of notification unless it has already been
+// processed, after replaying the events between the channel's position and it.
+func (c *CatchUpMode) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	position, err := c.Position(notification)
+	if err != nil {
+		return fmt.Errorf("parse position: %w", err)
+	}
+
+	rc := c.channels.get(notification.Channel)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	current, err := rc.load(ctx, c.Store, notification.Channel)
+	if err != nil {
+		return err
+	}
+	if position <= current {
+		return nil
+	}
+	if position > current+1 {
+		if _, err := c.replay(ctx, conn, notification.Channel, rc, position); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Process(ctx, conn, notification.Channel, position, notification); err != nil {
+		return fmt.Errorf("process %d: %w", position, err)
+	}
+	return rc.advance(ctx, c.Store, notification.Channel, position)
+}
+
+// HandleBacklog implements BacklogHandler. It replays the events after the position of channel and returns
+// ErrBacklogEmpty if there were none.
+func (c *CatchUpMode) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	rc := c.channels.get(channel)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	replayed, err := c.replay(ctx, conn, channel, rc, math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if replayed == 0 {
+		return ErrBacklogEmpty
+	}
+	return nil
+}
+
+// replay processes the events on channel after its position and before the position before, and returns how many it
+// processed. rc.mu must be held.
+func (c *CatchUpMode) replay(ctx context.Context, conn *pgx.Conn, channel string, rc *reliableChannel, before int64) (int, error) {
+	position, err := rc.load(ctx, c.Store, channel)
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for {
+		positions, err := c.Fetch(ctx, conn, channel, position)
+		if err != nil {
+			return replayed, fmt.Errorf("fetch after %d: %w", position, err)
+		}
+		if len(positions) == 0 {
+			return replayed, nil
+		}
+
+		for _, p := range positions {
+			if p <= position {
+				return replayed, fmt.Errorf("fetch after %d returned position %d out of order", position, p)
+			}
+			if p >= before {
+				return replayed, nil
+			}
+			if err := c.Process(ctx, conn, channel, p, nil); err != nil {
+				return replayed, fmt.Errorf("process %d: %w", p, err)
+			}
+			if err := rc.advance(ctx, c.Store, channel, p); err != nil {
+				return replayed, err
+			}
+			position = p
+			replayed++
+		}
+	}
+}
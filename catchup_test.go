@@ -0,0 +1,183 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerCatchUpMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_catchup_test;
+create table pgxlisten_catchup_test (position bigint primary key generated by default as identity, msg text not null);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_catchup_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		insert := func(msg string, notify bool) int64 {
+			var position int64
+			err := conn.QueryRow(ctx, `insert into pgxlisten_catchup_test (msg) values ($1) returning position`, msg).Scan(&position)
+			require.NoError(t, err)
+			if notify {
+				_, err = conn.Exec(ctx, `select pg_notify('foo', $1)`, strconv.FormatInt(position, 10))
+				require.NoError(t, err)
+			}
+			return position
+		}
+
+		// Written before Listen starts.
+		insert("a", false)
+		insert("b", false)
+
+		fetches := 0
+		processedChan := make(chan string, 8)
+		catchUp := &pgxlisten.CatchUpMode{
+			Fetch: func(ctx context.Context, conn *pgx.Conn, channel string, after int64) ([]int64, error) {
+				fetches++
+				if fetches == 1 {
+					// Written during the backlog phase, before it is fetched. Its notification is a duplicate.
+					insert("c", true)
+				}
+				rows, _ := conn.Query(ctx, `select position from pgxlisten_catchup_test where position > $1 order by position`, after)
+				positions, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+				if fetches == 2 {
+					// Written during the backlog phase, after the last fetch. Only its notification covers it.
+					insert("d", true)
+				}
+				return positions, err
+			},
+			Process: func(ctx context.Context, conn *pgx.Conn, channel string, position int64, notification *pgconn.Notification) error {
+				var msg string
+				err := conn.QueryRow(ctx, `select msg from pgxlisten_catchup_test where position = $1`, position).Scan(&msg)
+				if err != nil {
+					return err
+				}
+				if notification != nil {
+					msg += " live"
+				}
+				processedChan <- msg
+				return nil
+			},
+			Position: func(notification *pgconn.Notification) (int64, error) {
+				return strconv.ParseInt(notification.Payload, 10, 64)
+			},
+		}
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+		}
+		listener.Handle("foo", catchUp)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		receive := func(expected string) {
+			select {
+			case actual := <-processedChan:
+				require.Equal(t, expected, actual)
+			case <-ctx.Done():
+				t.Fatalf("%s. %v", expected, ctx.Err())
+			}
+		}
+
+		receive("a")
+		receive("b")
+		receive("c")
+		receive("d live")
+
+		last := insert("e", true)
+		receive("e live")
+
+		position, err := catchUp.CaughtUpTo(ctx, "foo")
+		require.NoError(t, err)
+		require.Equal(t, last, position)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, processedChan)
+	})
+}
+
+func TestCatchUpModeReplaysGaps(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	events := []int64{1, 2, 3, 4, 5}
+	var processed []string
+	failed := false
+	catchUp := &pgxlisten.CatchUpMode{
+		Fetch: func(ctx context.Context, conn *pgx.Conn, channel string, after int64) ([]int64, error) {
+			var positions []int64
+			for _, position := range events {
+				if position > after {
+					positions = append(positions, position)
+				}
+			}
+			return positions, nil
+		},
+		Process: func(ctx context.Context, conn *pgx.Conn, channel string, position int64, notification *pgconn.Notification) error {
+			if position == 2 && !failed {
+				failed = true
+				return errors.New("process failed")
+			}
+			msg := strconv.FormatInt(position, 10)
+			if notification != nil {
+				msg += " live"
+			}
+			processed = append(processed, msg)
+			return nil
+		},
+		Position: func(notification *pgconn.Notification) (int64, error) {
+			return strconv.ParseInt(notification.Payload, 10, 64)
+		},
+	}
+	notify := func(payload string) error {
+		return catchUp.HandleNotification(ctx, &pgconn.Notification{Channel: "foo", Payload: payload}, nil)
+	}
+
+	require.NoError(t, notify("1"))
+	require.Error(t, notify("2"))
+	// 2 failed, so it is replayed before 3 is processed.
+	require.NoError(t, notify("3"))
+	// The notification of 4 is lost, so it is replayed before 5 is processed.
+	require.NoError(t, notify("5"))
+	require.NoError(t, notify("4"))
+
+	require.Equal(t, []string{"1 live", "2", "3 live", "4", "5 live"}, processed)
+	position, err := catchUp.CaughtUpTo(ctx, "foo")
+	require.NoError(t, err)
+	require.Equal(t, int64(5), position)
+}
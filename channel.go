@@ -0,0 +1,110 @@
+package pgxlisten
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxChannelLen is the number of bytes of an identifier PostgreSQL keeps (NAMEDATALEN - 1).
+const maxChannelLen = 63
+
+// ErrInvalidChannel is returned by ValidateChannel and wrapped by the errors of the methods that validate channels.
+var ErrInvalidChannel = errors.New("invalid channel")
+
+// ValidateChannel returns an error wrapping ErrInvalidChannel if channel cannot be listened to as is. Channels are
+// quoted, so any character is allowed except NUL, but a channel must not be empty, must be valid UTF-8, and must fit in
+// the 63 bytes PostgreSQL keeps of an identifier. LISTEN silently truncates longer names and pg_notify rejects them, so
+// notifications would never arrive.
+func ValidateChannel(channel string) error {
+	switch {
+	case channel == "":
+		return fmt.Errorf("%w: empty", ErrInvalidChannel)
+	case len(channel) > maxChannelLen:
+		return fmt.Errorf("%w: %q is %d bytes, longer than %d", ErrInvalidChannel, channel, len(channel), maxChannelLen)
+	case strings.IndexByte(channel, 0) >= 0:
+		return fmt.Errorf("%w: %q contains NUL", ErrInvalidChannel, channel)
+	case !utf8.ValidString(channel):
+		return fmt.Errorf("%w: %q is not valid UTF-8", ErrInvalidChannel, channel)
+	}
+	return nil
+}
+
+// ValidateChannels checks the channels of all handlers registered with Handle and its variants with ValidateChannel
+// and returns an error describing every invalid one, or nil if all are valid. Since Handle cannot return an error,
+// programs that register handlers from configuration can call ValidateChannels to report mistakes at setup time rather
+// than when Listen starts.
+func (l *Listener) ValidateChannels() error {
+	l.handlersMu.RLock()
+	channels := make([]string, 0, len(l.handlers))
+	for channel := range l.handlers {
+		channels = append(channels, channel)
+	}
+	l.handlersMu.RUnlock()
+	sort.Strings(channels)
+
+	var errs []error
+	for _, channel := range channels {
+		if err := ValidateChannel(channel); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ChannelCaseMode decides how a Listener treats the case of channel names. See Listener.ChannelCaseMode.
+type ChannelCaseMode int
+
+const (
+	// ChannelCasePreserve listens to channels exactly as given and routes notifications by exact match. Channels are
+	// quoted, so "Jobs" and "jobs" are different channels, and NOTIFY must quote a mixed-case channel too.
+	ChannelCasePreserve ChannelCaseMode = iota
+
+	// ChannelCaseLower folds the ASCII letters of channels to lower case, like PostgreSQL folds unquoted identifiers,
+	// so channels match case-insensitively and notifications sent with an unquoted NOTIFY Jobs reach the handler for
+	// "Jobs". Like PostgreSQL, it leaves other letters as they are, so "Évent" and "évent" remain different channels.
+	ChannelCaseLower
+
+	// ChannelCaseUpper folds the ASCII letters of channels to upper case, so channels match case-insensitively except
+	// for other letters, which are left as they are. Senders must quote the upper case name, e.g. NOTIFY "JOBS" or
+	// pg_notify('JOBS', ...).
+	ChannelCaseUpper
+)
+
+// normalize returns channel folded according to m.
+func (m ChannelCaseMode) normalize(channel string) string {
+	switch m {
+	case ChannelCaseLower:
+		return foldASCII(channel, 'A', 'Z', 'a'-'A')
+	case ChannelCaseUpper:
+		return foldASCII(channel, 'a', 'z', 'A'-'a')
+	}
+	return channel
+}
+
+// foldASCII returns channel with the bytes from lo to hi shifted by delta. Only ASCII letters are folded, since
+// PostgreSQL does not fold other letters of identifiers in multibyte encodings.
+func foldASCII(channel string, lo, hi byte, delta int) string {
+	b := []byte(channel)
+	for i, c := range b {
+		if lo <= c && c <= hi {
+			b[i] = byte(int(c) + delta)
+		}
+	}
+	return string(b)
+}
+
+// channelName returns channel folded according to ChannelCaseMode.
+func (l *Listener) channelName(channel string) string {
+	return l.ChannelCaseMode.normalize(channel)
+}
+
+// validateChannel checks channel with ValidateChannel unless AllowInvalidChannels is set.
+func (l *Listener) validateChannel(channel string) error {
+	if l.AllowInvalidChannels {
+		return nil
+	}
+	return ValidateChannel(channel)
+}
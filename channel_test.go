@@ -0,0 +1,137 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestValidateChannel(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		channel string
+		valid   bool
+	}{
+		{name: "simple", channel: "jobs", valid: true},
+		{name: "quoted characters", channel: `Jobs "1"; drop`, valid: true},
+		{name: "max length", channel: strings.Repeat("a", 63), valid: true},
+		{name: "empty", channel: ""},
+		{name: "over length", channel: strings.Repeat("a", 64)},
+		{name: "over length multibyte", channel: strings.Repeat("ä", 32)},
+		{name: "NUL", channel: "jobs\x00"},
+		{name: "invalid UTF-8", channel: "jobs\xff"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := pgxlisten.ValidateChannel(tt.channel)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.ErrorIs(t, err, pgxlisten.ErrInvalidChannel)
+			}
+		})
+	}
+}
+
+func TestListenRejectsInvalidChannels(t *testing.T) {
+	connected := false
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			connected = true
+			return nil, context.Canceled
+		},
+	}
+	handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	})
+	listener.Handle("", handler)
+	listener.Handle(strings.Repeat("a", 64), handler)
+	listener.Handle("jobs", handler)
+
+	err := listener.ValidateChannels()
+	require.ErrorIs(t, err, pgxlisten.ErrInvalidChannel)
+	require.Contains(t, err.Error(), "empty")
+	require.Contains(t, err.Error(), "longer than 63")
+
+	err = listener.Listen(context.Background())
+	require.ErrorIs(t, err, pgxlisten.ErrInvalidChannel)
+	require.False(t, connected)
+
+	_, err = listener.AddHandler(context.Background(), "", handler)
+	require.ErrorIs(t, err, pgxlisten.ErrInvalidChannel)
+
+	var set pgxlisten.HandlerSet
+	set.Handle(strings.Repeat("b", 64), handler)
+	err = listener.AddSet(&set)
+	require.ErrorIs(t, err, pgxlisten.ErrInvalidChannel)
+}
+
+func TestListenAllowInvalidChannels(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, ctx.Err()
+		},
+		LogError:             func(ctx context.Context, err error) {},
+		AllowInvalidChannels: true,
+	}
+	listener.Handle("", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	err := listener.Listen(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestListenerChannelCaseModeRouting(t *testing.T) {
+	for _, tt := range []struct {
+		mode    pgxlisten.ChannelCaseMode
+		channel string
+		handled string
+	}{
+		{mode: pgxlisten.ChannelCasePreserve, channel: "mixedcase", handled: ""},
+		{mode: pgxlisten.ChannelCasePreserve, channel: "MixedCase", handled: "MixedCase"},
+		{mode: pgxlisten.ChannelCaseLower, channel: "MIXEDcase", handled: "mixedcase"},
+		{mode: pgxlisten.ChannelCaseUpper, channel: "mixedCASE", handled: "MIXEDCASE"},
+	} {
+		listener := &pgxlisten.Listener{ChannelCaseMode: tt.mode}
+		var handled string
+		listener.Handle("MixedCase", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			handled = notification.Channel
+			return nil
+		}))
+
+		listener.Dispatch(context.Background(), &pgconn.Notification{Channel: tt.channel}, nil)
+		require.Equal(t, tt.handled, handled, "%d %s", tt.mode, tt.channel)
+	}
+}
+
+func TestListenerChannelCaseModeFoldsASCIIOnly(t *testing.T) {
+	for _, tt := range []struct {
+		mode    pgxlisten.ChannelCaseMode
+		channel string
+		handled string
+	}{
+		{mode: pgxlisten.ChannelCaseLower, channel: "ÉVENT", handled: "Évent"},
+		{mode: pgxlisten.ChannelCaseLower, channel: "éVENT", handled: ""},
+		{mode: pgxlisten.ChannelCaseUpper, channel: "Évent", handled: "ÉVENT"},
+		{mode: pgxlisten.ChannelCaseUpper, channel: "évent", handled: ""},
+	} {
+		listener := &pgxlisten.Listener{ChannelCaseMode: tt.mode}
+		var handled string
+		listener.Handle("Évent", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			handled = notification.Channel
+			return nil
+		}))
+
+		listener.Dispatch(context.Background(), &pgconn.Notification{Channel: tt.channel}, nil)
+		require.Equal(t, tt.handled, handled, "%d %s", tt.mode, tt.channel)
+	}
+}
@@ -0,0 +1,15 @@
+package pgxlisten
+
+import "time"
+
+// Clock tells the current time. It allows tests to control the durations a Listener measures.
+type Clock interface {
+	Now() time.Time
+}
+
+func (l *Listener) now() time.Time {
+	if l.Clock != nil {
+		return l.Clock.Now()
+	}
+	return time.Now()
+}
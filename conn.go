@@ -0,0 +1,236 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrNotConnected is returned by methods that need the listening connection when Listen is not running or is between
+// connections.
+var ErrNotConnected = errors.New("not connected")
+
+// ErrWithConnReentrant is returned by WithConn and the other methods that use the listening connection when called
+// from a handler running on the receive loop. Waiting would deadlock since the receive loop cannot run the request
+// until the caller returns.
+var ErrWithConnReentrant = errors.New("WithConn called reentrantly")
+
+// ErrNoBacklogHandler is returned by RunBacklog when the handler for a channel is not a BacklogHandler, and by
+// BacklogChannel when it was not registered with HandleUnified.
+var ErrNoBacklogHandler = errors.New("no backlog handler")
+
+type receiveLoopCtxKey struct{}
+
+// detachedContext returns ctx for work that a handler defers until after it has returned, such as a timer. It is not
+// cancelled with ctx and is not marked as running on the receive loop, so the work can use withConn.
+func detachedContext(ctx context.Context) context.Context {
+	return context.WithValue(context.WithoutCancel(ctx), receiveLoopCtxKey{}, nil)
+}
+
+// connRequest is a function to be run on the listening connection by the receive loop.
+type connRequest struct {
+	ctx  context.Context
+	fn   func(ctx context.Context, conn *pgx.Conn) error
+	done chan error
+}
+
+func (l *Listener) setSession(s *session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.current = s
+}
+
+// clearSession detaches s from the Listener and fails any requests that did not get to run.
+func (l *Listener) clearSession(s *session) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == s {
+		l.current = nil
+		for channel := range s.listening {
+			l.resetReady(channel)
+		}
+	}
+	for _, req := range s.requests {
+		req.done <- ErrNotConnected
+	}
+	s.requests = nil
+}
+
+// withConn runs fn on the listening connection from the receive loop and returns its error. The wait for
+// notifications in progress, if any, is interrupted so fn does not have to wait for the next notification or
+// keepalive.
+func (l *Listener) withConn(ctx context.Context, fn func(ctx context.Context, conn *pgx.Conn) error) error {
+	if ctx.Value(receiveLoopCtxKey{}) != nil {
+		return ErrWithConnReentrant
+	}
+
+	req := &connRequest{ctx: ctx, fn: fn, done: make(chan error, 1)}
+
+	l.mu.Lock()
+	s := l.current
+	if s == nil {
+		l.mu.Unlock()
+		return ErrNotConnected
+	}
+	s.requests = append(s.requests, req)
+	if s.waitCancel != nil {
+		s.waitCancel()
+	}
+	l.mu.Unlock()
+
+	select {
+	case err := <-req.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runConnRequests runs the pending requests of s. If there are none, cancelWait is registered to interrupt the wait
+// that is about to start when a request arrives. It reports whether any requests were run.
+func (l *Listener) runConnRequests(s *session, cancelWait context.CancelFunc) bool {
+	l.mu.Lock()
+	requests := s.requests
+	s.requests = nil
+	if len(requests) == 0 {
+		s.waitCancel = cancelWait
+	}
+	l.mu.Unlock()
+
+	for _, req := range requests {
+		if err := req.ctx.Err(); err != nil {
+			req.done <- err
+			continue
+		}
+		req.done <- req.fn(req.ctx, s.conn)
+	}
+
+	return len(requests) > 0
+}
+
+// QueueUsage returns the fraction (0–1) of the server's notification queue currently occupied by notifications
+// waiting to be processed, as reported by pg_notification_queue_usage(). A value approaching 1 means listeners are not
+// keeping up and NOTIFY will soon start failing. The query runs on the listening connection in between waiting for
+// notifications. QueueUsage returns ErrNotConnected if Listen does not currently have a connection.
+func (l *Listener) QueueUsage(ctx context.Context) (float64, error) {
+	var usage float64
+	err := l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		var err error
+		usage, err = l.queueUsage(ctx, conn)
+		return err
+	})
+	return usage, err
+}
+
+func (l *Listener) queueUsage(ctx context.Context, conn *pgx.Conn) (float64, error) {
+	const sql = "select pg_notification_queue_usage()"
+	if l.OnExec != nil {
+		l.OnExec(ctx, sql)
+	}
+	var usage float64
+	err := conn.QueryRow(ctx, sql).Scan(&usage)
+	return usage, err
+}
+
+// RunBacklog immediately calls HandleBacklog of the handler for channel on the listening connection and returns its
+// error. The call is serialized with the receive loop, which pauses while it runs. HandleBacklog is called with ctx
+// limited to BacklogTimeout rather than with the ctx passed to Listen. RunBacklog returns ErrNotConnected
+// if Listen does not currently have a connection and ErrNoBacklogHandler if the handler for channel is not a
+// BacklogHandler or DisableBacklog is set.
+func (l *Listener) RunBacklog(ctx context.Context, channel string) error {
+	channel = l.channelName(channel)
+
+	reg := l.route(&pgconn.Notification{Channel: channel})
+	if reg == nil {
+		return fmt.Errorf("%w: %s", ErrNoBacklogHandler, channel)
+	}
+	backlogHandler, ok := reg.handler.(BacklogHandler)
+	if !ok || l.DisableBacklog {
+		return fmt.Errorf("%w: %s", ErrNoBacklogHandler, channel)
+	}
+
+	return l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		backlogCtx, cancel := l.backlogContext(reg.metaContext(ctx))
+		defer cancel()
+		return backlogHandler.HandleBacklog(backlogCtx, channel, conn)
+	})
+}
+
+// WithConn runs fn with exclusive access to the listening connection and returns fn's error. The receive loop pauses
+// while fn runs and resumes afterwards, so fn should be quick. Notifications that arrive in the meantime are buffered
+// and handled after fn returns. fn must not keep a reference to conn. Concurrent calls are serialized: they queue and
+// run one after the other on the receive loop, each waiting until its turn or until ctx is done. fn must not call
+// WithConn itself, since the nested call would wait for fn to return. Calls from handlers that already run on the
+// receive loop return ErrWithConnReentrant. WithConn returns ErrNotConnected if Listen does not currently have a
+// connection.
+func (l *Listener) WithConn(ctx context.Context, fn func(conn *pgx.Conn) error) error {
+	return l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		return fn(conn)
+	})
+}
+
+// currentSession returns the session of the current connection, or nil if there is none. In functions run by withConn
+// it is the session the request is running on.
+func (l *Listener) currentSession() *session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current
+}
+
+// BackendPID returns the PID of the server process of the listening connection, e.g. to find it in pg_stat_activity
+// or to recognize notifications the Listener sent itself. It reports false if Listen does not currently have a
+// connection. The PID changes whenever Listen reconnects.
+func (l *Listener) BackendPID() (uint32, bool) {
+	s := l.currentSession()
+	if s == nil {
+		return 0, false
+	}
+	return s.conn.PgConn().PID(), true
+}
+
+// ConnectedSince returns when the listening connection was established according to Clock, e.g. to report its uptime.
+// It reports false if Listen does not currently have a connection. The time changes whenever Listen reconnects.
+func (l *Listener) ConnectedSince() (time.Time, bool) {
+	s := l.currentSession()
+	if s == nil {
+		return time.Time{}, false
+	}
+	return s.connectedAt, true
+}
+
+// NextKeepalive returns when the listening connection is next pinged if no notification arrives before then. The time
+// is reported according to Clock. It reports false if Listen does not currently have a connection.
+func (l *Listener) NextKeepalive() (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == nil || l.current.keepaliveAt.IsZero() {
+		return time.Time{}, false
+	}
+	return l.now().Add(time.Until(l.current.keepaliveAt)), true
+}
+
+// NextBacklogRun returns when HandleBacklog is next called for channel. The time is reported according to Clock. It
+// reports false if Listen does not currently have a connection, channel is not listened to with a BacklogHandler, or
+// BacklogInterval is not set, in which case the backlog is only handled when Listen connects.
+func (l *Listener) NextBacklogRun(channel string) (time.Time, bool) {
+	channel = l.channelName(channel)
+
+	if l.BacklogInterval <= 0 {
+		return time.Time{}, false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.current == nil {
+		return time.Time{}, false
+	}
+	b, ok := l.current.backlogs[channel]
+	if !ok || b.next.IsZero() {
+		return time.Time{}, false
+	}
+	return l.now().Add(time.Until(b.next)), true
+}
@@ -0,0 +1,54 @@
+package pgxlisten
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// dedupCache remembers when each dedup key was last seen.
+type dedupCache struct {
+	mu      sync.Mutex
+	keys    map[string]time.Time
+	pruneAt time.Time
+}
+
+// seen records key as seen at now and reports whether it was already seen within window.
+func (c *dedupCache) seen(key string, now time.Time, window time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keys == nil {
+		c.keys = make(map[string]time.Time)
+	}
+
+	// Forget expired keys once per window so the cache does not grow without bound.
+	if !now.Before(c.pruneAt) {
+		for k, at := range c.keys {
+			if now.Sub(at) >= window {
+				delete(c.keys, k)
+			}
+		}
+		c.pruneAt = now.Add(window)
+	}
+
+	at, ok := c.keys[key]
+	c.keys[key] = now
+	return ok && now.Sub(at) < window
+}
+
+// DedupKeyWithPID is a Listener.DedupKey that includes the PID of the backend that sent the notification along with
+// its channel and payload. It suits fan-out where several writers notify the same event and the notification of each
+// writer should be handled once.
+func DedupKeyWithPID(notification *pgconn.Notification) string {
+	return strconv.FormatUint(uint64(notification.PID), 10) + "\x00" + notification.Channel + "\x00" + notification.Payload
+}
+
+func (l *Listener) dedupKey(notification *pgconn.Notification) string {
+	if l.DedupKey != nil {
+		return l.DedupKey(notification)
+	}
+	return notification.Channel + "\x00" + notification.Payload
+}
@@ -0,0 +1,456 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// dispatcher queues notifications per channel and runs their handlers concurrently, limited by Listener.Semaphore or
+// Listener.MaxConcurrency.
+type dispatcher struct {
+	l         *Listener
+	listenCtx context.Context
+	ctx       context.Context
+	cancel    context.CancelFunc
+	sem       Semaphore
+	wake      chan struct{}
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	mu      sync.Mutex
+	queues  map[string]*channelQueue
+	ring    []*channelQueue
+	next    int
+	credit  int
+	stopped bool
+	// changed is closed and replaced whenever a notification is picked from a queue or a handler returns.
+	changed chan struct{}
+}
+
+// OverflowPolicy decides which notification is dropped when a bounded channel queue is full. See
+// Listener.HandleQueue.
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the notification that did not fit in the queue.
+	OverflowDropNewest OverflowPolicy = iota
+
+	// OverflowDropOldest drops the notification that has been queued longest to make room for the new one.
+	OverflowDropOldest
+)
+
+// channelQueue is the FIFO queue of notifications received on one channel.
+type channelQueue struct {
+	channel  string
+	weight   int
+	size     int
+	priority int
+	items    []queuedNotification
+	running  int
+}
+
+// pop removes and returns the oldest notification of q. It reports false if none is queued.
+func (q *channelQueue) pop() (queuedNotification, bool) {
+	if len(q.items) == 0 {
+		return queuedNotification{}, false
+	}
+	item := q.items[0]
+	q.items[0] = queuedNotification{}
+	q.items = q.items[1:]
+	return item, true
+}
+
+// queuedNotification is a notification waiting to be handled, the mode and generation of the connection it was
+// received on, its number in the order notifications were received, and when it was queued. held is set if it was
+// held by Suppress, after it went through the Interceptors and DedupWindow.
+type queuedNotification struct {
+	notification *pgconn.Notification
+	mode         ConnMode
+	generation   int
+	seq          uint64
+	queuedAt     time.Time
+	held         bool
+}
+
+// context returns ctx carrying the mode, generation, and number of item.
+func (item queuedNotification) context(ctx context.Context) context.Context {
+	ctx = context.WithValue(ctx, connModeCtxKey{}, item.mode)
+	ctx = context.WithValue(ctx, generationCtxKey{}, item.generation)
+	return context.WithValue(ctx, receivedSeqCtxKey{}, item.seq)
+}
+
+// newDispatcher starts a dispatcher for l. Handlers are called with a context derived from ctx that is only cancelled
+// by stop, so queued notifications can still be handled after ctx is cancelled.
+func newDispatcher(ctx context.Context, l *Listener) *dispatcher {
+	d := &dispatcher{
+		l:         l,
+		listenCtx: ctx,
+		sem:       l.Semaphore,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		queues:    make(map[string]*channelQueue),
+		changed:   make(chan struct{}),
+	}
+	if d.sem == nil {
+		d.sem = NewSemaphore(l.MaxConcurrency)
+	}
+	d.ctx, d.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	go d.run()
+	return d
+}
+
+// enqueue adds notification, received as number seq on a connection in mode with generation, to the queue for its
+// channel.
+func (d *dispatcher) enqueue(notification *pgconn.Notification, mode ConnMode, generation int, seq uint64) {
+	d.mu.Lock()
+	q := d.queue(notification)
+
+	var dropped *pgconn.Notification
+	if q.size > 0 && len(q.items) >= q.size {
+		if d.l.QueueOverflow == OverflowDropOldest {
+			dropped = q.items[0].notification
+			q.items[0] = queuedNotification{}
+			q.items = q.items[1:]
+		} else {
+			dropped = notification
+		}
+	}
+	if dropped != notification {
+		q.items = append(q.items, queuedNotification{notification: notification, mode: mode, generation: generation, seq: seq, queuedAt: d.l.now()})
+	}
+	depth := len(q.items)
+	d.mu.Unlock()
+
+	if dropped != nil {
+		d.l.drop(dropped, DropQueueFull)
+	}
+	if m := d.l.metrics(); m != nil {
+		m.QueueDepth(notification.Channel, depth)
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// requeue puts items, the notifications of one channel held by Suppress, in front of those queued for the channel so
+// they are handled first. They are dropped if the dispatcher has stopped.
+func (d *dispatcher) requeue(items []queuedNotification) {
+	channel := items[0].notification.Channel
+	now := d.l.now()
+	for i := range items {
+		items[i].queuedAt = now
+	}
+
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		for _, item := range items {
+			d.l.drop(item.notification, DropShutdown)
+		}
+		return
+	}
+	q := d.queue(items[0].notification)
+	q.items = append(items, q.items...)
+	depth := len(q.items)
+	d.mu.Unlock()
+
+	if m := d.l.metrics(); m != nil {
+		m.QueueDepth(channel, depth)
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// queue returns the queue for the channel of notification, creating it if needed. It must be called with d.mu held.
+func (d *dispatcher) queue(notification *pgconn.Notification) *channelQueue {
+	q, ok := d.queues[notification.Channel]
+	if !ok {
+		q = &channelQueue{channel: notification.Channel, weight: 1}
+		if reg := d.l.route(notification); reg != nil {
+			q.weight = max(reg.weight, 1)
+			q.size = reg.queueSize
+			q.priority = reg.priority
+		}
+		d.queues[notification.Channel] = q
+		d.ring = append(d.ring, q)
+		if len(d.ring) == 1 {
+			d.credit = q.weight
+		}
+	}
+	return q
+}
+
+// pick removes and returns the next notification by weighted round-robin. It reports false if none is queued. It must
+// be called with d.mu held.
+func (d *dispatcher) pick() (queuedNotification, bool) {
+	for range len(d.ring) + 1 {
+		q := d.ring[d.next]
+		if d.credit > 0 && len(q.items) > 0 {
+			d.credit--
+			return q.pop()
+		}
+		d.next = (d.next + 1) % len(d.ring)
+		d.credit = d.ring[d.next].weight
+	}
+	return queuedNotification{}, false
+}
+
+// pickPriority removes and returns the oldest notification of the channel with the highest priority that has any
+// queued, comparing the oldest notifications of each channel with Listener.Prioritizer if set. It reports false if
+// none is queued. It is used instead of pick if Prioritizer is set or once ctx passed to Listen is cancelled. It must
+// be called with d.mu held.
+func (d *dispatcher) pickPriority() (queuedNotification, bool) {
+	var best *channelQueue
+	for _, q := range d.ring {
+		if len(q.items) > 0 && (best == nil || d.before(q, best)) {
+			best = q
+		}
+	}
+	if best == nil {
+		return queuedNotification{}, false
+	}
+
+	return best.pop()
+}
+
+// before reports whether the oldest notification of q should be handled before that of other. Both must have
+// notifications queued.
+func (d *dispatcher) before(q, other *channelQueue) bool {
+	if d.l.Prioritizer != nil {
+		return d.l.Prioritizer(q.items[0].notification, other.items[0].notification)
+	}
+	return q.priority > other.priority
+}
+
+// run starts a handler for each queued notification whenever the semaphore allows, until stop is called. It only
+// acquires the semaphore once there is work, so an idle dispatcher does not hold capacity shared with others.
+func (d *dispatcher) run() {
+	defer close(d.done)
+
+	for {
+		for {
+			d.mu.Lock()
+			stopped, queued := d.stopped, d.len() > 0
+			d.mu.Unlock()
+			if stopped {
+				return
+			}
+			if queued {
+				break
+			}
+
+			select {
+			case <-d.wake:
+			case <-d.ctx.Done():
+				return
+			}
+		}
+
+		if err := d.sem.Acquire(d.ctx); err != nil {
+			return
+		}
+
+		d.mu.Lock()
+		var item queuedNotification
+		ok, depth := false, 0
+		if !d.stopped {
+			if d.l.Prioritizer != nil || d.listenCtx.Err() != nil {
+				item, ok = d.pickPriority()
+			} else {
+				item, ok = d.pick()
+			}
+		}
+		if ok {
+			q := d.queues[item.notification.Channel]
+			q.running++
+			depth = len(q.items)
+			d.wg.Add(1)
+			d.notifyChanged()
+		}
+		d.mu.Unlock()
+		if !ok {
+			d.sem.Release()
+			continue
+		}
+
+		go func() {
+			defer d.sem.Release()
+			d.handle(item, depth)
+		}()
+	}
+}
+
+// handle handles item, which was picked from a queue that had depth notifications left, and marks it done. The
+// queue's running count and d.wg must have been incremented for it.
+func (d *dispatcher) handle(item queuedNotification, depth int) {
+	defer func() {
+		d.mu.Lock()
+		d.queues[item.notification.Channel].running--
+		d.notifyChanged()
+		d.mu.Unlock()
+		d.wg.Done()
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}()
+
+	if m := d.l.metrics(); m != nil {
+		m.QueueDepth(item.notification.Channel, depth)
+		m.ObserveQueueDwell(item.notification.Channel, d.l.now().Sub(item.queuedAt))
+	}
+	ctx := item.context(d.ctx)
+	if item.held {
+		d.l.handleHeld(ctx, item.notification, nil)
+		return
+	}
+	d.l.process(ctx, item.notification, nil)
+}
+
+// notifyChanged wakes the callers waiting for d.changed. It must be called with d.mu held.
+func (d *dispatcher) notifyChanged() {
+	close(d.changed)
+	d.changed = make(chan struct{})
+}
+
+// Flush handles the notifications queued for channel in the calling goroutine and returns once none is queued or
+// being handled, e.g. to read state derived from them. It returns ctx.Err() if ctx is cancelled first. Notifications
+// are only queued while Listen is running with MaxConcurrency or Semaphore set; otherwise Flush returns nil
+// immediately. Each notification is handled once: Flush removes those it handles from the queue, and waits for those
+// the dispatcher has already started. Notifications received while Flush runs are handled too. Handlers run by Flush
+// do not wait for the semaphore. Flush must not be called from a handler of channel, since it would wait for itself.
+func (l *Listener) Flush(ctx context.Context, channel string) error {
+	channel = l.channelName(channel)
+
+	l.mu.Lock()
+	d := l.dispatcher
+	l.mu.Unlock()
+	if d == nil {
+		return nil
+	}
+	return d.flush(ctx, channel)
+}
+
+// flush handles the notifications queued for channel in the calling goroutine until none is queued or being handled.
+func (d *dispatcher) flush(ctx context.Context, channel string) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		q := d.queues[channel]
+		if d.stopped || q == nil {
+			d.mu.Unlock()
+			return nil
+		}
+		item, ok := q.pop()
+		if ok {
+			q.running++
+			d.wg.Add(1)
+		}
+		depth, running, changed := len(q.items), q.running, d.changed
+		d.mu.Unlock()
+
+		switch {
+		case ok:
+			d.handle(item, depth)
+		case running == 0:
+			return nil
+		default:
+			// Wait for the handlers the dispatcher started.
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-changed:
+			}
+		}
+	}
+}
+
+// len returns the number of queued notifications. It must be called with d.mu held.
+func (d *dispatcher) len() int {
+	n := 0
+	for _, q := range d.ring {
+		n += len(q.items)
+	}
+	return n
+}
+
+// stop stops the dispatcher and waits for running handlers to return, for up to ShutdownTimeout if set. If
+// DrainOnCancel is set, queued notifications continue to be handled for up to DrainOnCancel first. Notifications that
+// are still queued are dropped.
+func (d *dispatcher) stop() {
+	if d.l.DrainOnCancel > 0 {
+		d.drain()
+	}
+
+	d.mu.Lock()
+	d.stopped = true
+	for _, q := range d.ring {
+		for _, item := range q.items {
+			d.l.drop(item.notification, DropShutdown)
+		}
+		q.items = nil
+	}
+	d.mu.Unlock()
+
+	d.cancel()
+	<-d.done
+	d.waitHandlers()
+}
+
+// drain waits for the queued notifications to be picked, for up to DrainOnCancel.
+func (d *dispatcher) drain() {
+	timer := time.NewTimer(d.l.DrainOnCancel)
+	defer timer.Stop()
+	for {
+		d.mu.Lock()
+		empty, changed := d.len() == 0, d.changed
+		d.mu.Unlock()
+		if empty {
+			return
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// waitHandlers waits for the running handlers to return, leaving them running after ShutdownTimeout if set.
+func (d *dispatcher) waitHandlers() {
+	if d.l.ShutdownTimeout <= 0 {
+		d.wg.Wait()
+		return
+	}
+
+	returned := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(returned)
+	}()
+	timer := time.NewTimer(d.l.ShutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-returned:
+	case <-timer.C:
+		d.mu.Lock()
+		running := 0
+		for _, q := range d.ring {
+			running += q.running
+		}
+		d.mu.Unlock()
+		d.l.logError(d.listenCtx, fmt.Errorf("%w: %d handlers still running %v after shutdown", ErrHandlerAbandoned, running, d.l.ShutdownTimeout))
+	}
+}
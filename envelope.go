@@ -0,0 +1,112 @@
+package pgxlisten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// EnvelopeVersion is the version of the notification envelope format produced by EncodeEnvelope and accepted by
+// DecodeEnvelope.
+const EnvelopeVersion = 1
+
+// DefaultEnvelopeType is the EnvelopeHandler key whose handler receives envelopes of types that have no handler of
+// their own.
+const DefaultEnvelopeType = "*"
+
+var (
+	// ErrEnvelopeVersion is returned when a payload is an envelope of a version other than EnvelopeVersion.
+	ErrEnvelopeVersion = errors.New("unsupported envelope version")
+
+	// ErrUnknownEnvelopeType is returned by EnvelopeHandler when there is no handler for an envelope's type.
+	ErrUnknownEnvelopeType = errors.New("unknown envelope type")
+)
+
+// Envelope is a standard notification payload format carrying a typed message and its metadata. Encoded as JSON it
+// looks like:
+//
+//	{"v":1,"type":"user.created","data":{"id":42},"sent_at":"2024-01-02T03:04:05Z"}
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data"`
+	SentAt  time.Time       `json:"sent_at"`
+}
+
+// EncodeEnvelope returns a payload containing data as the JSON encoded message of type typ, sent now.
+func EncodeEnvelope(typ string, data any) (string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("encode envelope data: %w", err)
+	}
+
+	payload, err := json.Marshal(Envelope{
+		Version: EnvelopeVersion,
+		Type:    typ,
+		Data:    raw,
+		SentAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("encode envelope: %w", err)
+	}
+	return string(payload), nil
+}
+
+// DecodeEnvelope parses payload as an envelope. It returns an error wrapping ErrEnvelopeVersion if the envelope
+// version is not EnvelopeVersion.
+func DecodeEnvelope(payload string) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal([]byte(payload), &envelope); err != nil {
+		return nil, fmt.Errorf("decode envelope: %w", err)
+	}
+
+	if envelope.Version != EnvelopeVersion {
+		return nil, fmt.Errorf("%w: %d", ErrEnvelopeVersion, envelope.Version)
+	}
+	return &envelope, nil
+}
+
+type envelopeCtxKey struct{}
+
+// EnvelopeFromContext returns the envelope being handled by EnvelopeHandler, if any.
+func EnvelopeFromContext(ctx context.Context) (*Envelope, bool) {
+	envelope, ok := ctx.Value(envelopeCtxKey{}).(*Envelope)
+	return envelope, ok
+}
+
+// EnvelopeHandler is a Handler that decodes each notification payload as an envelope and dispatches it to the
+// handler for the envelope's type. That handler is called with a copy of the notification whose payload is the
+// envelope's data, and with a context from which the whole envelope is available via EnvelopeFromContext. Envelopes
+// of a type without a handler go to the handler for DefaultEnvelopeType if there is one.
+type EnvelopeHandler map[string]Handler
+
+// HandleNotification decodes notification and dispatches it by envelope type.
+func (h EnvelopeHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	envelope, err := DecodeEnvelope(notification.Payload)
+	if err != nil {
+		return err
+	}
+
+	handler, ok := h[envelope.Type]
+	if !ok {
+		handler, ok = h[DefaultEnvelopeType]
+		if !ok {
+			return fmt.Errorf("%w: %q", ErrUnknownEnvelopeType, envelope.Type)
+		}
+	}
+
+	data := *notification
+	data.Payload = string(envelope.Data)
+	return handler.HandleNotification(context.WithValue(ctx, envelopeCtxKey{}, envelope), &data, conn)
+}
+
+// HandleEnvelope sets an EnvelopeHandler dispatching to handlers by envelope type as the handler for notifications
+// sent to channel.
+func (l *Listener) HandleEnvelope(channel string, handlers map[string]Handler) {
+	l.Handle(channel, EnvelopeHandler(handlers))
+}
@@ -0,0 +1,92 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	before := time.Now().Add(-time.Second)
+
+	payload, err := pgxlisten.EncodeEnvelope("user.created", map[string]int{"id": 42})
+	require.NoError(t, err)
+
+	envelope, err := pgxlisten.DecodeEnvelope(payload)
+	require.NoError(t, err)
+	require.Equal(t, pgxlisten.EnvelopeVersion, envelope.Version)
+	require.Equal(t, "user.created", envelope.Type)
+	require.JSONEq(t, `{"id":42}`, string(envelope.Data))
+	require.True(t, envelope.SentAt.After(before))
+}
+
+func TestDecodeEnvelopeVersionMismatch(t *testing.T) {
+	_, err := pgxlisten.DecodeEnvelope(`{"v":2,"type":"user.created","data":{}}`)
+	require.ErrorIs(t, err, pgxlisten.ErrEnvelopeVersion)
+
+	_, err = pgxlisten.DecodeEnvelope(`not json`)
+	require.Error(t, err)
+}
+
+func TestListenerHandleEnvelope(t *testing.T) {
+	ctx := context.Background()
+
+	var received []string
+	record := func(prefix string) pgxlisten.Handler {
+		return pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			envelope, ok := pgxlisten.EnvelopeFromContext(ctx)
+			require.True(t, ok)
+			received = append(received, prefix+envelope.Type+":"+notification.Payload)
+			return nil
+		})
+	}
+
+	listener := &pgxlisten.Listener{}
+	listener.HandleEnvelope("events", map[string]pgxlisten.Handler{
+		"user.created": record("created "),
+		"user.deleted": record("deleted "),
+	})
+
+	for _, typ := range []string{"user.created", "user.deleted"} {
+		payload, err := pgxlisten.EncodeEnvelope(typ, 1)
+		require.NoError(t, err)
+		err = listener.Dispatch(ctx, &pgconn.Notification{Channel: "events", Payload: payload}, nil)
+		require.NoError(t, err)
+	}
+
+	payload, err := pgxlisten.EncodeEnvelope("user.renamed", 1)
+	require.NoError(t, err)
+	err = listener.Dispatch(ctx, &pgconn.Notification{Channel: "events", Payload: payload}, nil)
+	require.ErrorIs(t, err, pgxlisten.ErrUnknownEnvelopeType)
+
+	err = listener.Dispatch(ctx, &pgconn.Notification{Channel: "events", Payload: `{"v":0,"type":"user.created"}`}, nil)
+	require.ErrorIs(t, err, pgxlisten.ErrEnvelopeVersion)
+
+	require.Equal(t, []string{"created user.created:1", "deleted user.deleted:1"}, received)
+}
+
+func TestEnvelopeHandlerDefaultType(t *testing.T) {
+	ctx := context.Background()
+
+	var received []string
+	handler := pgxlisten.EnvelopeHandler{
+		pgxlisten.DefaultEnvelopeType: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			envelope, _ := pgxlisten.EnvelopeFromContext(ctx)
+			received = append(received, envelope.Type)
+			return nil
+		}),
+	}
+
+	payload, err := pgxlisten.EncodeEnvelope("anything", nil)
+	require.NoError(t, err)
+	err = handler.HandleNotification(ctx, &pgconn.Notification{Channel: "events", Payload: payload}, nil)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"anything"}, received)
+}
@@ -0,0 +1,8 @@
+package pgxlisten
+
+import "time"
+
+// JitterDuration exposes jitter to tests.
+func (l *Listener) JitterDuration(d time.Duration) time.Duration {
+	return l.jitter(d)
+}
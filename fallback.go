@@ -0,0 +1,80 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ConnMode describes which kind of connection a notification was received on.
+type ConnMode int
+
+const (
+	// ConnModePrimary means the connection was made by Listener.Connect.
+	ConnModePrimary ConnMode = iota
+
+	// ConnModeFallback means Listener.Connect failed and the connection was made by Listener.FallbackConnect. Data
+	// read on it may be stale.
+	ConnModeFallback
+)
+
+// String returns "primary" or "fallback".
+func (m ConnMode) String() string {
+	switch m {
+	case ConnModePrimary:
+		return "primary"
+	case ConnModeFallback:
+		return "fallback"
+	default:
+		return fmt.Sprintf("ConnMode(%d)", int(m))
+	}
+}
+
+type connModeCtxKey struct{}
+
+// ModeFromContext returns the mode of the connection the notification or backlog being handled was received on. It
+// returns ConnModePrimary if ctx does not come from a Listener, e.g. in Dispatch.
+func ModeFromContext(ctx context.Context) ConnMode {
+	mode, _ := ctx.Value(connModeCtxKey{}).(ConnMode)
+	return mode
+}
+
+type attemptCtxKey struct{}
+
+// AttemptFromContext returns the number of the connection attempt that Listener.Connect or Listener.FallbackConnect
+// is being called for. Attempts are counted from 1 since Listen was called and include failed attempts, so Connect can
+// use it to pick a different target on every reconnect, e.g. together with Listener.OnReconnectCause for client-side
+// failover. It returns 0 if ctx does not come from a Listener.
+func AttemptFromContext(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptCtxKey{}).(int)
+	return attempt
+}
+
+type generationCtxKey struct{}
+
+// GenerationFromContext returns the generation of the connection the notification or backlog being handled was
+// received on. The first connection established by Listen is generation 1 and each reconnect increments it, so a
+// handler can tell whether it runs after a reconnect and may have missed notifications, e.g. to re-check state. It
+// returns 0 if ctx does not come from a Listener's connection, e.g. in Dispatch.
+func GenerationFromContext(ctx context.Context) int {
+	generation, _ := ctx.Value(generationCtxKey{}).(int)
+	return generation
+}
+
+// connectWithFallback calls Connect and, if that fails and FallbackConnect is set, FallbackConnect.
+func (l *Listener) connectWithFallback(ctx context.Context, attempt int) (*pgx.Conn, ConnMode, error) {
+	ctx = context.WithValue(ctx, attemptCtxKey{}, attempt)
+	conn, err := l.connect(ctx, attempt)
+	if err == nil || l.FallbackConnect == nil {
+		return conn, ConnModePrimary, err
+	}
+
+	conn, fallbackErr := l.FallbackConnect(ctx)
+	if fallbackErr != nil {
+		return nil, ConnModePrimary, fmt.Errorf("%w; fallback: %w", err, fallbackErr)
+	}
+
+	l.logDebug(ctx, fmt.Sprintf("connected to fallback after connect failed: %v", err))
+	return conn, ConnModeFallback, nil
+}
@@ -0,0 +1,93 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// HandlerSet is a group of handlers that can be built independently of a Listener, e.g. one per package, and then
+// attached to a Listener with AddSet. Unlike the methods on Listener, registering the same channel twice or a nil
+// handler is not silently accepted; the mistakes are collected and reported by Validate and AddSet.
+//
+// The zero value is an empty set ready to use.
+type HandlerSet struct {
+	handlers map[string]*registration
+	order    []string
+	errs     []error
+}
+
+// Handle adds handler for notifications sent to channel to the set. See Listener.Handle.
+func (s *HandlerSet) Handle(channel string, handler Handler) {
+	s.add(channel, &registration{handler: handler})
+}
+
+// HandleWithError adds handler for notifications sent to channel to the set with onError receiving its errors. See
+// Listener.HandleWithError.
+func (s *HandlerSet) HandleWithError(channel string, handler Handler, onError func(context.Context, *pgconn.Notification, error)) {
+	s.add(channel, &registration{handler: handler, onError: onError})
+}
+
+// HandleWeighted adds handler for notifications sent to channel to the set with weight. See Listener.HandleWeighted.
+func (s *HandlerSet) HandleWeighted(channel string, weight int, handler Handler) {
+	s.add(channel, &registration{handler: handler, weight: weight})
+}
+
+func (s *HandlerSet) add(channel string, reg *registration) {
+	if reg.handler == nil {
+		s.errs = append(s.errs, fmt.Errorf("channel %s: nil handler", channel))
+		return
+	}
+	if _, ok := s.handlers[channel]; ok {
+		s.errs = append(s.errs, fmt.Errorf("channel %s: duplicate handler", channel))
+		return
+	}
+
+	if s.handlers == nil {
+		s.handlers = make(map[string]*registration)
+	}
+	s.handlers[channel] = reg
+	s.order = append(s.order, channel)
+}
+
+// Channels returns the channels in the set in the order they were added.
+func (s *HandlerSet) Channels() []string {
+	return append([]string(nil), s.order...)
+}
+
+// Validate returns an error describing every nil or duplicate handler added to the set, or nil if there were none.
+func (s *HandlerSet) Validate() error {
+	return errors.Join(s.errs...)
+}
+
+// AddSet validates set and registers its handlers on l. Channels are folded according to ChannelCaseMode first, so
+// channels of set that fold to the same name, or to that of a channel that already has a handler on l, count as
+// duplicates. Channels are checked with ValidateChannel unless AllowInvalidChannels is set. If there is any error, no
+// handlers are registered and the error describes all problems found.
+func (l *Listener) AddSet(set *HandlerSet) error {
+	errs := append([]error(nil), set.errs...)
+	folded := make(map[string]bool, len(set.order))
+	l.handlersMu.RLock()
+	for _, channel := range set.order {
+		name := l.channelName(channel)
+		if err := l.validateChannel(name); err != nil {
+			errs = append(errs, fmt.Errorf("channel %s: %w", channel, err))
+		}
+		if _, ok := l.handlers[name]; ok || folded[name] {
+			errs = append(errs, fmt.Errorf("channel %s: duplicate handler", channel))
+		}
+		folded[name] = true
+	}
+	l.handlersMu.RUnlock()
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("add handler set: %w", err)
+	}
+
+	for _, channel := range set.order {
+		l.register(l.channelName(channel), set.handlers[channel])
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestHandlerSetValidate(t *testing.T) {
+	nop := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	})
+
+	set := &pgxlisten.HandlerSet{}
+	set.Handle("foo", nop)
+	set.Handle("bar", nop)
+	require.NoError(t, set.Validate())
+	require.Equal(t, []string{"foo", "bar"}, set.Channels())
+
+	set.Handle("foo", nop)
+	set.HandleWeighted("baz", 2, nil)
+	err := set.Validate()
+	require.ErrorContains(t, err, "channel foo: duplicate handler")
+	require.ErrorContains(t, err, "channel baz: nil handler")
+	require.Equal(t, []string{"foo", "bar"}, set.Channels())
+
+	listener := &pgxlisten.Listener{}
+	require.Error(t, listener.AddSet(set))
+	require.ErrorContains(t, listener.Dispatch(context.Background(), &pgconn.Notification{Channel: "foo"}, nil), "missing handler")
+}
+
+func TestListenerAddSet(t *testing.T) {
+	ctx := context.Background()
+
+	var received []string
+	record := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		received = append(received, notification.Channel+":"+notification.Payload)
+		return nil
+	})
+
+	set := &pgxlisten.HandlerSet{}
+	set.Handle("foo", record)
+	set.Handle("bar", record)
+
+	listener := &pgxlisten.Listener{}
+	listener.Handle("baz", record)
+	require.NoError(t, listener.AddSet(set))
+
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "a"}, nil))
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "bar", Payload: "b"}, nil))
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "baz", Payload: "c"}, nil))
+	require.Equal(t, []string{"foo:a", "bar:b", "baz:c"}, received)
+
+	// A second set cannot take over a channel that is already handled.
+	other := &pgxlisten.HandlerSet{}
+	other.Handle("foo", record)
+	require.ErrorContains(t, listener.AddSet(other), "channel foo: duplicate handler")
+}
+
+func TestListenerAddSetChannelCaseMode(t *testing.T) {
+	nop := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	})
+
+	for _, tt := range []struct {
+		mode     pgxlisten.ChannelCaseMode
+		existing string
+	}{
+		{mode: pgxlisten.ChannelCaseLower, existing: "jobs"},
+		{mode: pgxlisten.ChannelCaseUpper, existing: "JOBS"},
+	} {
+		// A channel that folds to the name of an existing handler is a duplicate.
+		listener := &pgxlisten.Listener{ChannelCaseMode: tt.mode}
+		listener.Handle(tt.existing, nop)
+		set := &pgxlisten.HandlerSet{}
+		set.Handle("Jobs", nop)
+		require.ErrorContains(t, listener.AddSet(set), "channel Jobs: duplicate handler")
+
+		// So are two channels of the set that fold to the same name.
+		listener = &pgxlisten.Listener{ChannelCaseMode: tt.mode}
+		set = &pgxlisten.HandlerSet{}
+		set.Handle("Jobs", nop)
+		set.Handle(tt.existing, nop)
+		require.ErrorContains(t, listener.AddSet(set), "channel "+tt.existing+": duplicate handler")
+		require.ErrorContains(t, listener.Dispatch(context.Background(), &pgconn.Notification{Channel: "jobs"}, nil), "missing handler")
+	}
+
+	// Without folding the channels are distinct.
+	listener := &pgxlisten.Listener{}
+	listener.Handle("jobs", nop)
+	set := &pgxlisten.HandlerSet{}
+	set.Handle("Jobs", nop)
+	require.NoError(t, listener.AddSet(set))
+}
@@ -0,0 +1,84 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Seen records the idempotency keys of notifications that have been handled. See Listener.IdempotencyKey.
+type Seen interface {
+	// SeenBefore reports whether key has been marked seen.
+	SeenBefore(ctx context.Context, key string) (bool, error)
+
+	// MarkSeen marks key as seen.
+	MarkSeen(ctx context.Context, key string) error
+}
+
+// TxSeen is a Seen that can also mark keys seen within a transaction. Handlers registered with HandleTx use it so the
+// key is committed atomically with their work.
+type TxSeen interface {
+	Seen
+
+	// MarkSeenTx marks key as seen in tx.
+	MarkSeenTx(ctx context.Context, tx pgx.Tx, key string) error
+}
+
+// SeenTable is a TxSeen that stores keys in a table with a text primary key column named key, e.g.
+//
+//	create table notification_seen (key text primary key, seen_at timestamptz not null default now());
+type SeenTable struct {
+	// DB queries and updates the table, e.g. a *pgxpool.Pool. DB is required.
+	DB OutboxDB
+
+	// Table is the name of the table. It may be schema qualified. Table is required.
+	Table string
+}
+
+func (s *SeenTable) table() string {
+	return pgx.Identifier(strings.Split(s.Table, ".")).Sanitize()
+}
+
+// SeenBefore implements Seen.
+func (s *SeenTable) SeenBefore(ctx context.Context, key string) (bool, error) {
+	rows, _ := s.DB.Query(ctx, fmt.Sprintf("select exists (select 1 from %s where key = $1)", s.table()), key)
+	return pgx.CollectOneRow(rows, pgx.RowTo[bool])
+}
+
+// MarkSeen implements Seen.
+func (s *SeenTable) MarkSeen(ctx context.Context, key string) error {
+	_, err := s.DB.Exec(ctx, fmt.Sprintf("insert into %s (key) values ($1) on conflict do nothing", s.table()), key)
+	return err
+}
+
+// MarkSeenTx implements TxSeen.
+func (s *SeenTable) MarkSeenTx(ctx context.Context, tx pgx.Tx, key string) error {
+	_, err := tx.Exec(ctx, fmt.Sprintf("insert into %s (key) values ($1) on conflict do nothing", s.table()), key)
+	return err
+}
+
+type idempotencyKeyCtxKey struct{}
+
+// idempotencyKey returns the idempotency key of notification or "" if it should not be checked.
+func (l *Listener) idempotencyKey(notification *pgconn.Notification) string {
+	if l.Seen == nil || l.IdempotencyKey == nil {
+		return ""
+	}
+	return l.IdempotencyKey(notification)
+}
+
+// markSeenTx marks the idempotency key of the notification being handled with ctx seen in tx, if Seen is a TxSeen.
+func (l *Listener) markSeenTx(ctx context.Context, tx pgx.Tx) error {
+	key, _ := ctx.Value(idempotencyKeyCtxKey{}).(string)
+	txSeen, ok := l.Seen.(TxSeen)
+	if key == "" || !ok {
+		return nil
+	}
+	if err := txSeen.MarkSeenTx(ctx, tx, key); err != nil {
+		return fmt.Errorf("mark idempotency key %q seen: %w", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerIdempotencyKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_work_test, pgxlisten_seen_test;
+create table pgxlisten_work_test (key text not null);
+create table pgxlisten_seen_test (key text primary key);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_work_test, pgxlisten_seen_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		errCrash := errors.New("crash")
+		crash := false
+
+		// newListener simulates a process that starts with no state besides the database.
+		newListener := func() *pgxlisten.Listener {
+			listener := &pgxlisten.Listener{
+				DB:   conn,
+				Seen: &pgxlisten.SeenTable{DB: conn, Table: "pgxlisten_seen_test"},
+				IdempotencyKey: func(notification *pgconn.Notification) string {
+					return notification.Payload
+				},
+			}
+			listener.HandleTx("work", func(ctx context.Context, notification *pgconn.Notification, tx pgx.Tx) error {
+				_, err := tx.Exec(ctx, `insert into pgxlisten_work_test (key) values ($1)`, notification.Payload)
+				if err == nil && crash {
+					err = errCrash
+				}
+				return err
+			})
+			return listener
+		}
+
+		work := func() []string {
+			rows, _ := conn.Query(ctx, `select key from pgxlisten_work_test order by key`)
+			keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+			require.NoError(t, err)
+			return keys
+		}
+
+		listener := newListener()
+		require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "work", Payload: "k1"}, nil))
+		require.Equal(t, []string{"k1"}, work())
+
+		// The process crashes while handling k2, before its transaction commits.
+		crash = true
+		require.ErrorIs(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "work", Payload: "k2"}, nil), errCrash)
+		require.Equal(t, []string{"k1"}, work())
+		crash = false
+
+		// After restarting both are delivered again. k1 is skipped and k2 is handled.
+		listener = newListener()
+		require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "work", Payload: "k1"}, nil))
+		require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "work", Payload: "k2"}, nil))
+		require.Equal(t, []string{"k1", "k2"}, work())
+
+		seen, err := listener.Seen.SeenBefore(ctx, "k2")
+		require.NoError(t, err)
+		require.True(t, seen)
+	})
+}
@@ -0,0 +1,74 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// HandleLatest sets handler as the handler for notifications sent to channel, keeping only the latest of the
+// notifications that arrive within window. It suits channels where each payload supersedes the previous one, such as
+// the current price of something. The first notification starts the window and every notification that arrives before
+// it ends replaces the pending one. When window has passed handler is called once with the last notification
+// received, on the listening connection like WithConn. If Listen is between connections at that time the call is
+// retried every window until it reconnects. Errors from handler are passed to LogError.
+func (l *Listener) HandleLatest(channel string, window time.Duration, handler Handler) {
+	l.Handle(channel, &latestHandler{l: l, channel: l.channelName(channel), window: window, handler: handler})
+}
+
+type latestHandler struct {
+	l       *Listener
+	channel string
+	window  time.Duration
+	handler Handler
+
+	mu      sync.Mutex
+	pending *pgconn.Notification
+}
+
+func (h *latestHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	h.mu.Lock()
+	scheduled := h.pending != nil
+	h.pending = notification
+	h.mu.Unlock()
+
+	if !scheduled {
+		laterCtx := detachedContext(ctx)
+		time.AfterFunc(h.window, func() { h.handleLater(laterCtx) })
+	}
+	return nil
+}
+
+// handleLater calls handler with the pending notification once the window has passed.
+func (h *latestHandler) handleLater(ctx context.Context) {
+	err := h.l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		// Take the notification only now so one that arrived while waiting for the connection is not missed.
+		h.mu.Lock()
+		notification := h.pending
+		h.pending = nil
+		h.mu.Unlock()
+
+		return h.handler.HandleNotification(ctx, notification, conn)
+	})
+	if errors.Is(err, ErrNotConnected) {
+		h.l.mu.Lock()
+		running := h.l.run != nil
+		h.l.mu.Unlock()
+		if running {
+			time.AfterFunc(h.window, func() { h.handleLater(ctx) })
+			return
+		}
+
+		h.mu.Lock()
+		h.pending = nil
+		h.mu.Unlock()
+	}
+	if err != nil {
+		h.l.logError(ctx, fmt.Errorf("handle latest %s notification: %w", h.channel, err))
+	}
+}
@@ -0,0 +1,27 @@
+package pgxlisten
+
+import "context"
+
+// HandleWithMeta sets the handler for notifications sent to channel like Handle and attaches meta to the channel, so
+// one handler can serve many channels that each need their own configuration, such as a destination queue, without
+// keeping a separate map from channel to configuration. The handler's methods get meta from their context with
+// MetaFromContext and type assert it to what was attached.
+func (l *Listener) HandleWithMeta(channel string, meta any, handler Handler) {
+	l.register(channel, &registration{handler: handler, meta: meta})
+}
+
+type metaCtxKey struct{}
+
+// MetaFromContext returns the metadata attached with HandleWithMeta to the channel whose notification or backlog is
+// being handled with ctx. It returns nil if the channel has none.
+func MetaFromContext(ctx context.Context) any {
+	return ctx.Value(metaCtxKey{})
+}
+
+// metaContext returns ctx carrying the metadata of reg, if any.
+func (reg *registration) metaContext(ctx context.Context) context.Context {
+	if reg.meta == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, metaCtxKey{}, reg.meta)
+}
@@ -0,0 +1,206 @@
+package pgxlisten
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ReconnectCauseNetwork is the cause reported by Listener.OnReconnectCause and Metrics.ReconnectCause for errors that
+// carry no SQLSTATE.
+const ReconnectCauseNetwork = "network"
+
+// Metrics receives measurements from a Listener, e.g. to export them to a monitoring system. Methods are called
+// synchronously from Listen and must not block. Implementations should embed NopMetrics so they keep compiling when
+// methods are added.
+type Metrics interface {
+	// ObserveConnect records the duration of a call to Listener.Connect. attempt is the number of the attempt starting
+	// at 1 for the first call made by Listen, and err is the error Connect returned, if any.
+	ObserveConnect(d time.Duration, attempt int, err error)
+
+	// NotificationDropped records that a notification on channel was discarded without being handled.
+	NotificationDropped(channel string, reason DropReason)
+
+	// ObserveConnectionLifetime records how long a connection stayed up, from Connect returning until the Listener
+	// stopped using it, and err is the reason it stopped. Many short lifetimes indicate an unstable connection.
+	ObserveConnectionLifetime(d time.Duration, err error)
+
+	// QueueDepth records the number of notifications queued for a handler on channel. It is called whenever the queue
+	// changes while MaxConcurrency or Semaphore is in use.
+	QueueDepth(channel string, depth int)
+
+	// ReconnectCause records that Listen is about to reconnect because of an error with sqlstate. See
+	// Listener.OnReconnectCause.
+	ReconnectCause(sqlstate string)
+
+	// ObserveQueueDwell records how long a notification on channel waited in the queue between being received and its
+	// handler starting while MaxConcurrency or Semaphore is in use. It does not include the handler's run time. Dwell
+	// times that keep growing mean MaxConcurrency is too low for the load.
+	ObserveQueueDwell(channel string, d time.Duration)
+
+	// NotificationBytes records that a notification with a payload of n bytes was received on channel, including
+	// notifications that are dropped afterwards. Exported as a counter per channel it gives the payload throughput,
+	// which together with the notification rate shows whether a channel is chatty with small payloads or sparse with
+	// large ones, e.g. to tune MaxPayloadBytes or queue sizes.
+	NotificationBytes(channel string, n int)
+
+	// ObserveEndToEndLatency records the time from when a notification on channel was sent until its handler
+	// returned without error, the event-to-action latency that includes delivery, queueing, and handling. It is only
+	// called for payloads that are JSON objects with a "sent_at" RFC 3339 timestamp set by the sender, such as those
+	// of EncodeEnvelope, and skipped for others. The sender's clock is used for the start, so clock skew between hosts
+	// shifts the measurements; negative durations are recorded as 0. QueueDwellBuckets suit it as well.
+	ObserveEndToEndLatency(channel string, d time.Duration)
+}
+
+// NamedMetrics is a Metrics that can label measurements with the name of the Listener they come from. See
+// Listener.Name.
+type NamedMetrics interface {
+	Metrics
+
+	// WithName returns a Metrics that records measurements labeled with name. It is called once per Listener.
+	WithName(name string) Metrics
+}
+
+// QueueDwellBuckets are exponential histogram bucket upper bounds suitable for ObserveQueueDwell, ranging from 1
+// millisecond to about 1 minute.
+var QueueDwellBuckets = []time.Duration{
+	time.Millisecond,
+	4 * time.Millisecond,
+	16 * time.Millisecond,
+	64 * time.Millisecond,
+	256 * time.Millisecond,
+	1024 * time.Millisecond,
+	4096 * time.Millisecond,
+	16384 * time.Millisecond,
+	65536 * time.Millisecond,
+}
+
+// ConnectionLifetimeBuckets are exponential histogram bucket upper bounds suitable for ObserveConnectionLifetime,
+// ranging from 1 second to about 18 hours.
+var ConnectionLifetimeBuckets = []time.Duration{
+	time.Second,
+	4 * time.Second,
+	16 * time.Second,
+	64 * time.Second,
+	256 * time.Second,
+	1024 * time.Second,
+	4096 * time.Second,
+	16384 * time.Second,
+	65536 * time.Second,
+}
+
+// NopMetrics implements Metrics by discarding all measurements.
+type NopMetrics struct{}
+
+// ObserveConnect does nothing.
+func (NopMetrics) ObserveConnect(d time.Duration, attempt int, err error) {}
+
+// NotificationDropped does nothing.
+func (NopMetrics) NotificationDropped(channel string, reason DropReason) {}
+
+// ObserveConnectionLifetime does nothing.
+func (NopMetrics) ObserveConnectionLifetime(d time.Duration, err error) {}
+
+// QueueDepth does nothing.
+func (NopMetrics) QueueDepth(channel string, depth int) {}
+
+// ReconnectCause does nothing.
+func (NopMetrics) ReconnectCause(sqlstate string) {}
+
+// ObserveQueueDwell does nothing.
+func (NopMetrics) ObserveQueueDwell(channel string, d time.Duration) {}
+
+// NotificationBytes does nothing.
+func (NopMetrics) NotificationBytes(channel string, n int) {}
+
+// ObserveEndToEndLatency does nothing.
+func (NopMetrics) ObserveEndToEndLatency(channel string, d time.Duration) {}
+
+// metrics returns Metrics, labeled with Name if it is a NamedMetrics, or nil if Metrics is not set.
+func (l *Listener) metrics() Metrics {
+	if l.Metrics == nil {
+		return nil
+	}
+	named, ok := l.Metrics.(NamedMetrics)
+	if !ok || l.Name == "" {
+		return l.Metrics
+	}
+	l.namedMetrics.once.Do(func() {
+		l.namedMetrics.metrics = named.WithName(l.Name)
+	})
+	return l.namedMetrics.metrics
+}
+
+// observeEndToEnd records the end-to-end latency of notification, which has just been handled, if its payload carries
+// a sent_at timestamp.
+func (l *Listener) observeEndToEnd(notification *pgconn.Notification) {
+	m := l.metrics()
+	if m == nil || !strings.Contains(notification.Payload, `"sent_at"`) {
+		return
+	}
+	var sent struct {
+		SentAt time.Time `json:"sent_at"`
+	}
+	if err := json.Unmarshal([]byte(notification.Payload), &sent); err != nil || sent.SentAt.IsZero() {
+		return
+	}
+	m.ObserveEndToEndLatency(notification.Channel, max(l.now().Sub(sent.SentAt), 0))
+}
+
+type nameCtxKey struct{}
+
+// NameFromContext returns the Name of the Listener that is logging or handling with ctx. It returns "" if the
+// Listener has no Name or ctx does not come from a Listener.
+func NameFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(nameCtxKey{}).(string)
+	return name
+}
+
+// nameContext returns ctx carrying Name, if set.
+func (l *Listener) nameContext(ctx context.Context) context.Context {
+	if l.Name == "" || NameFromContext(ctx) == l.Name {
+		return ctx
+	}
+	return context.WithValue(ctx, nameCtxKey{}, l.Name)
+}
+
+// connect calls Connect and reports how long it took.
+func (l *Listener) connect(ctx context.Context, attempt int) (*pgx.Conn, error) {
+	start := l.now()
+	conn, err := l.Connect(ctx)
+	d := l.now().Sub(start)
+
+	if m := l.metrics(); m != nil {
+		m.ObserveConnect(d, attempt, err)
+	}
+	if l.OnConnectTiming != nil {
+		l.OnConnectTiming(d, attempt, err)
+	}
+
+	return conn, err
+}
+
+// reconnectCause classifies err, which made Listen reconnect, and reports it.
+func (l *Listener) reconnectCause(err error) {
+	if err == nil || (l.Metrics == nil && l.OnReconnectCause == nil) {
+		return
+	}
+
+	sqlstate := ReconnectCauseNetwork
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		sqlstate = pgErr.Code
+	}
+
+	if m := l.metrics(); m != nil {
+		m.ReconnectCause(sqlstate)
+	}
+	if l.OnReconnectCause != nil {
+		l.OnReconnectCause(sqlstate, err)
+	}
+}
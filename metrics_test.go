@@ -0,0 +1,500 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+type connectObservation struct {
+	d       time.Duration
+	attempt int
+	err     error
+}
+
+type recordingMetrics struct {
+	pgxlisten.NopMetrics
+
+	mu        sync.Mutex
+	connects  []connectObservation
+	drops     map[pgxlisten.DropReason]int
+	lifetimes chan time.Duration
+	maxDepths map[string]int
+	causes    map[string]int
+	dwells    []time.Duration
+	bytes     map[string]int
+	endToEnd  []time.Duration
+}
+
+func (m *recordingMetrics) ObserveConnect(d time.Duration, attempt int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.connects = append(m.connects, connectObservation{d: d, attempt: attempt, err: err})
+}
+
+func (m *recordingMetrics) NotificationDropped(channel string, reason pgxlisten.DropReason) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.drops == nil {
+		m.drops = make(map[pgxlisten.DropReason]int)
+	}
+	m.drops[reason]++
+}
+
+func (m *recordingMetrics) ObserveConnectionLifetime(d time.Duration, err error) {
+	if m.lifetimes != nil {
+		m.lifetimes <- d
+	}
+}
+
+func (m *recordingMetrics) QueueDepth(channel string, depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.maxDepths == nil {
+		m.maxDepths = make(map[string]int)
+	}
+	m.maxDepths[channel] = max(m.maxDepths[channel], depth)
+}
+
+func (m *recordingMetrics) ReconnectCause(sqlstate string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.causes == nil {
+		m.causes = make(map[string]int)
+	}
+	m.causes[sqlstate]++
+}
+
+func (m *recordingMetrics) ObserveQueueDwell(channel string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dwells = append(m.dwells, d)
+}
+
+func (m *recordingMetrics) NotificationBytes(channel string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.bytes == nil {
+		m.bytes = make(map[string]int)
+	}
+	m.bytes[channel] += n
+}
+
+func (m *recordingMetrics) ObserveEndToEndLatency(channel string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.endToEnd = append(m.endToEnd, d)
+}
+
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestListenerObservesConnectTiming(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		errUnavailable := errors.New("database unavailable")
+		metrics := &recordingMetrics{}
+		hookChan := make(chan connectObservation, 8)
+		connectAttempts := 0
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				connectAttempts++
+				if connectAttempts == 1 {
+					time.Sleep(50 * time.Millisecond)
+					return nil, errUnavailable
+				}
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			ReconnectDelay: 10 * time.Millisecond,
+			Metrics:        metrics,
+			OnConnectTiming: func(d time.Duration, attempt int, err error) {
+				hookChan <- connectObservation{d: d, attempt: attempt, err: err}
+			},
+		}
+
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		var observed []connectObservation
+		for i := 0; i < 2; i++ {
+			select {
+			case o := <-hookChan:
+				observed = append(observed, o)
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Equal(t, 1, observed[0].attempt)
+		require.ErrorIs(t, observed[0].err, errUnavailable)
+		require.GreaterOrEqual(t, observed[0].d, 50*time.Millisecond)
+		require.Equal(t, 2, observed[1].attempt)
+		require.NoError(t, observed[1].err)
+
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		require.Equal(t, observed, metrics.connects)
+	})
+}
+
+func TestListenerObservesConnectionLifetime(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		metrics := &recordingMetrics{lifetimes: make(chan time.Duration, 8)}
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			ReconnectDelay: 10 * time.Millisecond,
+			Metrics:        metrics,
+			Clock:          clock,
+		}
+
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		var listenerPID uint32
+		err := listener.WithConn(ctx, func(conn *pgx.Conn) error {
+			return conn.QueryRow(ctx, `select pg_backend_pid()`).Scan(&listenerPID)
+		})
+		require.NoError(t, err)
+
+		clock.Advance(90 * time.Second)
+		_, err = conn.Exec(ctx, `select pg_terminate_backend($1)`, listenerPID)
+		require.NoError(t, err)
+
+		select {
+		case d := <-metrics.lifetimes:
+			require.Equal(t, 90*time.Second, d)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		// The replacement connection reports its lifetime when Listen stops.
+		select {
+		case d := <-metrics.lifetimes:
+			require.Zero(t, d)
+		default:
+			t.Fatal("no lifetime observed for the second connection")
+		}
+	})
+}
+
+func TestListenerReconnectCause(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	errs := []error{
+		&pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"},
+		fmt.Errorf("dial: %w", errors.New("connection refused")),
+		&pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"},
+		&pgconn.PgError{Code: "28P01", Message: "password authentication failed"},
+	}
+	metrics := &recordingMetrics{}
+	var causes []string
+	connectAttempts := 0
+
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			err := errs[connectAttempts]
+			connectAttempts++
+			return nil, err
+		},
+		LogError:             func(ctx context.Context, err error) {},
+		ReconnectDelay:       -1,
+		MaxReconnectAttempts: len(errs),
+		Metrics:              metrics,
+		OnReconnectCause: func(sqlstate string, err error) {
+			causes = append(causes, sqlstate)
+		},
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	err := listener.Listen(ctx)
+	require.ErrorIs(t, err, pgxlisten.ErrMaxReconnectAttempts)
+
+	// The last error makes Listen give up rather than reconnect.
+	require.Equal(t, []string{"57P01", pgxlisten.ReconnectCauseNetwork, "57P01"}, causes)
+	require.Equal(t, map[string]int{"57P01": 2, pgxlisten.ReconnectCauseNetwork: 1}, metrics.causes)
+}
+
+func TestListenerObservesQueueDwell(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		metrics := &recordingMetrics{}
+		clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			MaxConcurrency: 1,
+			Metrics:        metrics,
+			Clock:          clock,
+		}
+
+		startedChan := make(chan struct{})
+		releaseChan := make(chan struct{})
+		handledChan := make(chan string, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			if notification.Payload == "0" {
+				close(startedChan)
+				<-releaseChan
+			}
+			handledChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		// Occupy the only handler, then queue more notifications while it is busy.
+		_, err := conn.Exec(ctx, `select pg_notify('foo', '0')`)
+		require.NoError(t, err)
+		select {
+		case <-startedChan:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		_, err = conn.Exec(ctx, `select pg_notify('foo', g::text) from generate_series(1, 3) g`)
+		require.NoError(t, err)
+
+		// Give the notifications time to be queued.
+		time.Sleep(500 * time.Millisecond)
+		clock.Advance(5 * time.Second)
+		close(releaseChan)
+
+		for i := 0; i < 4; i++ {
+			select {
+			case <-handledChan:
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		require.Equal(t, []time.Duration{0, 5 * time.Second, 5 * time.Second, 5 * time.Second}, metrics.dwells)
+	})
+}
+
+type namedMetrics struct {
+	recordingMetrics
+
+	names   []string
+	labeled *labeledMetrics
+}
+
+func (m *namedMetrics) WithName(name string) pgxlisten.Metrics {
+	m.names = append(m.names, name)
+	m.labeled = &labeledMetrics{Metrics: &m.recordingMetrics, name: name}
+	return m.labeled
+}
+
+type labeledMetrics struct {
+	pgxlisten.Metrics
+
+	name    string
+	dropped []string
+}
+
+func (m *labeledMetrics) NotificationDropped(channel string, reason pgxlisten.DropReason) {
+	m.dropped = append(m.dropped, m.name+"/"+channel)
+	m.Metrics.NotificationDropped(channel, reason)
+}
+
+func TestListenerName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	metrics := &namedMetrics{}
+	var logNames, handlerNames []string
+	listener := &pgxlisten.Listener{
+		Name:            "billing",
+		Metrics:         metrics,
+		MaxPayloadBytes: 4,
+		LogError: func(ctx context.Context, err error) {
+			logNames = append(logNames, pgxlisten.NameFromContext(ctx))
+		},
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		handlerNames = append(handlerNames, pgxlisten.NameFromContext(ctx))
+		return nil
+	}))
+
+	err := listener.ListenReceiver(ctx, &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "foo", Payload: "1"},
+			{Channel: "foo", Payload: "too large"},
+			{Channel: "bar", Payload: "2"},
+		},
+		err: io.EOF,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"billing"}, metrics.names)
+	labeled := metrics.labeled
+	require.Equal(t, 1, metrics.drops[pgxlisten.DropPayloadTooLarge])
+	require.Equal(t, []string{"billing/foo"}, labeled.dropped)
+	require.Equal(t, []string{"billing"}, handlerNames)
+	require.NotEmpty(t, logNames)
+	for _, name := range logNames {
+		require.Equal(t, "billing", name)
+	}
+
+	require.Empty(t, pgxlisten.NameFromContext(ctx))
+}
+
+func TestListenerObservesNotificationBytes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	metrics := &recordingMetrics{}
+	listener := &pgxlisten.Listener{
+		Metrics:         metrics,
+		MaxPayloadBytes: 8,
+		LogError:        func(ctx context.Context, err error) {},
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	err := listener.ListenReceiver(ctx, &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "foo", Payload: "1"},
+			{Channel: "foo", Payload: "123"},
+			{Channel: "foo", Payload: ""},
+			{Channel: "bar", Payload: "too large"},
+		},
+		err: io.EOF,
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"foo": 4, "bar": 9}, metrics.bytes)
+}
+
+func TestListenerObservesEndToEndLatency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	metrics := &recordingMetrics{}
+	listener := &pgxlisten.Listener{
+		Metrics:  metrics,
+		Clock:    &manualClock{now: start.Add(3 * time.Second)},
+		LogError: func(ctx context.Context, err error) {},
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		if strings.Contains(notification.Payload, "fail") {
+			return errors.New("failed")
+		}
+		return nil
+	}))
+
+	sentAt := start.Format(time.RFC3339Nano)
+	err := listener.ListenReceiver(ctx, &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "foo", Payload: `{"id":1,"sent_at":"` + sentAt + `"}`},
+			{Channel: "foo", Payload: `{"id":2}`},
+			{Channel: "foo", Payload: `not json "sent_at"`},
+			{Channel: "foo", Payload: `{"id":"fail","sent_at":"` + sentAt + `"}`},
+		},
+		err: io.EOF,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{3 * time.Second}, metrics.endToEnd)
+}
@@ -0,0 +1,192 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// MultiListener fans in notifications from several databases. It holds one Listener per source database and
+// registers its handlers on each of them, so notifications from all sources are dispatched to the same handlers. Each
+// source connects, reconnects, and reports to its own LogError and Metrics independently. Handlers can tell which
+// source a notification came from with SourceFromContext.
+type MultiListener struct {
+	// StartupConcurrency limits how many sources connect and subscribe at the same time when Listen starts, e.g. to
+	// avoid a burst of connections when the sources are shards of one database split with ModuloShard. A source that
+	// fails its first attempt makes room for the next one and keeps retrying on its own. If set to 0, all sources
+	// start at once.
+	StartupConcurrency int
+
+	// OnStartup is called once every source has either subscribed or failed its first attempt to connect and listen.
+	// err joins the errors of the sources that failed, each prefixed with its source name, and is nil if all of them
+	// subscribed. The healthy sources run regardless. OnStartup is optional.
+	OnStartup func(err error)
+
+	sources  map[string]*Listener
+	order    []string
+	handlers map[string]Handler
+}
+
+type sourceCtxKey struct{}
+
+// SourceFromContext returns the name of the MultiListener source that received the notification being handled.
+func SourceFromContext(ctx context.Context) (string, bool) {
+	source, ok := ctx.Value(sourceCtxKey{}).(string)
+	return source, ok
+}
+
+// AddSource adds listener as the source named name. Handlers registered with Handle, before or after, are set on
+// listener. Other settings such as Connect, LogError, and Metrics are taken from listener as is.
+func (m *MultiListener) AddSource(name string, listener *Listener) {
+	if m.sources == nil {
+		m.sources = make(map[string]*Listener)
+	}
+	if _, ok := m.sources[name]; !ok {
+		m.order = append(m.order, name)
+	}
+	m.sources[name] = listener
+
+	for channel, handler := range m.handlers {
+		listener.Handle(channel, newSourceHandler(name, handler))
+	}
+}
+
+// Source returns the Listener added as the source named name, or nil if there is none. It can be used to inspect the
+// Stats or BreakerState of that source.
+func (m *MultiListener) Source(name string) *Listener {
+	return m.sources[name]
+}
+
+// Handle sets the handler for notifications sent to channel on every source.
+func (m *MultiListener) Handle(channel string, handler Handler) {
+	if m.handlers == nil {
+		m.handlers = make(map[string]Handler)
+	}
+	m.handlers[channel] = handler
+
+	for name, listener := range m.sources {
+		listener.Handle(channel, newSourceHandler(name, handler))
+	}
+}
+
+// Listen runs Listen for every source concurrently, starting up to StartupConcurrency of them at a time. It returns
+// when ctx is cancelled or when any source returns a fatal error, in which case the other sources are stopped as well.
+// The returned error joins the errors returned by all sources, each prefixed with its source name.
+func (m *MultiListener) Listen(ctx context.Context) error {
+	if len(m.sources) == 0 {
+		return errors.New("Listen: No sources")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var sem Semaphore
+	if m.StartupConcurrency > 0 {
+		sem = NewSemaphore(m.StartupConcurrency)
+	}
+	startErrs := make([]error, len(m.order))
+	var startWG sync.WaitGroup
+	startWG.Add(len(m.order))
+
+	errs := make([]error, len(m.order))
+	var wg sync.WaitGroup
+	for i, name := range m.order {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer cancel()
+
+			if sem != nil {
+				if err := sem.Acquire(ctx); err != nil {
+					startWG.Done()
+					return
+				}
+			}
+			var once sync.Once
+			started := func(err error) {
+				once.Do(func() {
+					if err != nil {
+						startErrs[i] = fmt.Errorf("%s: %w", name, err)
+					}
+					if sem != nil {
+						sem.Release()
+					}
+					startWG.Done()
+				})
+			}
+
+			listener := m.sources[name]
+			listener.started = started
+			err := listener.Listen(ctx)
+			// Listen may return before it started, e.g. if it has no handlers.
+			started(err)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", name, err)
+			}
+		}()
+	}
+
+	if m.OnStartup != nil {
+		go func() {
+			startWG.Wait()
+			if ctx.Err() == nil {
+				m.OnStartup(errors.Join(startErrs...))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+// newSourceHandler returns handler wrapped to tag the context with source, preserving BacklogHandler and
+// ResultHandler. Code that looks for a concrete handler type must unwrap it with unwrapSource.
+func newSourceHandler(source string, handler Handler) Handler {
+	if backlogHandler, ok := handler.(BacklogHandler); ok {
+		return &sourceBacklogHandler{sourceHandler{source: source, handler: handler}, backlogHandler}
+	}
+	return &sourceHandler{source: source, handler: handler}
+}
+
+type sourceHandler struct {
+	source  string
+	handler Handler
+}
+
+func (h *sourceHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return h.handler.HandleNotification(context.WithValue(ctx, sourceCtxKey{}, h.source), notification, conn)
+}
+
+// HandleNotificationResult implements ResultHandler so the results of handler reach OnHandled. Handlers that are not
+// a ResultHandler report an empty result as they would unwrapped.
+func (h *sourceHandler) HandleNotificationResult(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (HandlerResult, error) {
+	return invokeHandler(context.WithValue(ctx, sourceCtxKey{}, h.source), h.handler, notification, conn)
+}
+
+type sourceBacklogHandler struct {
+	sourceHandler
+	backlogHandler BacklogHandler
+}
+
+func (h *sourceBacklogHandler) needsListeningConn() bool {
+	return needsListeningConn(h.backlogHandler)
+}
+
+func (h *sourceBacklogHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	return h.backlogHandler.HandleBacklog(context.WithValue(ctx, sourceCtxKey{}, h.source), channel, conn)
+}
+
+// unwrapSource returns the handler wrapped by newSourceHandler, or handler itself if it is not wrapped.
+func unwrapSource(handler Handler) Handler {
+	switch h := handler.(type) {
+	case *sourceHandler:
+		return h.handler
+	case *sourceBacklogHandler:
+		return h.handler
+	}
+	return handler
+}
@@ -0,0 +1,235 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestMultiListenerTagsSource(t *testing.T) {
+	ctx := context.Background()
+
+	shard1 := &pgxlisten.Listener{}
+	shard2 := &pgxlisten.Listener{}
+
+	multi := &pgxlisten.MultiListener{}
+	multi.AddSource("shard1", shard1)
+
+	var received []string
+	multi.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		source, ok := pgxlisten.SourceFromContext(ctx)
+		require.True(t, ok)
+		received = append(received, source+":"+notification.Payload)
+		return nil
+	}))
+
+	// Sources added after Handle get the handler too.
+	multi.AddSource("shard2", shard2)
+	require.Same(t, shard2, multi.Source("shard2"))
+
+	require.NoError(t, shard1.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "a"}, nil))
+	require.NoError(t, shard2.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "b"}, nil))
+
+	require.Equal(t, []string{"shard1:a", "shard2:b"}, received)
+}
+
+func TestMultiListenerForwardsOptionalInterfaces(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	var results []pgxlisten.HandlerResult
+	shard := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, errors.New("connect failed")
+		},
+		OnHandled: func(ctx context.Context, notification *pgconn.Notification, result pgxlisten.HandlerResult) {
+			results = append(results, result)
+		},
+	}
+	multi := &pgxlisten.MultiListener{}
+	multi.AddSource("shard", shard)
+
+	// The result of a ResultHandler reaches OnHandled of the source.
+	multi.Handle("foo", pgxlisten.ResultHandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (pgxlisten.HandlerResult, error) {
+		return pgxlisten.HandlerResult{RowsAffected: 2}, nil
+	}))
+	require.NoError(t, shard.Dispatch(ctx, &pgconn.Notification{Channel: "foo"}, nil))
+	require.Equal(t, []pgxlisten.HandlerResult{{RowsAffected: 2}}, results)
+
+	// A handler registered with HandleUnified still streams its backlog through BacklogChannel of the source, which
+	// gets as far as connecting.
+	unified := &pgxlisten.Listener{}
+	unified.HandleUnified("jobs", "select 1", func(rows pgx.Rows) (*pgconn.Notification, error) {
+		return &pgconn.Notification{}, nil
+	}, pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+	multi.Handle("jobs", unified.Registrations()[0].Handler)
+	row := <-shard.BacklogChannel(ctx, "jobs")
+	require.NotErrorIs(t, row.Err, pgxlisten.ErrNoBacklogHandler)
+	require.ErrorContains(t, row.Err, "connect failed")
+}
+
+func TestMultiListenerListenAggregatesErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	multi := &pgxlisten.MultiListener{}
+	err := multi.Listen(ctx)
+	require.Error(t, err)
+
+	// Neither source has Connect set so both fail immediately.
+	multi.AddSource("shard1", &pgxlisten.Listener{})
+	multi.AddSource("shard2", &pgxlisten.Listener{})
+	multi.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	err = multi.Listen(ctx)
+	require.ErrorContains(t, err, "shard1: Listen: Connect is nil")
+	require.ErrorContains(t, err, "shard2: Listen: Connect is nil")
+}
+
+func TestMultiListenerListen(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		connect := func(ctx context.Context) (*pgx.Conn, error) {
+			config := defaultConnTestRunner.CreateConfig(ctx, t)
+			return pgx.ConnectConfig(ctx, config)
+		}
+
+		// Both sources use the same database so every notification is received once from each.
+		multi := &pgxlisten.MultiListener{}
+		multi.AddSource("primary", &pgxlisten.Listener{Connect: connect})
+		multi.AddSource("secondary", &pgxlisten.Listener{Connect: connect})
+
+		sourceChan := make(chan string, 8)
+		multi.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			source, _ := pgxlisten.SourceFromContext(ctx)
+			sourceChan <- source
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerErrChan := make(chan error, 1)
+
+		go func() {
+			listenerErrChan <- multi.Listen(listenerCtx)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('foo', 'a')`)
+		require.NoError(t, err)
+
+		sources := map[string]bool{}
+		for i := 0; i < 2; i++ {
+			select {
+			case source := <-sourceChan:
+				sources[source] = true
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+		}
+		require.Equal(t, map[string]bool{"primary": true, "secondary": true}, sources)
+
+		listenerCtxCancel()
+
+		select {
+		case err := <-listenerErrChan:
+			require.ErrorIs(t, err, context.Canceled)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Equal(t, uint64(1), multi.Source("primary").Stats().Received)
+		require.Equal(t, uint64(1), multi.Source("secondary").Stats().Received)
+	})
+}
+
+func TestMultiListenerStartupConcurrency(t *testing.T) {
+	const connectTime = 200 * time.Millisecond
+
+	// startup starts four sources of which shard3 cannot connect. It returns how long it took until all of them had
+	// subscribed or failed and the error reported by OnStartup.
+	startup := func(concurrency int) (time.Duration, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+		defer cancel()
+
+		startupChan := make(chan error, 1)
+		multi := &pgxlisten.MultiListener{
+			StartupConcurrency: concurrency,
+			OnStartup: func(err error) {
+				startupChan <- err
+			},
+		}
+		for _, name := range []string{"shard1", "shard2", "shard3", "shard4"} {
+			multi.AddSource(name, &pgxlisten.Listener{
+				Connect: func(ctx context.Context) (*pgx.Conn, error) {
+					time.Sleep(connectTime)
+					if name == "shard3" {
+						return nil, errors.New("unavailable")
+					}
+					config := defaultConnTestRunner.CreateConfig(ctx, t)
+					return pgx.ConnectConfig(ctx, config)
+				},
+				LogError: func(ctx context.Context, err error) {},
+			})
+		}
+		multi.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenCtx, listenCancel := context.WithCancel(ctx)
+		defer listenCancel()
+		listenDoneChan := make(chan struct{})
+		start := time.Now()
+		go func() {
+			multi.Listen(listenCtx)
+			close(listenDoneChan)
+		}()
+
+		var err error
+		select {
+		case err = <-startupChan:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		elapsed := time.Since(start)
+
+		// The healthy shards are running despite shard3 failing.
+		for _, name := range []string{"shard1", "shard2", "shard4"} {
+			_, ok := multi.Source(name).BackendPID()
+			require.True(t, ok, name)
+		}
+
+		listenCancel()
+		select {
+		case <-listenDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+		return elapsed, err
+	}
+
+	serial, err := startup(1)
+	require.ErrorContains(t, err, "shard3: ")
+	require.ErrorContains(t, err, "unavailable")
+	require.GreaterOrEqual(t, serial, 4*connectTime)
+
+	parallel, err := startup(4)
+	require.ErrorContains(t, err, "shard3: ")
+	require.NotContains(t, err.Error(), "shard1")
+	require.Less(t, parallel, 2*connectTime)
+}
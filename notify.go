@@ -0,0 +1,98 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// NotifyDB runs the NOTIFY statements of a Notifier. It is implemented by *pgxpool.Pool, *pgx.Conn, and pgx.Tx.
+type NotifyDB interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// Notifier sends notifications, optionally debouncing chatty writers. It pairs with HandleLatest on the receiving side.
+// The zero value is not usable; DB must be set.
+type Notifier struct {
+	// DB sends the notifications, e.g. a *pgxpool.Pool. It should not be a Listener's connection. DB is required.
+	DB NotifyDB
+
+	// LogError is called with errors from debounced notifications, which are sent in the background. If nil, they are
+	// discarded.
+	LogError func(context.Context, error)
+
+	mu      sync.Mutex
+	pending map[string]*debouncedNotify
+}
+
+// debouncedNotify is a notification waiting for its debounce window to pass.
+type debouncedNotify struct {
+	payload string
+	timer   *time.Timer
+}
+
+// Notify sends a notification with payload on channel.
+func (n *Notifier) Notify(ctx context.Context, channel, payload string) error {
+	if _, err := n.DB.Exec(ctx, "select pg_notify($1, $2)", channel, payload); err != nil {
+		return fmt.Errorf("notify %s: %w", channel, err)
+	}
+	return nil
+}
+
+// NotifyDebounced sends a notification on channel once window has passed since the first call for channel that is not
+// yet sent. Calls in the meantime only replace the payload, so a burst of calls results in a single notification with
+// the last payload. Call Flush before the program exits so pending notifications are not lost.
+func (n *Notifier) NotifyDebounced(channel, payload string, window time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if d, ok := n.pending[channel]; ok {
+		d.payload = payload
+		return
+	}
+
+	if n.pending == nil {
+		n.pending = make(map[string]*debouncedNotify)
+	}
+	d := &debouncedNotify{payload: payload}
+	d.timer = time.AfterFunc(window, func() { n.notifyPending(channel, d) })
+	n.pending[channel] = d
+}
+
+// notifyPending sends d once its window has passed unless Flush already did.
+func (n *Notifier) notifyPending(channel string, d *debouncedNotify) {
+	n.mu.Lock()
+	if n.pending[channel] != d {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.pending, channel)
+	payload := d.payload
+	n.mu.Unlock()
+
+	ctx := context.Background()
+	if err := n.Notify(ctx, channel, payload); err != nil && n.LogError != nil {
+		n.LogError(ctx, err)
+	}
+}
+
+// Flush immediately sends all notifications that NotifyDebounced is holding back and returns any errors.
+func (n *Notifier) Flush(ctx context.Context) error {
+	n.mu.Lock()
+	pending := n.pending
+	n.pending = nil
+	n.mu.Unlock()
+
+	var errs []error
+	for channel, d := range pending {
+		d.timer.Stop()
+		if err := n.Notify(ctx, channel, d.payload); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
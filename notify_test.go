@@ -0,0 +1,95 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+// recordingNotifyDB records the arguments of each statement instead of running it.
+type recordingNotifyDB struct {
+	mu    sync.Mutex
+	calls [][]any
+	ch    chan struct{}
+}
+
+func (db *recordingNotifyDB) Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error) {
+	db.mu.Lock()
+	db.calls = append(db.calls, arguments)
+	db.mu.Unlock()
+	db.ch <- struct{}{}
+	return pgconn.CommandTag{}, nil
+}
+
+func TestNotifierNotifyDebounced(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	db := &recordingNotifyDB{ch: make(chan struct{}, 8)}
+	notifier := &pgxlisten.Notifier{DB: db}
+
+	for _, payload := range []string{"1", "2", "3"} {
+		notifier.NotifyDebounced("price", payload, 50*time.Millisecond)
+	}
+	notifier.NotifyDebounced("other", "a", time.Hour)
+
+	select {
+	case <-db.ch:
+	case <-ctx.Done():
+		t.Fatalf("%v", ctx.Err())
+	}
+
+	// Flush sends what is still held back.
+	err := notifier.Flush(ctx)
+	require.NoError(t, err)
+	<-db.ch
+
+	// The burst does not cause another notification later.
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, db.ch)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	require.Equal(t, [][]any{{"price", "3"}, {"other", "a"}}, db.calls)
+}
+
+func TestNotifierNotifyDebouncedDelivers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		notifyConn, err := pgx.ConnectConfig(ctx, defaultConnTestRunner.CreateConfig(ctx, t))
+		require.NoError(t, err)
+		defer notifyConn.Close(ctx)
+
+		_, err = conn.Exec(ctx, "listen price")
+		require.NoError(t, err)
+
+		notifier := &pgxlisten.Notifier{
+			DB: notifyConn,
+			LogError: func(ctx context.Context, err error) {
+				t.Errorf("unexpected error: %v", err)
+			},
+		}
+		for i := 1; i <= 5; i++ {
+			notifier.NotifyDebounced("price", fmt.Sprint(i), 100*time.Millisecond)
+		}
+
+		notification, err := conn.WaitForNotification(ctx)
+		require.NoError(t, err)
+		require.Equal(t, "5", notification.Payload)
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		defer waitCancel()
+		_, err = conn.WaitForNotification(waitCtx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
@@ -0,0 +1,50 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ListenOnce waits for the next notification on channel and returns it. It gets its own connection from Connect, so
+// it does not interfere with Listen running concurrently, and closes it before returning. Handlers, Router, and the
+// other settings used by Listen do not apply. If ctx is done first, ListenOnce returns ctx.Err().
+func (l *Listener) ListenOnce(ctx context.Context, channel string) (*pgconn.Notification, error) {
+	channel = l.channelName(channel)
+
+	if l.Connect == nil {
+		return nil, errors.New("ListenOnce: Connect is nil")
+	}
+
+	conn, err := l.Connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect: %w", err)
+	}
+	defer func() {
+		if err := conn.Close(context.WithoutCancel(ctx)); err != nil {
+			l.logError(ctx, err)
+		}
+	}()
+
+	ident := pgx.Identifier{channel}.Sanitize()
+	if _, err := l.exec(ctx, conn, "listen "+ident); err != nil {
+		return nil, fmt.Errorf("listen %q: %w", channel, err)
+	}
+
+	notification, err := conn.WaitForNotification(ctx)
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, fmt.Errorf("waiting for notification: %w", err)
+	}
+
+	if _, err := l.exec(ctx, conn, "unlisten "+ident); err != nil {
+		l.logError(ctx, fmt.Errorf("unlisten %q: %w", channel, err))
+	}
+
+	return notification, nil
+}
@@ -0,0 +1,146 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const defaultOutboxBatchSize = 100
+
+// OutboxDB runs the queries of an OutboxHandler. It is implemented by *pgxpool.Pool and *pgx.Conn.
+type OutboxDB interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+}
+
+// OutboxHandler is a Handler and BacklogHandler that implements the transactional outbox pattern. Events are written
+// to an outbox table in the same transaction as the change they describe, along with a NOTIFY carrying the event's
+// id. OutboxHandler processes each event as its notification arrives and finds events whose notification was missed,
+// e.g. while the Listener was disconnected, by scanning for unprocessed rows whenever the backlog is handled. A row is
+// marked processed by setting ProcessedColumn to now() after Process succeeds, and notifications for rows that are
+// already marked are skipped.
+//
+// Every event is processed at least once. An event may be processed more than once if marking it fails or if a
+// notification and a backlog scan race, so Process should be idempotent.
+type OutboxHandler struct {
+	// DB queries and updates the outbox table, e.g. a *pgxpool.Pool. It is not the listening connection, which cannot
+	// be used while handlers run concurrently. DB is required.
+	DB OutboxDB
+
+	// Table is the name of the outbox table. It may be schema qualified. Table is required.
+	Table string
+
+	// IDColumn is the bigint column identifying each event. Notification payloads must be its value. If empty, "id" is
+	// used.
+	IDColumn string
+
+	// ProcessedColumn is the nullable timestamptz column that is set once an event has been processed. If empty,
+	// "processed_at" is used.
+	ProcessedColumn string
+
+	// Process processes the event with id. Process is required.
+	Process func(ctx context.Context, id int64) error
+
+	// BatchSize limits how many unprocessed rows are read at a time when handling the backlog. If set to 0, the
+	// default of 100 is used.
+	BatchSize int
+}
+
+func (h *OutboxHandler) table() string {
+	return pgx.Identifier(strings.Split(h.Table, ".")).Sanitize()
+}
+
+func (h *OutboxHandler) idColumn() string {
+	if h.IDColumn == "" {
+		return "id"
+	}
+	return pgx.Identifier{h.IDColumn}.Sanitize()
+}
+
+func (h *OutboxHandler) processedColumn() string {
+	if h.ProcessedColumn == "" {
+		return "processed_at"
+	}
+	return pgx.Identifier{h.ProcessedColumn}.Sanitize()
+}
+
+// HandleNotification implements Handler.
+func (h *OutboxHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	id, err := strconv.ParseInt(notification.Payload, 10, 64)
+	if err != nil {
+		return fmt.Errorf("parse outbox id: %w", err)
+	}
+
+	// Skip events that a backlog scan has already processed.
+	sql := fmt.Sprintf("select %s is not null from %s where %s = $1", h.processedColumn(), h.table(), h.idColumn())
+	rows, _ := h.DB.Query(ctx, sql, id)
+	processed, err := pgx.CollectOneRow(rows, pgx.RowTo[bool])
+	if err != nil {
+		return fmt.Errorf("query outbox id %d: %w", id, err)
+	}
+	if processed {
+		return nil
+	}
+
+	return h.process(ctx, id)
+}
+
+// HandleBacklog implements BacklogHandler. It processes unprocessed rows in id order, up to BacklogLimitFromContext if
+// set, and returns ErrBacklogEmpty if there were none.
+func (h *OutboxHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	batchSize := h.BatchSize
+	if batchSize == 0 {
+		batchSize = defaultOutboxBatchSize
+	}
+	limit := BacklogLimitFromContext(ctx)
+
+	sql := fmt.Sprintf("select %[1]s from %[2]s where %[3]s is null and %[1]s > $1 order by %[1]s limit $2",
+		h.idColumn(), h.table(), h.processedColumn())
+
+	processed := 0
+	after := int64(-1 << 63)
+	for limit == 0 || processed < limit {
+		if limit > 0 {
+			batchSize = min(batchSize, limit-processed)
+		}
+		rows, _ := h.DB.Query(ctx, sql, after, batchSize)
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+		if err != nil {
+			return fmt.Errorf("query outbox: %w", err)
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		for _, id := range ids {
+			if err := h.process(ctx, id); err != nil {
+				return err
+			}
+			after = id
+			processed++
+		}
+	}
+
+	if processed == 0 {
+		return ErrBacklogEmpty
+	}
+	return nil
+}
+
+// process processes the event with id and marks it processed.
+func (h *OutboxHandler) process(ctx context.Context, id int64) error {
+	if err := h.Process(ctx, id); err != nil {
+		return fmt.Errorf("process outbox id %d: %w", id, err)
+	}
+
+	sql := fmt.Sprintf("update %s set %s = now() where %s = $1 and %[2]s is null", h.table(), h.processedColumn(), h.idColumn())
+	if _, err := h.DB.Exec(ctx, sql, id); err != nil {
+		return fmt.Errorf("mark outbox id %d processed: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerOutboxHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_outbox_test;
+create table pgxlisten_outbox_test (id bigint primary key generated by default as identity, msg text not null, processed_at timestamptz);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_outbox_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		insert := func(msg string, notify bool) int64 {
+			var id int64
+			err := conn.QueryRow(ctx, `insert into pgxlisten_outbox_test (msg) values ($1) returning id`, msg).Scan(&id)
+			require.NoError(t, err)
+			if notify {
+				_, err = conn.Exec(ctx, `select pg_notify('outbox', $1::text)`, id)
+				require.NoError(t, err)
+			}
+			return id
+		}
+
+		db, err := pgx.ConnectConfig(ctx, ctr.CreateConfig(ctx, t))
+		require.NoError(t, err)
+		defer db.Close(ctx)
+
+		processedChan := make(chan int64, 8)
+		handler := &pgxlisten.OutboxHandler{
+			DB:    db,
+			Table: "pgxlisten_outbox_test",
+			Process: func(ctx context.Context, id int64) error {
+				processedChan <- id
+				return nil
+			},
+		}
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			BacklogInterval: 100 * time.Millisecond,
+		}
+		listener.Handle("outbox", handler)
+
+		receive := func(expected int64) {
+			select {
+			case id := <-processedChan:
+				require.Equal(t, expected, id)
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", expected, ctx.Err())
+			}
+		}
+
+		// An event written while the Listener was not running is caught up by the backlog.
+		missed := insert("a", true)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		receive(missed)
+
+		// Notified events are processed via the notification.
+		receive(insert("b", true))
+
+		// Events whose notification was lost are found by the next backlog scan.
+		receive(insert("c", false))
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		// Each event was processed once and marked.
+		require.Empty(t, processedChan)
+		var unprocessed int
+		err = conn.QueryRow(ctx, `select count(*) from pgxlisten_outbox_test where processed_at is null`).Scan(&unprocessed)
+		require.NoError(t, err)
+		require.Zero(t, unprocessed)
+	})
+}
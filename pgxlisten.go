@@ -2,10 +2,17 @@
 package pgxlisten
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
@@ -13,13 +20,68 @@ import (
 
 const (
 	defaultKeepaliveTimeout = 30 * time.Second
+
+	defaultMaxBacklogIntervalFactor = 10
+
+	defaultJitter = 0.1
+
+	defaultListenConnQueryThreshold = 100 * time.Millisecond
+
+	defaultQueueHighWater = 0.5
+
+	defaultQueueCheckInterval = time.Minute
+
+	// handlerAbandonGrace is how long past HandlerTimeout a handler may take to react to its expired context before it
+	// is abandoned.
+	handlerAbandonGrace = 100 * time.Millisecond
+
+	// shutdownUnlistenTimeout is how long Listen waits for UNLISTEN when shutting down.
+	shutdownUnlistenTimeout = time.Second
 )
 
+// ErrPayloadTooLarge is reported when a notification is dropped because its payload exceeds
+// Listener.MaxPayloadBytes.
+var ErrPayloadTooLarge = errors.New("payload too large")
+
+// ErrMaxReconnectAttempts is returned by Listen when Listener.MaxReconnectAttempts consecutive attempts to connect
+// and listen have failed.
+var ErrMaxReconnectAttempts = errors.New("max reconnect attempts reached")
+
+// ErrInitialListen is returned by Listen when Listener.StrictInitialListen is set and LISTEN fails before Listen has
+// first subscribed. It wraps the error of the channel whose LISTEN failed.
+var ErrInitialListen = errors.New("initial LISTEN failed")
+
+// ErrAlreadyListening is returned by Listen and ListenReceiver when the Listener is already running either of them.
+var ErrAlreadyListening = errors.New("already listening")
+
+// ErrHandlerFailed is returned by Listen and ListenReceiver when Listener.FatalHandlerErrors is set and a handler
+// returned an error. It wraps that error.
+var ErrHandlerFailed = errors.New("handler failed")
+
+// ErrHandlerAbandoned is reported when a handler does not return within Listener.HandlerTimeout, or within
+// Listener.ShutdownTimeout when Listen returns, and is left running.
+var ErrHandlerAbandoned = errors.New("handler abandoned")
+
+// ErrBacklogEmpty may be returned by HandleBacklog to report that there was no backlog to process. It is not treated
+// as an error and is not passed to LogError. When Listener.AdaptiveBacklog is enabled it causes the interval until the
+// next backlog run for that channel to be lengthened.
+var ErrBacklogEmpty = errors.New("backlog empty")
+
+// ErrListenConnBlocked is reported through LogError when WarnOnListenConnQuery is set and a handler held the listening
+// connection for longer than ListenConnQueryThreshold.
+var ErrListenConnBlocked = errors.New("handler blocked the listening connection")
+
+// ErrConnDirty is reported through LogError when a handler returned with the listening connection closed, busy, or in
+// a transaction. Notifications are not delivered while a transaction is open, so Listen reconnects instead.
+var ErrConnDirty = errors.New("listening connection left dirty by handler")
+
 // Listener connects to a PostgreSQL server, listens for notifications, and dispatches them to handlers based on
 // channel.
 type Listener struct {
 	// Connect establishes or otherwise gets a connection for the exclusive use of the Listener. Listener takes
-	// responsibility for closing any connection it receives. Connect is required.
+	// responsibility for closing any connection it receives. Connect is called again for every reconnect and Listener
+	// keeps nothing from previous connections, so Connect alone decides where each connection goes. The attempt number
+	// is available from ctx with AttemptFromContext. Connect is required.
 	Connect func(ctx context.Context) (*pgx.Conn, error)
 
 	// LogError is called by Listen when a non-fatal error occurs. Most errors are non-fatal. For example, a database
@@ -29,13 +91,479 @@ type Listener struct {
 
 	LogDebug func(context.Context, string)
 
+	// OnExec is called with each SQL statement the Listener generates itself, such as LISTEN and UNLISTEN, just
+	// before it is run on the listening connection, e.g. for audit logging. It cannot prevent the statement from being
+	// run. Statements run by handlers, including HandleBacklog, are not reported. OnExec is optional.
+	OnExec func(ctx context.Context, sql string)
+
+	// BeforeWait is called with the listening connection at the top of every iteration of the receive loop, before
+	// Listener waits for the next notification, e.g. to update a heartbeat row or inspect session state. It runs on
+	// the receive loop, so notifications are not handled while it runs, and it is called at least once per
+	// notification, keepalive, backlog run, and request from methods such as WithConn; anything beyond a quick query
+	// delays all of them. conn must be left idle. If BeforeWait returns an error Listen reconnects. BeforeWait is
+	// optional.
+	BeforeWait func(ctx context.Context, conn *pgx.Conn) error
+
+	// Trace enables verbose tracing of the connection lifecycle through LogDebug: connecting, connected with the
+	// backend PID, each LISTEN, each notification received, handler start and end, disconnects with their error, and
+	// the delay before reconnecting. It is meant for diagnosing why notifications do not arrive. Trace has no effect
+	// unless LogDebug is set and costs nothing when disabled.
+	Trace bool
+
+	// SingleThreaded guarantees that all handler methods (HandleNotification and HandleBacklog) are called one at a
+	// time from the goroutine running Listen, so handlers may share state without synchronization. This is currently
+	// also the default; setting SingleThreaded keeps the guarantee even when options that run handlers concurrently
+	// are used or the default changes.
+	SingleThreaded bool
+
+	// HandlerTimeout limits how long HandleNotification may run. The handler's context expires after HandlerTimeout,
+	// and if the handler has not returned shortly after Listener stops waiting for it, reports ErrHandlerAbandoned, and
+	// moves on while the handler is left to finish on its own goroutine. An abandoned handler must not use the
+	// connection it was given any further. When SingleThreaded is set only the context expires and the handler is
+	// never abandoned. If set to 0, handlers have no time limit.
+	HandlerTimeout time.Duration
+
+	// HandlerRetries is how many more times HandleNotification is called for a notification after it returns an
+	// error, before the error is reported. Errors are only retried if the classifier given to HandleRetryable reports
+	// them as retryable; handlers registered otherwise have all errors retried. Abandoned handlers are never retried.
+	// If set to 0, handlers are not retried.
+	HandlerRetries int
+
+	// HandlerRetryDelay is how long to wait before each retry. If set to 0, handlers are retried immediately.
+	HandlerRetryDelay time.Duration
+
+	// FatalHandlerErrors makes handler errors fatal, for pipelines where losing an event is worse than restarting the
+	// process. The first error a handler method reports, after HandlerRetries are used up, is passed to LogError or the
+	// error handler as usual and then shuts Listen down as if its ctx had been cancelled, so DrainOnCancel applies, and
+	// Listen returns an error wrapping ErrHandlerFailed and the handler's error. Notifications received meanwhile may
+	// still be handled. If false, handler errors are only reported and Listen continues.
+	FatalHandlerErrors bool
+
+	// WarnOnListenConnQuery reports handlers that hold the listening connection for longer than
+	// ListenConnQueryThreshold, typically by running slow queries on the conn they are passed. No notifications are
+	// received meanwhile, so such queries belong on a pool. The warning is passed to LogError as an error wrapping
+	// ErrListenConnBlocked. Handlers run by MaxConcurrency or Semaphore do not get the listening connection and are
+	// never reported.
+	WarnOnListenConnQuery bool
+
+	// ListenConnQueryThreshold is how long a handler may hold the listening connection before WarnOnListenConnQuery
+	// reports it. If set to 0, the default of 100ms is used.
+	ListenConnQueryThreshold time.Duration
+
+	// MaxConcurrency enables concurrent handling. Received notifications are queued per channel and up to
+	// MaxConcurrency handlers run at once on their own goroutines, so a slow handler no longer delays receiving. Queued
+	// channels are served by weighted round-robin using the weights given to HandleWeighted, so a busy channel cannot
+	// monopolize the handlers. Handlers run this way are passed a nil conn since the listening connection cannot be
+	// used concurrently. Notifications still queued when Listen returns are dropped, unless DrainOnCancel is set in
+	// which case handling continues for up to DrainOnCancel. MaxConcurrency is ignored when SingleThreaded is set. If
+	// set to 0, handlers are called synchronously on the goroutine running Listen.
+	MaxConcurrency int
+
+	// Semaphore, if set, limits the number of handlers running at once in place of the internal limit of
+	// MaxConcurrency. Sharing one Semaphore between several Listeners caps their combined concurrency, e.g. with
+	// NewSemaphore for a process-wide worker budget. Setting Semaphore enables concurrent handling as described for
+	// MaxConcurrency, which is then ignored. Semaphore is ignored when SingleThreaded is set. Semaphore is optional.
+	Semaphore Semaphore
+
+	// QueueOverflow decides which notification is dropped when a queue bounded by HandleQueue is full. The default,
+	// OverflowDropNewest, drops the notification that was just received.
+	QueueOverflow OverflowPolicy
+
+	// MaxPayloadBytes limits the size of notification payloads passed to handlers. Notifications with larger payloads
+	// are dropped and reported to LogError. If set to 0, there is no limit beyond PostgreSQL's own.
+	MaxPayloadBytes int
+
+	// ChannelsFunc, if set, is called each time Listen connects to compute additional channels to listen to, e.g. by
+	// querying a table of tenants with conn. It allows the set of channels to change between connections without
+	// restarting. Notifications on channels that have no handler of their own go to DefaultHandler. Each connection
+	// starts without any subscriptions, so channels that are no longer returned are simply not listened to again.
+	// RefreshChannels calls it again to apply a changed set to the current connection, unlistening removed channels.
+	ChannelsFunc func(ctx context.Context, conn *pgx.Conn) ([]string, error)
+
+	// ShardFilter, if set, restricts the channels listened to to those for which it returns true, so that a fleet of
+	// Listeners can split the channels among themselves; see ModuloShard. It is applied to the channels of handlers,
+	// Router, and ChannelsFunc each time Listen connects, and to channels added with AddHandler, after their names are
+	// folded by ChannelCaseMode. ShardFilter is optional.
+	ShardFilter func(channel string) bool
+
+	// AppName identifies the listening connection in pg_stat_activity. If set, application_name is set on each
+	// connection to AppName followed by the channels listened to, e.g. "billing: invoices,payments", truncated to the
+	// 63 bytes PostgreSQL keeps. If empty, application_name is left as configured by Connect.
+	AppName string
+
+	// DefaultHandler handles notifications on channels that have no other handler, such as channels returned by
+	// ChannelsFunc. DefaultHandler is optional.
+	DefaultHandler Handler
+
+	// DB begins the transactions of handlers registered with HandleTx, e.g. a *pgxpool.Pool. If nil, transactions are
+	// begun on the connection passed to the handler, which is not available when MaxConcurrency or Semaphore is set.
+	// DB is optional.
+	DB TxBeginner
+
+	// OnHandled is called after each notification has been handled with the HandlerResult reported by the handler and
+	// the error it returned, e.g. to keep an audit trail. Handlers report results by implementing ResultHandler; for
+	// other handlers the result only carries the error. OnHandled is optional.
+	OnHandled func(ctx context.Context, notification *pgconn.Notification, result HandlerResult)
+
+	// Interceptors are run in order on each notification before it is routed to a handler. Each interceptor may
+	// observe the notification, return a rewritten notification to pass on in its place, or return false to drop it.
+	// Interceptors are optional.
+	Interceptors []func(*pgconn.Notification) (*pgconn.Notification, bool)
+
+	// DedupWindow enables dropping duplicate notifications. A notification is a duplicate if another with the same
+	// DedupKey was received within DedupWindow before it. PostgreSQL already collapses identical notifications sent in
+	// one transaction; DedupWindow also catches those sent by separate transactions or that differ in unimportant
+	// details. Duplicates are dropped after the Interceptors run. If set to 0, notifications are not deduplicated.
+	DedupWindow time.Duration
+
+	// IdempotencyKey returns the idempotency key of a notification, e.g. an event id in its payload. Notifications
+	// whose key Seen reports as seen before are skipped, and keys are marked seen once their handler succeeds. An
+	// empty key is not checked. Unlike DedupWindow this survives restarts if Seen is durable. IdempotencyKey has no
+	// effect unless Seen is set.
+	IdempotencyKey func(*pgconn.Notification) string
+
+	// Seen records which idempotency keys have been handled. If it is a TxSeen, handlers registered with HandleTx mark
+	// keys seen in the same transaction as their work. Seen is optional.
+	Seen Seen
+
+	// DedupKey returns the key that identifies duplicate notifications for DedupWindow, e.g. the payload without a
+	// timestamp field it contains. If nil, the channel and payload are used, so identical notifications sent by
+	// different writers are merged. A key that includes the notification's PID, such as DedupKeyWithPID, only drops
+	// repeats sent by the same backend. PIDs are reused once a backend exits, so they only tell writers apart over
+	// short windows and must not be treated as globally unique.
+	DedupKey func(*pgconn.Notification) string
+
+	// ReplayBuffer is the number of recent notifications kept for each channel so that handlers added later with
+	// AddHandlerReplay can catch up on them. Notifications are kept after the Interceptors and DedupWindow, whether or
+	// not they had a handler. If set to 0, nothing is kept.
+	ReplayBuffer int
+
+	// SuppressQueueSize is the number of notifications held for each channel suppressed with Suppress, to be handled
+	// by Unsuppress. Notifications beyond it are dropped with DropSuppressed. If set to 0, all notifications of
+	// suppressed channels are dropped.
+	SuppressQueueSize int
+
+	// Metrics receives measurements of the Listener's operation. If it is a NamedMetrics and Name is set, the
+	// measurements are labeled with Name. Metrics is optional.
+	Metrics Metrics
+
+	// ReceivedCounter, if set, is incremented for each notification received, for monitoring without implementing
+	// Metrics. It counts the same notifications as Stats.Received and may be shared by several Listeners.
+	// ReceivedCounter is optional.
+	ReceivedCounter *atomic.Int64
+
+	// ErrorCounter, if set, is incremented for each error reported to LogError or an error handler. ErrorCounter is
+	// optional.
+	ErrorCounter *atomic.Int64
+
+	// Name identifies the Listener in logs and metrics when a process runs several of them. The context passed to
+	// LogError, LogDebug, error handlers, and handlers carries it for NameFromContext, and it labels the measurements of
+	// a NamedMetrics. Name must not be changed once the Listener is in use. If empty, nothing is labeled.
+	Name string
+
+	// OnConnectTiming is called after each call to Connect with how long it took, the number of the attempt
+	// (starting at 1 for the first call made by Listen), and the error it returned, if any. OnConnectTiming is optional.
+	OnConnectTiming func(d time.Duration, attempt int, err error)
+
+	// OnReconnectCause is called each time Listen is about to reconnect with the SQLSTATE of the error that ended the
+	// previous attempt, or ReconnectCauseNetwork if it has none, e.g. because the network failed. It can be used to
+	// tell admin shutdowns (57P01) and idle timeouts (57P05) apart from network problems. The same is reported to
+	// Metrics. OnReconnectCause is optional.
+	OnReconnectCause func(sqlstate string, err error)
+
+	// Clock is used to take the measurements reported to Metrics and OnConnectTiming and to track DedupWindow. If nil,
+	// the system clock is used. Clock is optional and mostly useful in tests.
+	Clock Clock
+
+	// FallbackConnect is called to get a connection when Connect fails, e.g. to a replica that can serve while the
+	// primary is unavailable. The fallback must accept LISTEN, which a hot standby does not. Handlers can tell which
+	// connection a notification was received on with ModeFromContext. Each reconnect tries Connect first, but a
+	// fallback connection is kept until it is lost. FallbackConnect is optional.
+	FallbackConnect func(ctx context.Context) (*pgx.Conn, error)
+
+	// Router, if set, determines which channels are listened to and which handler each notification is dispatched to.
+	// Handlers registered with Handle are not used when Router is set. Router is optional.
+	Router Router
+
+	// AllowInvalidChannels disables the check that the channels of registered handlers are valid, which Listen,
+	// AddHandler, and AddSet perform by default. See ValidateChannel.
+	AllowInvalidChannels bool
+
+	// ChannelCaseMode decides how the case of channel names is treated. Channels given to Handle and its variants,
+	// AddHandler, Router.Channels, ChannelsFunc, and the methods that take a channel, such as Ready and Suppress, are
+	// folded accordingly, and LISTEN quotes the folded name, so registration, LISTEN, and routing agree. The channel of
+	// handled notifications is the folded name. ChannelCaseMode must be set before handlers are registered. If set to
+	// 0, the default of ChannelCasePreserve is used.
+	ChannelCaseMode ChannelCaseMode
+
 	// ReconnectDelay configures the amount of time to wait before reconnecting in case the connection to the database
 	// is lost. If set to 0, the default of 1 minute is used. A negative value disables the timeout entirely.
 	ReconnectDelay time.Duration
 
-	handlers map[string]Handler
+	// ReconnectBackoff decides the delay before reconnecting instead of ReconnectDelay, e.g. a FullJitterBackoff or a
+	// DecorrelatedJitterBackoff. It is reset whenever Listen has subscribed on a new connection. The breaker cooldown
+	// still takes precedence while the breaker is open. ReconnectBackoff is optional.
+	ReconnectBackoff Backoff
+
+	// ReconnectInitialDelay is the amount of time to wait before the first reconnect after a connection Listen had
+	// subscribed on is lost, instead of ReconnectDelay or ReconnectBackoff, e.g. to give a restarting database a moment
+	// to settle without delaying later attempts as long. Those still decide the delay between the attempts that follow
+	// until a connection subscribes again. If set to 0, the first reconnect waits like any other.
+	ReconnectInitialDelay time.Duration
+
+	// ReconnectLimit caps the rate of reconnects at ReconnectLimit per ReconnectLimitPeriod, regardless of
+	// ReconnectDelay and ReconnectBackoff, so a connection that keeps dropping cannot hammer the database. Reconnects
+	// take tokens from a bucket of ReconnectLimit tokens that refills at that rate, and once it is empty Listen waits for
+	// the next token, which is reported through LogDebug. If set to 0, reconnects are not rate limited.
+	ReconnectLimit int
+
+	// ReconnectLimitPeriod is the period of ReconnectLimit. If set to 0, the default of one minute is used.
+	ReconnectLimitPeriod time.Duration
+
+	handlersMu sync.RWMutex
+	handlers   map[string]*registration
+	unlistened map[string]unlistenedChannel
+
+	suppressMu sync.Mutex
+	suppressed map[string]*suppressedChannel
 
 	KeepaliveTimeout time.Duration
+
+	// RelistenInterval enables re-issuing LISTEN for every channel on the current connection every RelistenInterval. It
+	// is a safety net for connection-pooling proxies or server-side resets that can drop subscriptions while the
+	// connection stays up. LISTEN is idempotent, so it has no effect on subscriptions that are still in place. If set
+	// to 0, channels are only listened to when connecting.
+	RelistenInterval time.Duration
+
+	// OnQueueHighWater is called with the usage of the server's notification queue, as reported by QueueUsage, when a
+	// periodic check finds it at or above QueueHighWater after it was below. It warns that listeners are not keeping
+	// up before the queue fills and NOTIFY starts failing. It is called from the goroutine running Listen and must not
+	// block. OnQueueHighWater is optional; the queue is only checked when it is set.
+	OnQueueHighWater func(usage float64)
+
+	// QueueHighWater is the queue usage (0–1) at which OnQueueHighWater is called. If set to 0, the default of 0.5 is
+	// used.
+	QueueHighWater float64
+
+	// QueueCheckInterval is how often the queue usage is checked for OnQueueHighWater. If set to 0, the default of one
+	// minute is used.
+	QueueCheckInterval time.Duration
+
+	// MaxReconnectAttempts makes Listen give up and return an error wrapping ErrMaxReconnectAttempts after that many
+	// consecutive attempts fail to connect and listen. If set to 0, Listen keeps trying until ctx is cancelled.
+	MaxReconnectAttempts int
+
+	// StrictInitialListen makes Listen return an error wrapping ErrInitialListen if LISTEN fails for any channel before
+	// Listen has first subscribed to all channels, e.g. because a channel name is rejected, instead of reconnecting. It
+	// surfaces misconfiguration at startup. Once Listen has subscribed, LISTEN failures cause reconnects as usual.
+	StrictInitialListen bool
+
+	// SelfTestOnConnect makes Listen check every new connection by sending a notification to a channel private to the
+	// connection and waiting for it before listening to any channel. Unlike a keepalive, which only shows that the
+	// connection is up, it proves the LISTEN/NOTIFY round-trip works, which catches e.g. a connection-pooling proxy
+	// that does not deliver notifications. If the notification does not arrive within SelfTestTimeout, the error,
+	// which wraps ErrSelfTest, is passed to LogError and Listen reconnects.
+	SelfTestOnConnect bool
+
+	// SelfTestTimeout is how long SelfTestOnConnect waits for the test notification. If set to 0, the default of 5
+	// seconds is used.
+	SelfTestTimeout time.Duration
+
+	// OnSubscribed is called on the receive loop each time Listen has connected and listened to all channels, and has
+	// handled the backlog of those with a BacklogHandler, with the sorted channels it listens to. It signals that the
+	// Listener is fully operational, e.g. to mark it healthy, and is called again after each reconnect. Ready reports
+	// the same for individual channels. OnSubscribed is optional.
+	OnSubscribed func(ctx context.Context, channels []string)
+
+	// BreakerThreshold enables a circuit breaker on reconnects. After BreakerThreshold consecutive attempts fail to
+	// connect and listen, the breaker opens and Listen waits BreakerCooldown instead of ReconnectDelay before probing
+	// with a single attempt. A successful attempt closes the breaker. If set to 0, the breaker is disabled.
+	BreakerThreshold int
+
+	// BreakerCooldown configures how long Listen waits before probing the database while the circuit breaker is open.
+	// If set to 0, the default of 5 minutes is used.
+	BreakerCooldown time.Duration
+
+	// OnBreakerStateChange is called when the circuit breaker changes state. OnBreakerStateChange is optional.
+	OnBreakerStateChange func(context.Context, BreakerState)
+
+	// Jitter is the fraction by which keepalive and backlog intervals are randomly varied, so that many listeners
+	// started at the same time do not hit the database in lockstep. For example, 0.1 varies intervals by up to ±10%. If
+	// set to 0, the default of 0.1 is used. A negative value disables jitter.
+	Jitter float64
+
+	// JitterSeed seeds the random number generator used for Jitter. If set to 0, a random seed is used. Setting it
+	// makes the sequence of intervals reproducible, e.g. in tests.
+	JitterSeed uint64
+
+	// DrainOnCancel configures a grace window for notifications that have already been received when ctx passed to
+	// Listen is cancelled. Instead of discarding them, Listen stops listening and keeps handling them for up to
+	// DrainOnCancel before returning. Handlers called while draining receive a context that is not cancelled but
+	// expires at the end of the window. The handler that is running when ctx is cancelled still sees ctx cancelled. If
+	// set to 0, notifications that have not been handled when ctx is cancelled are discarded. Notifications of
+	// channels registered with a higher priority by HandlePriority are handled first.
+	//
+	// When MaxConcurrency or Semaphore is set, the window ends early once no notification is left queued. The contexts
+	// of the handlers still running are then cancelled, and Listen waits for them to return for up to ShutdownTimeout.
+	// The two add up: Listen returns at most DrainOnCancel plus ShutdownTimeout after ctx is cancelled, apart from the
+	// time UNLISTEN takes. Otherwise handlers run on the goroutine calling Listen, so the handler running when the
+	// window ends is only bounded by HandlerTimeout.
+	DrainOnCancel time.Duration
+
+	// ShutdownTimeout limits how long Listen waits, when it returns, for handlers that still run on their own
+	// goroutines because MaxConcurrency or Semaphore is set. It starts once ctx is cancelled and DrainOnCancel, if set,
+	// is over, at which point the handlers' contexts are cancelled. Handlers that have not returned by then are left
+	// running, and ErrHandlerAbandoned is reported through LogError. If set to 0, Listen waits until all have returned.
+	ShutdownTimeout time.Duration
+
+	// Prioritizer reports whether notification a should be handled before b. It orders the notifications that are
+	// pending at the same time: those handled while draining and, when MaxConcurrency or Semaphore is set, those queued
+	// for the dispatcher, which then ignores channel weights. Notifications of the same channel are still handled in
+	// the order they were received, so the next notification is picked among the oldest pending one of each channel.
+	// Setting Prioritizer gives up FIFO order across channels. It takes precedence over HandlePriority. Prioritizer is
+	// optional.
+	Prioritizer func(a, b *pgconn.Notification) bool
+
+	// BacklogInterval configures how often HandleBacklog is called for each channel whose handler is a BacklogHandler
+	// while the connection is up. If set to 0, backlog is only handled immediately after connecting.
+	BacklogInterval time.Duration
+
+	// AdaptiveBacklog enables adaptive backlog polling. Each time HandleBacklog returns ErrBacklogEmpty the interval
+	// until the next run for that channel is doubled, up to MaxBacklogInterval. The interval is reset to BacklogInterval
+	// as soon as HandleBacklog finds work. It has no effect unless BacklogInterval is set.
+	AdaptiveBacklog bool
+
+	// MaxBacklogInterval caps the interval reached by AdaptiveBacklog. If set to 0, the default of ten times
+	// BacklogInterval is used.
+	MaxBacklogInterval time.Duration
+
+	// DisableBacklog makes the Listener never call HandleBacklog, even for handlers that implement BacklogHandler, e.g.
+	// when a handler type that is also used elsewhere implements it but only live notifications are wanted here.
+	// RunBacklog returns ErrNoBacklogHandler while it is set.
+	DisableBacklog bool
+
+	// BacklogTimeout limits how long each call to HandleBacklog may take. Its context is cancelled when BacklogTimeout
+	// elapses and the error is reported like any other HandleBacklog error. If set to 0, HandleBacklog is only limited
+	// by the ctx passed to Listen.
+	BacklogTimeout time.Duration
+
+	// BacklogConcurrency limits how many channels' backlogs are handled at once after Listen connects. When it is
+	// greater than 1, the backlogs are handled once every channel is listened to, on their own goroutines, and Listen
+	// starts receiving once all have returned. HandleBacklog is then passed a nil conn since the listening connection
+	// cannot be used concurrently, so backlog handlers should use a connection of their own, e.g. from a pool. The
+	// backlogs of channels registered with HandleUnified, which query the listening connection, are still handled one
+	// at a time on it, alongside the others. This bounds the catch-up load on the database independently of
+	// MaxConcurrency. Later runs every BacklogInterval and those started by AddHandler or RunBacklog are not affected.
+	// BacklogConcurrency is ignored when SingleThreaded is set. If set to 0 or 1, backlogs are handled one at a time on
+	// the listening connection as each channel is listened to.
+	BacklogConcurrency int
+
+	// BacklogMaxPerRun limits how many items each call to HandleBacklog should process, so that a large backlog is
+	// worked off in steady steps instead of monopolizing the connection and the database in one long run. HandleBacklog
+	// gets the limit from BacklogLimitFromContext; OutboxHandler and ReliableMode honor it. A run that stops at the
+	// limit does not return ErrBacklogEmpty, so the rest is processed by the following runs every BacklogInterval,
+	// which should be set as well. If set to 0, backlog runs are not limited.
+	BacklogMaxPerRun int
+
+	// BacklogFilter, if set, is called for each backlog row the Listener reads itself, i.e. the rows returned by the
+	// query of a handler registered with HandleUnified, before the row is converted into a notification. channel is the
+	// channel whose backlog is handled and rows is positioned on the row, which BacklogFilter may read with Scan or
+	// Values but must not advance. Rows for which it reports false are skipped and counted in Stats.BacklogFiltered,
+	// and do not count against BacklogMaxPerRun. An error aborts the run and is reported like other HandleBacklog
+	// errors. Backlog handlers that read their own rows are not affected.
+	//
+	// A skipped row is not handled, so the query returns it again on every run unless it also excludes it. Queries
+	// that resume after the last handled row, e.g. by id, therefore keep rereading the skipped rows that follow it, and
+	// should exclude the rows BacklogFilter would skip, or mark them, so the backlog can advance. BacklogFilter is
+	// optional.
+	BacklogFilter func(channel string, row pgx.Rows) (bool, error)
+
+	stats        counters
+	dedup        dedupCache
+	replay       replayBuffer
+	running      atomic.Bool
+	receivedSeq  atomic.Uint64
+	namedMetrics struct {
+		once    sync.Once
+		metrics Metrics
+	}
+	jitterRand struct {
+		// mu guards rand, since backlogs handled concurrently call jitter from their own goroutines.
+		mu   sync.Mutex
+		rand *rand.Rand
+	}
+	dispatcher   *dispatcher
+	prevChannels []string
+	generation   int
+	carried      []queuedNotification
+
+	// everSubscribed is set once Listen has subscribed to all channels for StrictInitialListen.
+	everSubscribed bool
+
+	reconnectBucket tokenBucket
+
+	// started is called by Listen when it has first subscribed, with nil, or has failed its first attempt, with the
+	// error. It is set by MultiListener.
+	started func(err error)
+
+	mu           sync.Mutex
+	current      *session
+	ready        map[string]chan struct{}
+	breakerState BreakerState
+	run          *listenRun
+}
+
+// registration is a handler registered for a channel along with its options.
+type registration struct {
+	handler   Handler
+	onError   func(context.Context, *pgconn.Notification, error)
+	weight    int
+	queueSize int
+	priority  int
+
+	// isRetryable classifies handler errors for HandlerRetries. If nil, all errors are retryable.
+	isRetryable func(error) bool
+
+	// marksSeen is set for HandleTx handlers, which mark the idempotency key seen in their transaction if Seen is a
+	// TxSeen.
+	marksSeen bool
+
+	// inline is set for HandleInline handlers, which are not run by the dispatcher.
+	inline bool
+
+	// meta is the metadata attached with HandleWithMeta, passed to the handler's methods for MetaFromContext.
+	meta any
+}
+
+// session holds the state of a single connection established by Listen.
+type session struct {
+	conn         *pgx.Conn
+	connectedAt  time.Time
+	relistenAt   time.Time
+	listening    map[string]bool
+	queueCheckAt time.Time
+	queueHigh    bool
+
+	// keepaliveAt, backlogs, and the next field of each backlogSchedule are only changed by the receive loop, with
+	// Listener.mu held so NextKeepalive and NextBacklogRun can read them.
+	keepaliveAt time.Time
+	backlogs    map[string]*backlogSchedule
+
+	// deferBacklogs is set while Listen subscribes on a new connection with BacklogConcurrency greater than 1, so the
+	// backlogs are scheduled by listenChannel but handled together afterwards.
+	deferBacklogs bool
+
+	// requests and waitCancel are protected by Listener.mu.
+	requests   []*connRequest
+	waitCancel context.CancelFunc
+}
+
+// backlogSchedule tracks when HandleBacklog is next due for a channel.
+type backlogSchedule struct {
+	reg      *registration
+	handler  BacklogHandler
+	interval time.Duration
+	next     time.Time
 }
 
 func (l *Listener) keepaliveTime() time.Duration {
@@ -45,25 +573,145 @@ func (l *Listener) keepaliveTime() time.Duration {
 	return l.KeepaliveTimeout
 }
 
-// Handle sets the handler for notifications sent to channel.
+// jitter returns d randomly varied by up to Jitter in either direction.
+func (l *Listener) jitter(d time.Duration) time.Duration {
+	fraction := l.Jitter
+	if fraction == 0 {
+		fraction = defaultJitter
+	}
+	if fraction < 0 || d <= 0 {
+		return d
+	}
+
+	l.jitterRand.mu.Lock()
+	defer l.jitterRand.mu.Unlock()
+	if l.jitterRand.rand == nil {
+		seed := l.JitterSeed
+		if seed == 0 {
+			seed = rand.Uint64()
+		}
+		l.jitterRand.rand = rand.New(rand.NewPCG(seed, seed))
+	}
+
+	return d + time.Duration((l.jitterRand.rand.Float64()*2-1)*fraction*float64(d))
+}
+
+func (l *Listener) listenConnQueryThreshold() time.Duration {
+	if l.ListenConnQueryThreshold == 0 {
+		return defaultListenConnQueryThreshold
+	}
+	return l.ListenConnQueryThreshold
+}
+
+func (l *Listener) maxBacklogInterval() time.Duration {
+	if l.MaxBacklogInterval == 0 {
+		return l.BacklogInterval * defaultMaxBacklogIntervalFactor
+	}
+	return l.MaxBacklogInterval
+}
+
+// Handle sets the handler for notifications sent to channel. If handler also implements BacklogHandler its backlog is
+// handled as well, otherwise only HandleNotification is called.
 func (l *Listener) Handle(channel string, handler Handler) {
+	l.register(channel, &registration{handler: handler})
+}
+
+// HandleWithError sets the handler for notifications sent to channel like Handle. Errors returned by handler for this
+// channel are passed to onError instead of LogError. The notification is nil for errors returned by HandleBacklog. If
+// onError is nil, LogError is used.
+func (l *Listener) HandleWithError(channel string, handler Handler, onError func(context.Context, *pgconn.Notification, error)) {
+	l.register(channel, &registration{handler: handler, onError: onError})
+}
+
+// HandleWeighted sets the handler for notifications sent to channel like Handle and gives channel weight when
+// MaxConcurrency is set. Each round of the scheduler takes up to weight queued notifications from channel before moving
+// on to the next channel. Channels registered with Handle have weight 1.
+func (l *Listener) HandleWeighted(channel string, weight int, handler Handler) {
+	l.register(channel, &registration{handler: handler, weight: weight})
+}
+
+// HandleQueue sets the handler for notifications sent to channel like Handle and bounds the queue of notifications
+// waiting for a handler on channel to size when MaxConcurrency or Semaphore is set. Each channel has its own queue, so
+// a flood on one channel cannot use up the buffer of others. When the queue is full QueueOverflow decides which
+// notification is dropped. Channels registered with Handle have unbounded queues.
+func (l *Listener) HandleQueue(channel string, size int, handler Handler) {
+	l.register(channel, &registration{handler: handler, queueSize: size})
+}
+
+// HandlePriority sets the handler for notifications sent to channel like Handle and gives channel priority when
+// draining at shutdown. Once ctx passed to Listen is cancelled, notifications that are already received or queued are
+// handled in order of decreasing priority, so critical channels are not cut off when DrainOnCancel is short. Channels
+// registered with Handle have priority 0. Priority has no effect before shutdown.
+func (l *Listener) HandlePriority(channel string, priority int, handler Handler) {
+	l.register(channel, &registration{handler: handler, priority: priority})
+}
+
+// HandleInline sets the handler for notifications sent to channel like Handle, but always calls it on the receive
+// goroutine with the listening connection, even when MaxConcurrency or Semaphore is set. Without them every handler
+// runs inline already. An inline handler avoids the latency of queueing and starting a goroutine and sees the
+// notifications of channel strictly in order, but no notification of any channel is received while it runs, and it
+// does not count against MaxConcurrency. Handlers run by the dispatcher are isolated from receipt instead, at the cost
+// of that latency and of notifications of different channels being handled out of order. Handlers of channels whose
+// notifications are frequent or slow to handle should therefore not be inline. Whether a notification is handled
+// inline is decided by the channel it was received on, before the Interceptors run.
+func (l *Listener) HandleInline(channel string, handler Handler) {
+	l.register(channel, &registration{handler: handler, inline: true})
+}
+
+func (l *Listener) register(channel string, reg *registration) {
+	channel = l.channelName(channel)
+
+	l.handlersMu.Lock()
+	defer l.handlersMu.Unlock()
+
 	if l.handlers == nil {
-		l.handlers = make(map[string]Handler)
+		l.handlers = make(map[string]*registration)
 	}
 
-	l.handlers[channel] = handler
+	l.handlers[channel] = reg
+	delete(l.unlistened, channel)
 }
 
 // Listen listens for and handles notifications. It will only return when ctx is cancelled or a fatal error occurs.
 // Because Listen is intended to continue running even when there is a network or database outage most errors are not
 // considered fatal. For example, if connecting to the database fails it will wait a while and try to reconnect.
+//
+// Reconnecting loses the notifications the server had not yet sent on the old connection, so channels with a
+// BacklogHandler should recover them from their backlog. Notifications that had already been received are kept:
+// those queued for MaxConcurrency or Semaphore stay queued and continue to be handled while reconnecting, and those
+// the old connection had buffered but not yet returned, e.g. because they arrived while a backlog query or keepalive
+// was running, are queued or, when handled synchronously, handled on the new connection once it is listening. They are
+// handled with the mode and generation of the connection they were received on. Received notifications are only
+// dropped when Listen returns.
+//
+// Listen always returns a non-nil error:
+//
+//   - ctx.Err() when it stops because ctx was cancelled or its deadline passed. This is a clean shutdown.
+//   - ErrListenerShutdown when it stops because Shutdown was called. This is a clean shutdown too.
+//   - an error wrapping ErrMaxReconnectAttempts and the last connection error when MaxReconnectAttempts consecutive
+//     attempts have failed.
+//   - an error describing the misconfiguration when the Listener cannot start, e.g. because Connect is nil.
+//   - an error wrapping ErrHandlerFailed and the handler's error when FatalHandlerErrors is set and a handler failed.
+//   - an error wrapping ErrInitialListen and the LISTEN error when StrictInitialListen is set and LISTEN fails before
+//     Listen has first subscribed.
+//   - ErrAlreadyListening when Listen or ListenReceiver is already running on the Listener. A Listener may be
+//     listened with again once the previous call has returned.
+//
+// Callers using errgroup or similar can therefore treat any error other than context.Canceled,
+// context.DeadlineExceeded, or ErrListenerShutdown as a failure; ListenGroup does so.
 func (l *Listener) Listen(ctx context.Context) error {
+	if !l.running.CompareAndSwap(false, true) {
+		return ErrAlreadyListening
+	}
+	defer l.running.Store(false)
+	ctx = l.nameContext(ctx)
+
 	if l.Connect == nil {
 		return errors.New("Listen: Connect is nil")
 	}
 
-	if l.handlers == nil {
-		return errors.New("Listen: No handlers")
+	if err := l.checkHandlers(); err != nil {
+		return fmt.Errorf("Listen: %w", err)
 	}
 
 	reconnectDelay := time.Minute
@@ -71,105 +719,966 @@ func (l *Listener) Listen(ctx context.Context) error {
 		reconnectDelay = l.ReconnectDelay
 	}
 
-	for {
-		err := l.listen(ctx)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer l.startRun(cancel)()
+	defer l.startDispatcher(ctx)()
+
+	l.generation = 0
+	l.everSubscribed = false
+	l.reconnectBucket = tokenBucket{}
+	defer l.dropCarried()
+	failures := 0
+	for attempt := 1; ; attempt++ {
+		subscribed, err := l.listen(ctx, attempt)
 		if err != nil {
 			l.logError(ctx, err)
+			if l.tracing() {
+				l.logDebug(ctx, fmt.Sprintf("trace: disconnected: %v", err))
+			}
 		}
 
-		if reconnectDelay < 0 {
-			if err := ctx.Err(); err != nil {
-				return err
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+
+		if errors.Is(err, ErrInitialListen) {
+			l.reportStarted(err)
+			return err
+		}
+
+		if subscribed {
+			l.everSubscribed = true
+			failures = 0
+			if l.ReconnectBackoff != nil {
+				l.ReconnectBackoff.Reset()
 			}
+		} else {
+			failures++
+			l.reportStarted(err)
+		}
+
+		if l.MaxReconnectAttempts > 0 && failures >= l.MaxReconnectAttempts {
+			return fmt.Errorf("%w: %w", ErrMaxReconnectAttempts, err)
+		}
+
+		l.reconnectCause(err)
+
+		delay := reconnectDelay
+		switch {
+		case subscribed && l.ReconnectInitialDelay > 0:
+			delay = l.ReconnectInitialDelay
+		case l.ReconnectBackoff != nil:
+			delay = l.ReconnectBackoff.Next()
+		}
+		if l.BreakerThreshold > 0 && failures >= l.BreakerThreshold {
+			l.setBreakerState(ctx, BreakerOpen)
+			delay = l.breakerCooldown()
+		}
+		if wait := l.reconnectLimitWait(); wait > delay {
+			l.logDebug(ctx, fmt.Sprintf("reconnects rate limited: waiting %v", wait))
+			delay = wait
+		}
+
+		if l.tracing() {
+			l.logDebug(ctx, fmt.Sprintf("trace: reconnecting in %v", max(delay, 0)))
+		}
 
+		if delay < 0 {
 			continue
 		}
 
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(reconnectDelay):
+			return context.Cause(ctx)
+		case <-time.After(delay):
 			// If listenAndSendOneConn returned and ctx has not been cancelled that means there was a fatal database error.
 			// Wait a while to avoid busy-looping while the database is unreachable.
 		}
+
+		if l.BreakerState() == BreakerOpen {
+			l.setBreakerState(ctx, BreakerHalfOpen)
+		}
+	}
+}
+
+// checkHandlers returns an error if the Listener has no handlers or, unless AllowInvalidChannels is set, if any
+// channel is invalid.
+func (l *Listener) checkHandlers() error {
+	l.handlersMu.RLock()
+	noHandlers := l.handlers == nil
+	l.handlersMu.RUnlock()
+	if noHandlers && l.Router == nil && l.DefaultHandler == nil {
+		return errors.New("No handlers")
+	}
+
+	if !l.AllowInvalidChannels {
+		return l.ValidateChannels()
+	}
+	return nil
+}
+
+// startDispatcher starts the dispatcher if MaxConcurrency or Semaphore is in use. The returned function stops it.
+func (l *Listener) startDispatcher(ctx context.Context) func() {
+	if (l.MaxConcurrency <= 0 && l.Semaphore == nil) || l.SingleThreaded {
+		return func() {}
+	}
+
+	d := newDispatcher(ctx, l)
+	l.mu.Lock()
+	l.dispatcher = d
+	l.mu.Unlock()
+	return func() {
+		d.stop()
+		l.mu.Lock()
+		l.dispatcher = nil
+		l.mu.Unlock()
 	}
 }
 
-func (l *Listener) listen(ctx context.Context) error {
-	conn, err := l.Connect(ctx)
+// listen connects, listens, and handles notifications until an error occurs. subscribed reports whether it got as far
+// as listening to all channels.
+func (l *Listener) listen(ctx context.Context, attempt int) (subscribed bool, err error) {
+	// Mark ctx so that WithConn can detect calls from handlers running on the receive loop.
+	ctx = context.WithValue(ctx, receiveLoopCtxKey{}, true)
+
+	if l.tracing() {
+		l.logDebug(ctx, fmt.Sprintf("trace: connecting attempt %d", attempt))
+	}
+	conn, mode, err := l.connectWithFallback(ctx, attempt)
 	if err != nil {
-		return fmt.Errorf("connect: %w", err)
+		return false, fmt.Errorf("connect: %w", err)
 	}
+	if l.tracing() {
+		l.logDebug(ctx, fmt.Sprintf("trace: connected to %s backend pid %d", mode, conn.PgConn().PID()))
+	}
+	l.generation++
+	ctx = context.WithValue(ctx, connModeCtxKey{}, mode)
+	ctx = context.WithValue(ctx, generationCtxKey{}, l.generation)
+	connectedAt := l.now()
+	defer func() {
+		if m := l.metrics(); m != nil {
+			m.ObserveConnectionLifetime(l.now().Sub(connectedAt), err)
+		}
+	}()
 	defer func() {
 		if err := conn.Close(ctx); err != nil {
 			l.logError(ctx, err)
 		}
 	}()
 
-	for channel, handler := range l.handlers {
-		_, err := conn.Exec(ctx, "listen "+pgx.Identifier{channel}.Sanitize())
-		if err != nil {
-			return fmt.Errorf("listen %q: %w", channel, err)
+	s := &session{
+		conn:        conn,
+		connectedAt: connectedAt,
+		backlogs:    make(map[string]*backlogSchedule),
+		listening:   make(map[string]bool),
+	}
+	l.setSession(s)
+	defer l.clearSession(s)
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			l.carryBuffered(ctx, s)
+		}
+	}()
+
+	channels, err := l.channels(ctx, conn)
+	if err != nil {
+		return false, err
+	}
+	l.channelsChanged(ctx, channels)
+
+	if l.AppName != "" {
+		if _, err := l.exec(ctx, conn, "select set_config('application_name', $1, false)", appName(l.AppName, channels)); err != nil {
+			return false, fmt.Errorf("set application_name: %w", err)
 		}
+	}
+
+	if l.SelfTestOnConnect {
+		if err := l.selfTest(ctx, s); err != nil {
+			return false, err
+		}
+	}
 
-		if backlogHandler, ok := handler.(BacklogHandler); ok {
-			err := backlogHandler.HandleBacklog(ctx, channel, conn)
-			if err != nil {
-				l.logError(ctx, fmt.Errorf("handle backlog %q: %w", channel, err))
+	s.deferBacklogs = l.BacklogConcurrency > 1 && !l.SingleThreaded
+	for _, channel := range channels {
+		if err := l.listenChannel(ctx, s, channel); err != nil {
+			if l.StrictInitialListen && !l.everSubscribed {
+				return false, fmt.Errorf("%w: %w", ErrInitialListen, err)
 			}
+			return false, err
 		}
 	}
+	if s.deferBacklogs {
+		s.deferBacklogs = false
+		l.handleBacklogsConcurrently(ctx, s)
+	}
+
+	l.setBreakerState(ctx, BreakerClosed)
+	l.reportStarted(nil)
+	if l.OnSubscribed != nil {
+		l.OnSubscribed(ctx, s.listeningChannels())
+	}
+	l.handleCarried(ctx, s)
 
+	l.scheduleKeepalive(s)
+	s.relistenAt = time.Now().Add(l.RelistenInterval)
+	s.queueCheckAt = time.Now().Add(l.queueCheckInterval())
 	for {
-		if err := l.waitOnce(ctx, conn); err != nil {
-			return err
+		if err := checkConn(s.conn); err != nil {
+			return true, err
+		}
+		if l.BeforeWait != nil {
+			if err := l.BeforeWait(ctx, s.conn); err != nil {
+				return true, fmt.Errorf("BeforeWait: %w", err)
+			}
+		}
+		if err := l.waitOnce(ctx, s); err != nil {
+			if ctx.Err() != nil {
+				if l.DrainOnCancel > 0 {
+					l.drain(ctx, s)
+				} else {
+					l.unlistenAll(ctx, s)
+				}
+			}
+			return true, err
+		}
+	}
+}
+
+// carryBuffered keeps the notifications s has received but not yet returned when it fails, so they are handled after
+// reconnecting. They are queued if the dispatcher is running and otherwise kept for handleCarried.
+func (l *Listener) carryBuffered(ctx context.Context, s *session) {
+	// With ctx cancelled WaitForNotification only returns notifications that are already buffered.
+	bufferedCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	for {
+		notification, _ := s.conn.WaitForNotification(bufferedCtx)
+		if notification == nil {
+			return
+		}
+		if l.dispatcher != nil {
+			l.dispatch(ctx, notification, s.conn)
+		} else {
+			l.carried = append(l.carried, queuedNotification{
+				notification: notification,
+				mode:         ModeFromContext(ctx),
+				generation:   GenerationFromContext(ctx),
+				seq:          l.receivedSeq.Add(1),
+				queuedAt:     l.now(),
+			})
 		}
 	}
 }
 
-// waitOnce waits for a notification or a keepalive timeout, whichever comes
-// first.  Note that ONLY the WaitForNotification call takes place with a
-// timeout, and all other calls use the parent context.  Only the Wait call
-// needs a timeout here, and the rest use the parent context.
-func (l *Listener) waitOnce(parentCtx context.Context, conn *pgx.Conn) error {
-	timedCtx, cancel := context.WithTimeout(parentCtx, l.keepaliveTime())
+// handleCarried handles the notifications carried over from previous connections on s.
+func (l *Listener) handleCarried(ctx context.Context, s *session) {
+	for len(l.carried) > 0 && ctx.Err() == nil {
+		item := l.carried[0]
+		l.carried[0] = queuedNotification{}
+		l.carried = l.carried[1:]
+
+		itemCtx := context.WithValue(ctx, connModeCtxKey{}, item.mode)
+		itemCtx = context.WithValue(itemCtx, generationCtxKey{}, item.generation)
+		itemCtx = context.WithValue(itemCtx, receivedSeqCtxKey{}, item.seq)
+		l.dispatch(itemCtx, item.notification, s.conn)
+	}
+}
+
+// dropCarried drops the notifications that were carried over but not handled before Listen returned.
+func (l *Listener) dropCarried() {
+	for _, item := range l.carried {
+		l.drop(item.notification, DropShutdown)
+	}
+	l.carried = nil
+}
+
+// reportStarted calls started the first time it is called in a Listen call.
+func (l *Listener) reportStarted(err error) {
+	if l.started != nil {
+		l.started(err)
+		l.started = nil
+	}
+}
+
+// checkConn returns an error wrapping ErrConnDirty if conn is not idle and ready to wait for notifications, which
+// means a handler closed it, left a query unfinished, or left a transaction open.
+func checkConn(conn *pgx.Conn) error {
+	if conn.IsClosed() {
+		return fmt.Errorf("%w: connection closed", ErrConnDirty)
+	}
+	if conn.PgConn().IsBusy() {
+		return fmt.Errorf("%w: connection busy", ErrConnDirty)
+	}
+	if status := conn.PgConn().TxStatus(); status != 'I' {
+		return fmt.Errorf("%w: transaction status %q", ErrConnDirty, status)
+	}
+	return nil
+}
+
+// listenChannel listens to channel on s and handles its backlog if its handler is a BacklogHandler. It does nothing if
+// channel is not in the Listener's shard.
+func (l *Listener) listenChannel(ctx context.Context, s *session, channel string) error {
+	if l.ShardFilter != nil && !l.ShardFilter(channel) {
+		return nil
+	}
+
+	_, err := l.exec(ctx, s.conn, "listen "+pgx.Identifier{channel}.Sanitize())
+	if err != nil {
+		return fmt.Errorf("listen %q: %w", channel, err)
+	}
+	s.listening[channel] = true
+	l.setReady(channel)
+	if l.tracing() {
+		l.logDebug(ctx, fmt.Sprintf("trace: listening to %q", channel))
+	}
+
+	reg := l.route(&pgconn.Notification{Channel: channel})
+	if reg == nil {
+		return nil
+	}
+
+	if backlogHandler, ok := reg.handler.(BacklogHandler); ok && !l.DisableBacklog {
+		b := &backlogSchedule{reg: reg, handler: backlogHandler, interval: l.BacklogInterval}
+		l.mu.Lock()
+		s.backlogs[channel] = b
+		l.mu.Unlock()
+		if !s.deferBacklogs {
+			l.handleBacklog(ctx, s, s.conn, channel, b)
+		}
+	}
+
+	return nil
+}
+
+// unlistenChannel stops listening to channel on s and handling its backlog.
+func (l *Listener) unlistenChannel(ctx context.Context, s *session, channel string) error {
+	l.mu.Lock()
+	delete(s.backlogs, channel)
+	l.mu.Unlock()
+	delete(s.listening, channel)
+	l.mu.Lock()
+	l.resetReady(channel)
+	l.mu.Unlock()
+	if _, err := l.exec(ctx, s.conn, "unlisten "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return fmt.Errorf("unlisten %q: %w", channel, err)
+	}
+	return nil
+}
+
+// listeningChannels returns the channels listened to on s in sorted order.
+func (s *session) listeningChannels() []string {
+	channels := make([]string, 0, len(s.listening))
+	for channel := range s.listening {
+		channels = append(channels, channel)
+	}
+	slices.Sort(channels)
+	return channels
+}
+
+// relisten issues LISTEN again for every channel listened to on s and schedules the next run.
+func (l *Listener) relisten(ctx context.Context, s *session) error {
+	for _, channel := range s.listeningChannels() {
+		if _, err := l.exec(ctx, s.conn, "listen "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return fmt.Errorf("relisten %q: %w", channel, err)
+		}
+	}
+	s.relistenAt = time.Now().Add(l.RelistenInterval)
+	return nil
+}
+
+// checkQueueUsage calls OnQueueHighWater if the queue usage has reached QueueHighWater since the last check on s and
+// schedules the next check. Failing to get the usage is logged but does not affect the connection.
+func (l *Listener) checkQueueUsage(ctx context.Context, s *session) {
+	s.queueCheckAt = time.Now().Add(l.queueCheckInterval())
+
+	usage, err := l.queueUsage(ctx, s.conn)
+	if err != nil {
+		l.logError(ctx, fmt.Errorf("check queue usage: %w", err))
+		return
+	}
+
+	highWater := l.QueueHighWater
+	if highWater == 0 {
+		highWater = defaultQueueHighWater
+	}
+	high := usage >= highWater
+	if high && !s.queueHigh {
+		l.OnQueueHighWater(usage)
+	}
+	s.queueHigh = high
+}
+
+func (l *Listener) queueCheckInterval() time.Duration {
+	if l.QueueCheckInterval == 0 {
+		return defaultQueueCheckInterval
+	}
+	return l.QueueCheckInterval
+}
+
+// drain handles the notifications s has already received after ctx has been cancelled. It stops listening so the
+// server delivers nothing further, then handles what has been buffered until none remain or DrainOnCancel elapses.
+func (l *Listener) drain(ctx context.Context, s *session) {
+	drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), l.DrainOnCancel)
 	defer cancel()
 
-	notification, err := conn.WaitForNotification(timedCtx)
-	if errors.Is(err, context.DeadlineExceeded) {
-		if keepaliveErr := conn.Ping(parentCtx); keepaliveErr != nil {
-			return fmt.Errorf("keepalive failed after timeout (%w): %w", err, keepaliveErr)
+	// Any notifications sent before the server processes unlisten are read into the connection's buffer while waiting
+	// for the result.
+	if !l.unlistenAll(drainCtx, s) {
+		return
+	}
+
+	// ctx is already cancelled so WaitForNotification only returns notifications that are already buffered.
+	var notifications []*pgconn.Notification
+	for {
+		notification, err := s.conn.WaitForNotification(ctx)
+		if err != nil {
+			break
+		}
+		notifications = append(notifications, notification)
+	}
+	for _, notification := range l.prioritize(notifications) {
+		if drainCtx.Err() != nil {
+			return
+		}
+		l.dispatch(drainCtx, notification, s.conn)
+	}
+}
+
+// prioritize orders notifications by Prioritizer, or else by the priority of their channels, keeping notifications of
+// the same channel and those that are tied in the order they were received.
+func (l *Listener) prioritize(notifications []*pgconn.Notification) []*pgconn.Notification {
+	if l.Prioritizer == nil {
+		slices.SortStableFunc(notifications, func(a, b *pgconn.Notification) int {
+			return cmp.Compare(l.priority(b), l.priority(a))
+		})
+		return notifications
+	}
+
+	// Indexes into notifications of the notifications of each channel not yet ordered, by order of first arrival.
+	var queues [][]int
+	queueOf := make(map[string]int)
+	for i, notification := range notifications {
+		q, ok := queueOf[notification.Channel]
+		if !ok {
+			q = len(queues)
+			queueOf[notification.Channel] = q
+			queues = append(queues, nil)
+		}
+		queues[q] = append(queues[q], i)
+	}
+
+	ordered := make([]*pgconn.Notification, 0, len(notifications))
+	for len(ordered) < len(notifications) {
+		best := -1
+		for q, queue := range queues {
+			if len(queue) == 0 {
+				continue
+			}
+			if best == -1 {
+				best = q
+				continue
+			}
+			head, bestHead := notifications[queue[0]], notifications[queues[best][0]]
+			if l.Prioritizer(head, bestHead) || (!l.Prioritizer(bestHead, head) && queue[0] < queues[best][0]) {
+				best = q
+			}
+		}
+		ordered = append(ordered, notifications[queues[best][0]])
+		queues[best] = queues[best][1:]
+	}
+	return ordered
+}
+
+// priority returns the priority notification's channel was registered with by HandlePriority.
+func (l *Listener) priority(notification *pgconn.Notification) int {
+	if reg := l.route(notification); reg != nil {
+		return reg.priority
+	}
+	return 0
+}
+
+// unlistenAll stops listening to all channels on s when ctx has been cancelled and reports whether it succeeded. It
+// gives up after shutdownUnlistenTimeout so a connection that is already broken does not delay shutdown. A failure is
+// only logged at debug level since the connection is closed next anyway.
+func (l *Listener) unlistenAll(ctx context.Context, s *session) bool {
+	unlistenCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownUnlistenTimeout)
+	defer cancel()
+
+	if _, err := l.exec(unlistenCtx, s.conn, "unlisten *"); err != nil {
+		l.logDebug(ctx, fmt.Sprintf("shutdown: unlisten: %v", err))
+		return false
+	}
+	return true
+}
+
+// handleBacklog calls the backlog handler for channel with conn and schedules its next run. If the handler of channel
+// was replaced by one that is not a BacklogHandler, the backlog is unscheduled instead.
+func (l *Listener) handleBacklog(ctx context.Context, s *session, conn *pgx.Conn, channel string, b *backlogSchedule) {
+	if !l.currentBacklog(channel, b) {
+		l.mu.Lock()
+		delete(s.backlogs, channel)
+		l.mu.Unlock()
+		return
+	}
+
+	var err error
+	if l.Suppressed(channel) {
+		l.logDebug(ctx, fmt.Sprintf("backlog %q suppressed", channel))
+	} else {
+		backlogCtx, cancel := l.backlogContext(b.reg.metaContext(ctx))
+		err = b.handler.HandleBacklog(backlogCtx, channel, conn)
+		cancel()
+	}
+	if errors.Is(err, ErrBacklogEmpty) {
+		if l.AdaptiveBacklog {
+			b.interval = min(b.interval*2, l.maxBacklogInterval())
+		}
+		l.logDebug(ctx, fmt.Sprintf("backlog %q empty", channel))
+	} else {
+		if err != nil {
+			l.handlerError(ctx, b.reg, nil, fmt.Errorf("handle backlog %q: %w", channel, err))
+		}
+		b.interval = l.BacklogInterval
+	}
+	next := time.Now().Add(l.jitter(b.interval))
+	l.mu.Lock()
+	b.next = next
+	l.mu.Unlock()
+}
+
+// handleBacklogsConcurrently handles the backlogs scheduled on s, up to BacklogConcurrency at once, with a nil conn and
+// waits for them to return. Backlogs that need the listening connection are handled one at a time on it instead.
+func (l *Listener) handleBacklogsConcurrently(ctx context.Context, s *session) {
+	// handleBacklog may unschedule a backlog, so the schedules are collected first.
+	l.mu.Lock()
+	channels := make([]string, 0, len(s.backlogs))
+	for channel := range s.backlogs {
+		channels = append(channels, channel)
+	}
+	l.mu.Unlock()
+	slices.Sort(channels)
+
+	sem := NewSemaphore(l.BacklogConcurrency)
+	var wg sync.WaitGroup
+	for _, channel := range channels {
+		if err := sem.Acquire(ctx); err != nil {
+			break
+		}
+		l.mu.Lock()
+		b := s.backlogs[channel]
+		l.mu.Unlock()
+		if needsListeningConn(b.handler) {
+			l.handleBacklog(ctx, s, s.conn, channel, b)
+			sem.Release()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sem.Release()
+			l.handleBacklog(ctx, s, nil, channel, b)
+		}()
+	}
+	wg.Wait()
+}
+
+// listeningConnBacklogHandler is implemented by backlog handlers of the Listener that query the conn they are passed
+// and so cannot be handled with a nil conn.
+type listeningConnBacklogHandler interface {
+	needsListeningConn() bool
+}
+
+// needsListeningConn reports whether b must be handled on the listening connection.
+func needsListeningConn(b BacklogHandler) bool {
+	h, ok := b.(listeningConnBacklogHandler)
+	return ok && h.needsListeningConn()
+}
+
+// scheduleKeepalive schedules the next keepalive on s one jittered KeepaliveTimeout from now.
+func (l *Listener) scheduleKeepalive(s *session) {
+	keepaliveAt := time.Now().Add(l.jitter(l.keepaliveTime()))
+	l.mu.Lock()
+	s.keepaliveAt = keepaliveAt
+	l.mu.Unlock()
+}
+
+type backlogLimitCtxKey struct{}
+
+// BacklogLimitFromContext returns how many items the HandleBacklog call ctx was passed to should process at most, as
+// configured by Listener.BacklogMaxPerRun. It returns 0 if the run is not limited.
+func BacklogLimitFromContext(ctx context.Context) int {
+	limit, _ := ctx.Value(backlogLimitCtxKey{}).(int)
+	return limit
+}
+
+// backlogContext returns the context for a call to HandleBacklog, which is ctx limited to BacklogTimeout if set and
+// carrying BacklogMaxPerRun.
+func (l *Listener) backlogContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.BacklogMaxPerRun > 0 {
+		ctx = context.WithValue(ctx, backlogLimitCtxKey{}, l.BacklogMaxPerRun)
+	}
+	if l.BacklogTimeout > 0 {
+		return context.WithTimeout(ctx, l.BacklogTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// waitOnce waits for a notification, a keepalive timeout, or a due backlog
+// run, whichever comes first.  Note that ONLY the WaitForNotification call
+// takes place with a timeout, and all other calls use the parent context.
+// Only the Wait call needs a timeout here, and the rest use the parent context.
+func (l *Listener) waitOnce(parentCtx context.Context, s *session) error {
+	deadline := s.keepaliveAt
+	if l.RelistenInterval > 0 && s.relistenAt.Before(deadline) {
+		deadline = s.relistenAt
+	}
+	if l.OnQueueHighWater != nil && s.queueCheckAt.Before(deadline) {
+		deadline = s.queueCheckAt
+	}
+	if l.BacklogInterval > 0 {
+		for _, b := range s.backlogs {
+			if b.next.Before(deadline) {
+				deadline = b.next
+			}
+		}
+	}
+
+	timedCtx, cancel := context.WithDeadline(parentCtx, deadline)
+	defer cancel()
+
+	if l.runConnRequests(s, cancel) {
+		return nil
+	}
+	// Once runConnRequests has registered cancel, Unsuppress interrupts the wait below, so a channel unsuppressed
+	// after this call is released by the next one.
+	l.releaseSuppressed(parentCtx, s.conn)
+
+	notification, err := s.conn.WaitForNotification(timedCtx)
+	l.mu.Lock()
+	s.waitCancel = nil
+	l.mu.Unlock()
+	if errors.Is(err, context.Canceled) && parentCtx.Err() == nil {
+		// Interrupted by a connRequest. It is run at the start of the next call.
+		return nil
+	} else if errors.Is(err, context.DeadlineExceeded) && parentCtx.Err() == nil {
+		now := time.Now()
+		if l.RelistenInterval > 0 && !now.Before(s.relistenAt) {
+			if err := l.relisten(parentCtx, s); err != nil {
+				return err
+			}
+		}
+		if l.OnQueueHighWater != nil && !now.Before(s.queueCheckAt) {
+			l.checkQueueUsage(parentCtx, s)
 		}
-		if l.LogDebug != nil {
-			l.LogDebug(timedCtx, "keepalive timed out")
+		if now.Before(s.keepaliveAt) {
+			for channel, b := range s.backlogs {
+				if l.BacklogInterval > 0 && !now.Before(b.next) {
+					l.handleBacklog(parentCtx, s, s.conn, channel, b)
+				}
+			}
+			return nil
+		}
+
+		if keepaliveErr := s.conn.Ping(parentCtx); keepaliveErr != nil {
+			return fmt.Errorf("keepalive failed after timeout (%w): %w", err, keepaliveErr)
 		}
+		l.scheduleKeepalive(s)
+		l.logDebug(timedCtx, "keepalive timed out")
 		return nil
 	} else if err != nil {
 		return fmt.Errorf("waiting for notification: %w", err)
 	}
+	l.scheduleKeepalive(s)
+	if l.tracing() {
+		l.logDebug(parentCtx, fmt.Sprintf("trace: received %q notification with %d byte payload from pid %d",
+			notification.Channel, len(notification.Payload), notification.PID))
+	}
+
+	l.dispatch(parentCtx, notification, s.conn)
+	return nil
+}
+
+// dispatch hands notification to the dispatcher if MaxConcurrency or Semaphore is in use, otherwise it processes it
+// immediately. notification is numbered in the order it was received unless ctx already carries its number.
+func (l *Listener) dispatch(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) {
+	notification = l.foldChannel(notification)
+	seq := receivedSeq(ctx)
+	if seq == 0 {
+		seq = l.receivedSeq.Add(1)
+		ctx = context.WithValue(ctx, receivedSeqCtxKey{}, seq)
+	}
+	if l.dispatcher != nil && !l.inline(notification) {
+		l.dispatcher.enqueue(notification, ModeFromContext(ctx), GenerationFromContext(ctx), seq)
+		return
+	}
+	l.process(ctx, notification, conn)
+}
+
+// foldChannel returns notification with its channel folded according to ChannelCaseMode. Only notifications from a
+// Receiver or passed to Dispatch can differ, since LISTEN uses folded names. notification is not modified.
+func (l *Listener) foldChannel(notification *pgconn.Notification) *pgconn.Notification {
+	channel := l.channelName(notification.Channel)
+	if channel == notification.Channel {
+		return notification
+	}
+	folded := *notification
+	folded.Channel = channel
+	return &folded
+}
+
+// inline reports whether notification is routed to a handler registered with HandleInline.
+func (l *Listener) inline(notification *pgconn.Notification) bool {
+	reg := l.route(notification)
+	return reg != nil && reg.inline
+}
+
+// process handles notification and reports any resulting error.
+func (l *Listener) process(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) {
+	reg, err := l.handle(ctx, notification, conn)
+	l.reportHandled(ctx, reg, notification, err)
+}
+
+// reportHandled reports err, returned by handle or deliver for notification routed to reg.
+func (l *Listener) reportHandled(ctx context.Context, reg *registration, notification *pgconn.Notification, err error) {
+	switch {
+	case err == nil:
+	case reg == nil:
+		l.logError(ctx, err)
+	default:
+		l.handlerError(ctx, reg, notification, fmt.Errorf("handle %s notification: %w", notification.Channel, err))
+	}
+}
+
+// handle runs notification through the interceptors, routes it to its handler and calls it. It returns the
+// registration notification was routed to, or nil if there is none, and the resulting error. Both are nil if an
+// interceptor or DedupWindow dropped notification or its channel is suppressed. The error is nil if Seen reported
+// notification as seen before.
+func (l *Listener) handle(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (*registration, error) {
+	l.stats.received.Add(1)
+	if l.ReceivedCounter != nil {
+		l.ReceivedCounter.Add(1)
+	}
+	if m := l.metrics(); m != nil {
+		m.NotificationBytes(notification.Channel, len(notification.Payload))
+	}
+
+	if l.MaxPayloadBytes > 0 && len(notification.Payload) > l.MaxPayloadBytes {
+		l.drop(notification, DropPayloadTooLarge)
+		return nil, fmt.Errorf("%s notification: %w: %d bytes", notification.Channel, ErrPayloadTooLarge, len(notification.Payload))
+	}
+
+	for _, intercept := range l.Interceptors {
+		var ok bool
+		notification, ok = intercept(notification)
+		if !ok {
+			return nil, nil
+		}
+	}
+
+	if l.DedupWindow > 0 && l.dedup.seen(l.dedupKey(notification), l.now(), l.DedupWindow) {
+		l.drop(notification, DropDuplicate)
+		return nil, nil
+	}
+
+	if l.suppress(ctx, notification) {
+		return nil, nil
+	}
+
+	return l.deliver(ctx, notification, conn)
+}
+
+// deliver routes notification to its handler and calls it, like handle after the interceptors and DedupWindow.
+func (l *Listener) deliver(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (*registration, error) {
+	reg, unlistened := l.routeUnlistened(ctx, notification)
+	if unlistened {
+		l.drop(notification, DropUnlistened)
+		return nil, nil
+	}
+	if reg == nil {
+		reg = l.routeAndRecord(notification)
+	}
+	if reg == nil {
+		return nil, fmt.Errorf("missing handler: %s", notification.Channel)
+	}
 
-	if handler, ok := l.handlers[notification.Channel]; ok {
-		err := handler.HandleNotification(parentCtx, notification, conn)
+	key := l.idempotencyKey(notification)
+	if key != "" {
+		seen, err := l.Seen.SeenBefore(ctx, key)
 		if err != nil {
-			l.logError(parentCtx, fmt.Errorf("handle %s notification: %w", notification.Channel, err))
+			return reg, fmt.Errorf("check idempotency key %q: %w", key, err)
 		}
-	} else {
-		l.logError(parentCtx, fmt.Errorf("missing handler: %s", notification.Channel))
+		if seen {
+			return reg, nil
+		}
+		ctx = context.WithValue(ctx, idempotencyKeyCtxKey{}, key)
 	}
-	return nil
+
+	if l.tracing() {
+		l.logDebug(ctx, fmt.Sprintf("trace: handler start %q", notification.Channel))
+	}
+	warnBlocked := conn != nil && l.WarnOnListenConnQuery
+	var start time.Time
+	if warnBlocked {
+		start = l.now()
+	}
+	result, err := l.callHandlerRetrying(reg.metaContext(ctx), reg, notification, conn)
+	if warnBlocked {
+		if d := l.now().Sub(start); d > l.listenConnQueryThreshold() {
+			l.logError(ctx, fmt.Errorf("%w: %s handler took %v; run slow queries on a pool instead of the conn passed to handlers",
+				ErrListenConnBlocked, notification.Channel, d))
+		}
+	}
+	if l.tracing() {
+		l.logDebug(ctx, fmt.Sprintf("trace: handler end %q: %v", notification.Channel, err))
+	}
+	if err == nil {
+		l.observeEndToEnd(notification)
+	}
+	if l.OnHandled != nil {
+		result.Err = err
+		l.OnHandled(ctx, notification, result)
+	}
+	if err == nil && key != "" {
+		if _, ok := l.Seen.(TxSeen); !ok || !reg.marksSeen {
+			if err := l.Seen.MarkSeen(ctx, key); err != nil {
+				return reg, fmt.Errorf("mark idempotency key %q seen: %w", key, err)
+			}
+		}
+	}
+	return reg, err
+}
+
+// callHandler calls the handler of reg, abandoning it if it exceeds HandlerTimeout.
+func (l *Listener) callHandler(ctx context.Context, reg *registration, notification *pgconn.Notification, conn *pgx.Conn) (HandlerResult, error) {
+	if l.HandlerTimeout <= 0 {
+		return invokeHandler(ctx, reg.handler, notification, conn)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, l.HandlerTimeout)
+	defer cancel()
+
+	if l.SingleThreaded {
+		return invokeHandler(ctx, reg.handler, notification, conn)
+	}
+
+	type outcome struct {
+		result HandlerResult
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := invokeHandler(ctx, reg.handler, notification, conn)
+		done <- outcome{result: result, err: err}
+	}()
+
+	// Wait for the full timeout even if ctx is cancelled earlier to give cooperative handlers time to return.
+	timer := time.NewTimer(l.HandlerTimeout + handlerAbandonGrace)
+	defer timer.Stop()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timer.C:
+		l.stats.abandoned.Add(1)
+		return HandlerResult{}, fmt.Errorf("%w after %v", ErrHandlerAbandoned, l.HandlerTimeout)
+	}
+}
+
+// invokeHandler calls handler, using HandleNotificationResult if it is a ResultHandler.
+func invokeHandler(ctx context.Context, handler Handler, notification *pgconn.Notification, conn *pgx.Conn) (HandlerResult, error) {
+	if resultHandler, ok := handler.(ResultHandler); ok {
+		return resultHandler.HandleNotificationResult(ctx, notification, conn)
+	}
+	return HandlerResult{}, handler.HandleNotification(ctx, notification, conn)
+}
+
+// Dispatch routes notification to its handler and calls it exactly as Listen does for each notification it receives,
+// and returns the handler's error instead of logging it. conn is passed to the handler as is and may be nil if the
+// handler does not use it. Dispatch is intended for testing handlers; see package pgxlistentest.
+func (l *Listener) Dispatch(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	_, err := l.handle(ctx, l.foldChannel(notification), conn)
+	return err
+}
+
+// exec reports sql to OnExec and runs it on conn with args.
+func (l *Listener) exec(ctx context.Context, conn *pgx.Conn, sql string, args ...any) (pgconn.CommandTag, error) {
+	if l.OnExec != nil {
+		l.OnExec(ctx, sql)
+	}
+	return conn.Exec(ctx, sql, args...)
+}
+
+// maxAppNameLen is the number of bytes of application_name PostgreSQL keeps (NAMEDATALEN - 1).
+const maxAppNameLen = 63
+
+// appName returns the application_name for a connection listening to channels, truncated without splitting a UTF-8
+// sequence.
+func appName(name string, channels []string) string {
+	if len(channels) > 0 {
+		name += ": " + strings.Join(channels, ",")
+	}
+	if len(name) <= maxAppNameLen {
+		return name
+	}
+
+	n := maxAppNameLen
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n]
 }
 
 func (l *Listener) logError(ctx context.Context, err error) {
+	l.countError()
 	if l.LogError != nil {
-		l.LogError(ctx, err)
+		l.LogError(l.nameContext(ctx), err)
+	}
+}
+
+// countError increments ErrorCounter if set.
+func (l *Listener) countError() {
+	if l.ErrorCounter != nil {
+		l.ErrorCounter.Add(1)
+	}
+}
+
+// handlerError reports an error returned by the handler of reg to its error handler, or LogError if it has none.
+func (l *Listener) handlerError(ctx context.Context, reg *registration, notification *pgconn.Notification, err error) {
+	if reg.onError != nil {
+		l.countError()
+		reg.onError(l.nameContext(ctx), notification, err)
+	} else {
+		l.logError(ctx, err)
+	}
+	if l.FatalHandlerErrors {
+		l.abort(fmt.Errorf("%w: %w", ErrHandlerFailed, err))
+	}
+}
+
+// tracing reports whether Trace messages should be logged. Callers check it before formatting a message so tracing
+// costs nothing when disabled.
+func (l *Listener) tracing() bool {
+	return l.Trace && l.LogDebug != nil
+}
+
+func (l *Listener) logDebug(ctx context.Context, msg string) {
+	if l.LogDebug != nil {
+		l.LogDebug(l.nameContext(ctx), msg)
 	}
 }
 
-// Handler is the interface by which notifications are handled.
+// Handler is the interface by which notifications are handled. It is the only method a handler is required to
+// implement. Additional behavior such as BacklogHandler is detected by type assertion, so a handler that does not need
+// it simply does not implement the method.
+//
+// Unless configured otherwise, Listener calls all handler methods one at a time from the goroutine running Listen.
+// See Listener.SingleThreaded.
 type Handler interface {
 	// HandleNotification is synchronously called by Listener to handle a notification. If processing the notification can
 	// take any significant amount of time this method should process it asynchronously (e.g. via goroutine with a
-	// different database connection). If an error is returned it will be logged with the Listener.LogError function.
+	// different database connection). If an error is returned it will be logged with the Listener.LogError function, or
+	// passed to the error handler given to Listener.HandleWithError. conn must be left as it was found: a handler that
+	// closes it, leaves rows unread, or leaves a transaction open causes Listen to report ErrConnDirty and reconnect.
 	HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error
 }
 
@@ -181,18 +1690,65 @@ func (f HandlerFunc) HandleNotification(ctx context.Context, notification *pgcon
 	return f(ctx, notification, conn)
 }
 
+// PayloadHandlerFunc is an adapter to allow use of a function that only needs the notification payload as a Handler.
+type PayloadHandlerFunc func(ctx context.Context, payload string) error
+
+// HandleNotification calls f(ctx, notification.Payload).
+func (f PayloadHandlerFunc) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return f(ctx, notification.Payload)
+}
+
+// HandlerResult describes what a handler did with a notification. It is passed to Listener.OnHandled.
+type HandlerResult struct {
+	// RowsAffected is the number of rows the handler changed.
+	RowsAffected int64
+
+	// Actions describes the actions the handler took, e.g. downstream events produced.
+	Actions []string
+
+	// Err is the error returned by the handler, if any. It is set by Listener.
+	Err error
+}
+
+// ResultHandler is an optional interface that can be implemented by a Handler to report a HandlerResult for each
+// notification. When a handler implements it, Listener calls HandleNotificationResult instead of HandleNotification
+// and passes the result to Listener.OnHandled. Handlers that only return an error need not implement it.
+type ResultHandler interface {
+	Handler
+
+	// HandleNotificationResult handles notification like HandleNotification and also reports what it did.
+	HandleNotificationResult(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (HandlerResult, error)
+}
+
+// ResultHandlerFunc is an adapter to allow use of a function as a ResultHandler.
+type ResultHandlerFunc func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (HandlerResult, error)
+
+// HandleNotification calls f(ctx, notification, conn) and discards the result.
+func (f ResultHandlerFunc) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	_, err := f(ctx, notification, conn)
+	return err
+}
+
+// HandleNotificationResult calls f(ctx, notification, conn).
+func (f ResultHandlerFunc) HandleNotificationResult(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (HandlerResult, error) {
+	return f(ctx, notification, conn)
+}
+
 // BacklogHandler is an optional interface that can be implemented by a Handler to process unhandled events that
-// occurred before the Listener started. For example, a simple pattern is to insert jobs into a table and to send a
-// notification of the new work. When jobs are enqueued but the Listener is not running then HandleBacklog can read from
-// that table and handle all jobs.
+// occurred before the Listener started. Listener checks for it with a type assertion on each registered Handler;
+// handlers that do not implement it are never asked to handle backlog. For example, a simple pattern is to insert jobs
+// into a table and to send a notification of the new work. When jobs are enqueued but the Listener is not running then
+// HandleBacklog can read from that table and handle all jobs.
 //
 // To ensure that no notifications are lost the Listener starts listening before handling any backlog. This means it is
 // possible for HandleBacklog to handle a notification and for HandleNotification still to be called. A Handler must be
 // prepared for this situation when it is also a BacklogHandler.
 type BacklogHandler interface {
 	// HandleBacklog is synchronously called by Listener at the beginning of Listen at process any previously queued
-	// messages or jobs. If processing can take any significant amount of time this method should process it
-	// asynchronously (e.g. via goroutine with a different database connection). If an error is returned it will be logged
-	// with the Listener.LogError function.
+	// messages or jobs, and again every Listener.BacklogInterval if that is set. If processing can take any significant
+	// amount of time this method should process it asynchronously (e.g. via goroutine with a different database
+	// connection). If an error is returned it will be logged with the Listener.LogError function, unless it is
+	// ErrBacklogEmpty. ctx is derived from the ctx passed to Listen, so queries using it respect its deadline and
+	// cancellation as well as Listener.BacklogTimeout.
 	HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error
 }
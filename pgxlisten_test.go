@@ -2,7 +2,16 @@ package pgxlisten_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -257,3 +266,4360 @@ create table pgxlisten_test (id int primary key generated by default as identity
 		}
 	})
 }
+
+type emptyBacklogHandler struct {
+	mu    sync.Mutex
+	calls []time.Time
+}
+
+func (h *emptyBacklogHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return nil
+}
+
+func (h *emptyBacklogHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls = append(h.calls, time.Now())
+	return pgxlisten.ErrBacklogEmpty
+}
+
+func TestListenerListenAdaptiveBacklog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var logErrorCalls int
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				if errors.Is(err, pgxlisten.ErrBacklogEmpty) {
+					logErrorCalls++
+				}
+			},
+			BacklogInterval:    50 * time.Millisecond,
+			AdaptiveBacklog:    true,
+			MaxBacklogInterval: 400 * time.Millisecond,
+		}
+
+		handler := &emptyBacklogHandler{}
+		listener.Handle("foo", handler)
+
+		listenerCtx, listenerCtxCancel := context.WithTimeout(ctx, 2*time.Second)
+		defer listenerCtxCancel()
+		listener.Listen(listenerCtx)
+
+		handler.mu.Lock()
+		defer handler.mu.Unlock()
+
+		require.Zero(t, logErrorCalls)
+		require.GreaterOrEqual(t, len(handler.calls), 4)
+
+		// The interval doubles after every empty run until it reaches MaxBacklogInterval.
+		expected := 100 * time.Millisecond
+		for i := 1; i < len(handler.calls); i++ {
+			gap := handler.calls[i].Sub(handler.calls[i-1])
+			require.GreaterOrEqualf(t, gap, expected*9/10, "%d", i)
+			require.Lessf(t, gap, expected+200*time.Millisecond, "%d", i)
+			expected = min(expected*2, 400*time.Millisecond)
+		}
+	})
+}
+
+type notificationOnlyHandler struct {
+	ch chan string
+}
+
+func (h *notificationOnlyHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	select {
+	case h.ch <- notification.Payload:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+func TestListenerListenNotificationOnlyHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var mu sync.Mutex
+		var logErrors []error
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				logErrors = append(logErrors, err)
+			},
+			BacklogInterval: 50 * time.Millisecond,
+		}
+
+		handler := &notificationOnlyHandler{ch: make(chan string)}
+		var _ pgxlisten.Handler = handler
+		_, isBacklogHandler := any(handler).(pgxlisten.BacklogHandler)
+		require.False(t, isBacklogHandler)
+
+		listener.Handle("foo", handler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify($1, $2)`, "foo", "a")
+		require.NoError(t, err)
+
+		select {
+		case payload := <-handler.ch:
+			require.Equal(t, "a", payload)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		mu.Lock()
+		require.Empty(t, logErrors)
+		mu.Unlock()
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerHandleWithErrorRoutesErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		globalErrChan := make(chan error, 8)
+		paymentsErrChan := make(chan error, 8)
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				globalErrChan <- err
+			},
+		}
+
+		failingHandler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return errors.New(notification.Payload)
+		})
+
+		listener.HandleWithError("payments", failingHandler, func(ctx context.Context, notification *pgconn.Notification, err error) {
+			require.Equal(t, "payments", notification.Channel)
+			paymentsErrChan <- err
+		})
+		listener.Handle("audit", failingHandler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('payments', 'payment failed'), pg_notify('audit', 'audit failed')`)
+		require.NoError(t, err)
+
+		select {
+		case err := <-paymentsErrChan:
+			require.ErrorContains(t, err, "payment failed")
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		select {
+		case err := <-globalErrChan:
+			require.ErrorContains(t, err, "audit failed")
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		require.Empty(t, paymentsErrChan)
+		require.Empty(t, globalErrChan)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerQueueUsage(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+
+		fooChan := make(chan *pgconn.Notification)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			select {
+			case fooChan <- notification:
+			case <-ctx.Done():
+			}
+			return nil
+		}))
+
+		_, err := listener.QueueUsage(ctx)
+		require.ErrorIs(t, err, pgxlisten.ErrNotConnected)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		usage, err := listener.QueueUsage(ctx)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, usage, 0.0)
+		require.LessOrEqual(t, usage, 1.0)
+
+		// The receive loop keeps working after the query.
+		_, err = conn.Exec(ctx, `select pg_notify($1, $2)`, "foo", "a")
+		require.NoError(t, err)
+
+		select {
+		case notification := <-fooChan:
+			require.Equal(t, "a", notification.Payload)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+type payloadRouter struct {
+	urgent pgxlisten.Handler
+	normal pgxlisten.Handler
+}
+
+func (r *payloadRouter) Channels() []string {
+	return []string{"jobs"}
+}
+
+func (r *payloadRouter) Route(notification *pgconn.Notification) pgxlisten.Handler {
+	if strings.HasPrefix(notification.Payload, "urgent:") {
+		return r.urgent
+	}
+	return r.normal
+}
+
+func TestListenerListenWithRouter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		urgentChan := make(chan string, 8)
+		normalChan := make(chan string, 8)
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			Router: &payloadRouter{
+				urgent: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+					urgentChan <- notification.Payload
+					return nil
+				}),
+				normal: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+					normalChan <- notification.Payload
+					return nil
+				}),
+			},
+		}
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		for _, payload := range []string{"urgent:a", "b", "urgent:c"} {
+			_, err := conn.Exec(ctx, `select pg_notify($1, $2)`, "jobs", payload)
+			require.NoError(t, err)
+		}
+
+		for i, expected := range []string{"urgent:a", "urgent:c"} {
+			select {
+			case actual := <-urgentChan:
+				require.Equalf(t, expected, actual, "%d", i)
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+		}
+
+		select {
+		case actual := <-normalChan:
+			require.Equal(t, "b", actual)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerCircuitBreaker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		stateChan := make(chan pgxlisten.BreakerState, 16)
+		connectAttempts := 0
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				connectAttempts++
+				if connectAttempts <= 3 {
+					return nil, errors.New("database unavailable")
+				}
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			ReconnectDelay:   10 * time.Millisecond,
+			BreakerThreshold: 2,
+			BreakerCooldown:  200 * time.Millisecond,
+			OnBreakerStateChange: func(ctx context.Context, state pgxlisten.BreakerState) {
+				stateChan <- state
+			},
+		}
+
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		expectedStates := []pgxlisten.BreakerState{
+			pgxlisten.BreakerOpen,
+			pgxlisten.BreakerHalfOpen,
+			pgxlisten.BreakerOpen,
+			pgxlisten.BreakerHalfOpen,
+			pgxlisten.BreakerClosed,
+		}
+		for i, expected := range expectedStates {
+			select {
+			case actual := <-stateChan:
+				require.Equalf(t, expected, actual, "%d", i)
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+		}
+
+		require.Equal(t, pgxlisten.BreakerClosed, listener.BreakerState())
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerListenDrainOnCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			DrainOnCancel: 5 * time.Second,
+		}
+
+		fooChan := make(chan string, 8)
+		firstStarted := make(chan struct{})
+		releaseFirst := make(chan struct{})
+
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			if notification.Payload == "a" {
+				close(firstStarted)
+				<-releaseFirst
+			}
+			fooChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('foo', 'a')`)
+		require.NoError(t, err)
+
+		select {
+		case <-firstStarted:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		// These are received while the first handler is still running.
+		_, err = conn.Exec(ctx, `select pg_notify('foo', 'b')`)
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, `select pg_notify('foo', 'c')`)
+		require.NoError(t, err)
+
+		listenerCtxCancel()
+		close(releaseFirst)
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		close(fooChan)
+		var received []string
+		for payload := range fooChan {
+			received = append(received, payload)
+		}
+		require.Equal(t, []string{"a", "b", "c"}, received)
+	})
+}
+
+func TestListenerInterceptors(t *testing.T) {
+	ctx := context.Background()
+
+	var received []string
+	listener := &pgxlisten.Listener{
+		Interceptors: []func(*pgconn.Notification) (*pgconn.Notification, bool){
+			func(notification *pgconn.Notification) (*pgconn.Notification, bool) {
+				return notification, notification.Payload != "veto"
+			},
+			func(notification *pgconn.Notification) (*pgconn.Notification, bool) {
+				rewritten := *notification
+				rewritten.Payload = strings.ToUpper(notification.Payload)
+				return &rewritten, true
+			},
+		},
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		received = append(received, notification.Payload)
+		return nil
+	}))
+
+	for _, payload := range []string{"a", "veto", "b"} {
+		err := listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: payload}, nil)
+		require.NoError(t, err)
+	}
+
+	require.Equal(t, []string{"A", "B"}, received)
+}
+
+// goroutineID returns the ID of the calling goroutine as reported in its stack trace.
+func goroutineID() string {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	return strings.Fields(string(buf))[1]
+}
+
+type goroutineRecordingHandler struct {
+	ids  chan string
+	done chan struct{}
+}
+
+func (h *goroutineRecordingHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	h.ids <- goroutineID()
+	if notification.Payload == "last" {
+		close(h.done)
+	}
+	return nil
+}
+
+func (h *goroutineRecordingHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	h.ids <- goroutineID()
+	return nil
+}
+
+func TestListenerSingleThreaded(t *testing.T) {
+	for _, singleThreaded := range []bool{false, true} {
+		t.Run(fmt.Sprintf("SingleThreaded=%v", singleThreaded), func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+			defer cancel()
+
+			defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+				listener := &pgxlisten.Listener{
+					Connect: func(ctx context.Context) (*pgx.Conn, error) {
+						config := defaultConnTestRunner.CreateConfig(ctx, t)
+						return pgx.ConnectConfig(ctx, config)
+					},
+					BacklogInterval: 50 * time.Millisecond,
+					SingleThreaded:  singleThreaded,
+				}
+
+				handler := &goroutineRecordingHandler{ids: make(chan string, 1024), done: make(chan struct{})}
+				listener.Handle("foo", handler)
+				listener.Handle("bar", handler)
+
+				listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+				defer listenerCtxCancel()
+				listenerGoroutineChan := make(chan string, 1)
+				listenerDoneChan := make(chan struct{})
+
+				go func() {
+					listenerGoroutineChan <- goroutineID()
+					listener.Listen(listenerCtx)
+					close(listenerDoneChan)
+				}()
+
+				// No way to know when Listener is ready so wait a little.
+				time.Sleep(2 * time.Second)
+
+				for _, channel := range []string{"foo", "bar", "foo", "bar"} {
+					_, err := conn.Exec(ctx, `select pg_notify($1, 'x')`, channel)
+					require.NoError(t, err)
+				}
+				_, err := conn.Exec(ctx, `select pg_notify('foo', 'last')`)
+				require.NoError(t, err)
+
+				select {
+				case <-handler.done:
+				case <-ctx.Done():
+					t.Fatalf("%v", ctx.Err())
+				}
+
+				listenerCtxCancel()
+
+				select {
+				case <-listenerDoneChan:
+				case <-ctx.Done():
+					t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+				}
+
+				listenerGoroutine := <-listenerGoroutineChan
+				close(handler.ids)
+				calls := 0
+				for id := range handler.ids {
+					require.Equal(t, listenerGoroutine, id)
+					calls++
+				}
+				// Two initial backlog runs, periodic backlog runs, and five notifications.
+				require.Greater(t, calls, 7)
+			})
+		})
+	}
+}
+
+func TestListenerResetStats(t *testing.T) {
+	ctx := context.Background()
+
+	listener := &pgxlisten.Listener{
+		MaxPayloadBytes: 4,
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	for _, payload := range []string{"a", "b", "abcde"} {
+		listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: payload}, nil)
+	}
+
+	require.Equal(t, pgxlisten.Stats{Received: 3, Dropped: 1}, listener.ResetStats())
+	require.Equal(t, pgxlisten.Stats{}, listener.Stats())
+
+	// Counting resumes from zero and concurrent increments are not lost.
+	var wg sync.WaitGroup
+	var total uint64
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "a"}, nil)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		total += listener.ResetStats().Received
+	}
+	require.Equal(t, uint64(400), total)
+}
+
+func TestListenerMaxPayloadBytes(t *testing.T) {
+	ctx := context.Background()
+
+	metrics := &recordingMetrics{}
+	var received []string
+	listener := &pgxlisten.Listener{
+		MaxPayloadBytes: 4,
+		Metrics:         metrics,
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		received = append(received, notification.Payload)
+		return nil
+	}))
+
+	err := listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "abcd"}, nil)
+	require.NoError(t, err)
+
+	err = listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "abcde"}, nil)
+	require.ErrorIs(t, err, pgxlisten.ErrPayloadTooLarge)
+
+	require.Equal(t, []string{"abcd"}, received)
+	require.Equal(t, pgxlisten.Stats{Received: 2, Dropped: 1}, listener.Stats())
+	require.Equal(t, map[pgxlisten.DropReason]int{pgxlisten.DropPayloadTooLarge: 1}, metrics.drops)
+}
+
+func TestListenerHandlerTimeoutAbandonsHandler(t *testing.T) {
+	ctx := context.Background()
+
+	release := make(chan struct{})
+	defer close(release)
+
+	listener := &pgxlisten.Listener{
+		HandlerTimeout: 100 * time.Millisecond,
+	}
+	listener.Handle("stuck", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		// Ignores ctx.
+		<-release
+		return nil
+	}))
+	listener.Handle("cooperative", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+
+	start := time.Now()
+	err := listener.Dispatch(ctx, &pgconn.Notification{Channel: "stuck"}, nil)
+	require.ErrorIs(t, err, pgxlisten.ErrHandlerAbandoned)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	require.Equal(t, uint64(1), listener.Stats().Abandoned)
+
+	err = listener.Dispatch(ctx, &pgconn.Notification{Channel: "cooperative"}, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, uint64(1), listener.Stats().Abandoned)
+}
+
+func TestListenerWeightedFairScheduling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			MaxConcurrency: 1,
+		}
+
+		handledChan := make(chan string, 64)
+		handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			time.Sleep(20 * time.Millisecond)
+			handledChan <- notification.Channel
+			return nil
+		})
+		listener.HandleWeighted("bulk", 2, handler)
+		listener.Handle("urgent", handler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		// Flood bulk, then send a single urgent notification behind it.
+		_, err := conn.Exec(ctx, `select pg_notify('bulk', g::text) from generate_series(1, 30) g`)
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, `select pg_notify('urgent', 'now')`)
+		require.NoError(t, err)
+
+		var handled []string
+		for len(handled) < 31 {
+			select {
+			case channel := <-handledChan:
+				handled = append(handled, channel)
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", len(handled), ctx.Err())
+			}
+		}
+
+		// With strict FIFO urgent would be handled last. With weighted round-robin it only waits for a couple of bulk
+		// notifications.
+		require.Contains(t, handled[:6], "urgent")
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerSharedSemaphore(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		sem := pgxlisten.NewSemaphore(2)
+
+		var mu sync.Mutex
+		running, maxRunning := 0, 0
+		handledChan := make(chan string, 64)
+		handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			mu.Lock()
+			running++
+			maxRunning = max(maxRunning, running)
+			mu.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			handledChan <- notification.Channel
+			return nil
+		})
+
+		var wg sync.WaitGroup
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+
+		for _, channel := range []string{"foo", "bar"} {
+			listener := &pgxlisten.Listener{
+				Connect: func(ctx context.Context) (*pgx.Conn, error) {
+					config := defaultConnTestRunner.CreateConfig(ctx, t)
+					return pgx.ConnectConfig(ctx, config)
+				},
+				Semaphore: sem,
+			}
+			listener.Handle(channel, handler)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				listener.Listen(listenerCtx)
+			}()
+		}
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify(c, g::text) from generate_series(1, 10) g, unnest(array['foo', 'bar']) c`)
+		require.NoError(t, err)
+
+		handled := map[string]int{}
+		for i := 0; i < 20; i++ {
+			select {
+			case channel := <-handledChan:
+				handled[channel]++
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+		}
+		require.Equal(t, map[string]int{"foo": 10, "bar": 10}, handled)
+
+		mu.Lock()
+		require.Equal(t, 2, maxRunning)
+		mu.Unlock()
+
+		listenerCtxCancel()
+		wg.Wait()
+	})
+}
+
+func TestListenerListenReturnValues(t *testing.T) {
+	errUnavailable := errors.New("database unavailable")
+	failingConnect := func(ctx context.Context) (*pgx.Conn, error) {
+		return nil, errUnavailable
+	}
+	nopHandler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	})
+
+	t.Run("Connect is nil", func(t *testing.T) {
+		listener := &pgxlisten.Listener{}
+		listener.Handle("foo", nopHandler)
+		err := listener.Listen(context.Background())
+		require.EqualError(t, err, "Listen: Connect is nil")
+	})
+
+	t.Run("No handlers", func(t *testing.T) {
+		listener := &pgxlisten.Listener{Connect: failingConnect}
+		err := listener.Listen(context.Background())
+		require.EqualError(t, err, "Listen: No handlers")
+	})
+
+	t.Run("MaxReconnectAttempts", func(t *testing.T) {
+		attempts := 0
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				attempts++
+				return failingConnect(ctx)
+			},
+			ReconnectDelay:       time.Millisecond,
+			MaxReconnectAttempts: 3,
+		}
+		listener.Handle("foo", nopHandler)
+		err := listener.Listen(context.Background())
+		require.ErrorIs(t, err, pgxlisten.ErrMaxReconnectAttempts)
+		require.ErrorIs(t, err, errUnavailable)
+		require.Equal(t, 3, attempts)
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		listener := &pgxlisten.Listener{
+			Connect:        failingConnect,
+			ReconnectDelay: 10 * time.Millisecond,
+		}
+		listener.Handle("foo", nopHandler)
+		time.AfterFunc(50*time.Millisecond, cancel)
+		err := listener.Listen(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("Deadline exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		listener := &pgxlisten.Listener{
+			Connect:        failingConnect,
+			ReconnectDelay: -1,
+		}
+		listener.Handle("foo", nopHandler)
+		err := listener.Listen(ctx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestPayloadHandlerFunc(t *testing.T) {
+	ctx := context.Background()
+
+	var received []string
+	listener := &pgxlisten.Listener{
+		Interceptors: []func(*pgconn.Notification) (*pgconn.Notification, bool){
+			func(notification *pgconn.Notification) (*pgconn.Notification, bool) {
+				return notification, notification.Payload != "skip"
+			},
+		},
+	}
+	listener.Handle("foo", pgxlisten.PayloadHandlerFunc(func(ctx context.Context, payload string) error {
+		received = append(received, payload)
+		if payload == "bad" {
+			return errors.New("bad payload")
+		}
+		return nil
+	}))
+
+	for _, payload := range []string{"a", "skip"} {
+		err := listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: payload}, nil)
+		require.NoError(t, err)
+	}
+	err := listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "bad"}, nil)
+	require.EqualError(t, err, "bad payload")
+
+	require.Equal(t, []string{"a", "bad"}, received)
+	require.Equal(t, uint64(3), listener.Stats().Received)
+}
+
+func TestListenerChannelsFunc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		tenantSets := [][]string{{"tenant_a"}, {"tenant_b"}}
+		pidChan := make(chan uint32, 8)
+		calls := 0
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			ReconnectDelay: 100 * time.Millisecond,
+			ChannelsFunc: func(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+				channels := tenantSets[min(calls, len(tenantSets)-1)]
+				calls++
+				pidChan <- conn.PgConn().PID()
+				return channels, nil
+			},
+		}
+
+		receivedChan := make(chan string, 8)
+		listener.DefaultHandler = pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Channel + ":" + notification.Payload
+			return nil
+		})
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('tenant_a', '1'), pg_notify('tenant_b', '1')`)
+		require.NoError(t, err)
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "tenant_a:1", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		// Force a reconnect. The new connection gets the new channel set.
+		_, err = conn.Exec(ctx, `select pg_terminate_backend($1)`, <-pidChan)
+		require.NoError(t, err)
+
+		select {
+		case <-pidChan:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		time.Sleep(500 * time.Millisecond)
+
+		_, err = conn.Exec(ctx, `select pg_notify('tenant_a', '2'), pg_notify('tenant_b', '2')`)
+		require.NoError(t, err)
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "tenant_b:2", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, receivedChan)
+	})
+}
+
+func TestListenerRefreshChannels(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var mu sync.Mutex
+		tenants := []string{"tenant_a"}
+		var unlistened []string
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			ChannelsFunc: func(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return tenants, nil
+			},
+			OnExec: func(ctx context.Context, sql string) {
+				if strings.HasPrefix(sql, "unlisten ") {
+					mu.Lock()
+					unlistened = append(unlistened, sql)
+					mu.Unlock()
+				}
+			},
+		}
+
+		receivedChan := make(chan string, 8)
+		listener.DefaultHandler = pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Channel + ":" + notification.Payload
+			return nil
+		})
+
+		require.ErrorIs(t, listener.RefreshChannels(ctx), pgxlisten.ErrNotConnected)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		select {
+		case <-listener.Ready("tenant_a"):
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		// The new set is applied on the same connection: tenant_a is unlistened and tenant_b listened to.
+		pid, ok := listener.BackendPID()
+		require.True(t, ok)
+		mu.Lock()
+		tenants = []string{"tenant_b"}
+		mu.Unlock()
+		require.NoError(t, listener.RefreshChannels(ctx))
+		mu.Lock()
+		require.Equal(t, []string{`unlisten "tenant_a"`}, unlistened)
+		mu.Unlock()
+		refreshedPID, ok := listener.BackendPID()
+		require.True(t, ok)
+		require.Equal(t, pid, refreshedPID)
+
+		_, err := conn.Exec(ctx, `select pg_notify('tenant_a', '1'), pg_notify('tenant_b', '1')`)
+		require.NoError(t, err)
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "tenant_b:1", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, receivedChan)
+	})
+}
+
+type countingBacklogHandler struct {
+	calls chan string
+}
+
+func (h *countingBacklogHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return nil
+}
+
+func (h *countingBacklogHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	var one int
+	if err := conn.QueryRow(ctx, `select 1`).Scan(&one); err != nil {
+		return err
+	}
+	h.calls <- channel
+	return nil
+}
+
+func TestListenerRunBacklog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+
+		handler := &countingBacklogHandler{calls: make(chan string, 8)}
+		listener.Handle("jobs", handler)
+		listener.Handle("plain", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		err := listener.RunBacklog(ctx, "jobs")
+		require.ErrorIs(t, err, pgxlisten.ErrNotConnected)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// Initial backlog run.
+		select {
+		case channel := <-handler.calls:
+			require.Equal(t, "jobs", channel)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		err = listener.RunBacklog(ctx, "jobs")
+		require.NoError(t, err)
+		require.Len(t, handler.calls, 1)
+		<-handler.calls
+
+		err = listener.RunBacklog(ctx, "plain")
+		require.ErrorIs(t, err, pgxlisten.ErrNoBacklogHandler)
+
+		err = listener.RunBacklog(ctx, "missing")
+		require.ErrorIs(t, err, pgxlisten.ErrNoBacklogHandler)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerJitter(t *testing.T) {
+	const interval = time.Second
+
+	listener := &pgxlisten.Listener{JitterSeed: 42}
+	seen := map[time.Duration]bool{}
+	var first []time.Duration
+	for i := 0; i < 1000; i++ {
+		d := listener.JitterDuration(interval)
+		require.GreaterOrEqual(t, d, interval*9/10)
+		require.LessOrEqual(t, d, interval*11/10)
+		seen[d] = true
+		if i < 10 {
+			first = append(first, d)
+		}
+	}
+	require.Greater(t, len(seen), 900)
+
+	// The same seed produces the same intervals.
+	sameSeed := &pgxlisten.Listener{JitterSeed: 42}
+	for i, expected := range first {
+		require.Equalf(t, expected, sameSeed.JitterDuration(interval), "%d", i)
+	}
+
+	wide := &pgxlisten.Listener{Jitter: 0.5, JitterSeed: 1}
+	for i := 0; i < 1000; i++ {
+		d := wide.JitterDuration(interval)
+		require.GreaterOrEqual(t, d, interval/2)
+		require.LessOrEqual(t, d, interval*3/2)
+	}
+
+	disabled := &pgxlisten.Listener{Jitter: -1}
+	require.Equal(t, interval, disabled.JitterDuration(interval))
+}
+
+func TestListenerOnHandled(t *testing.T) {
+	ctx := context.Background()
+
+	errFailed := errors.New("failed")
+	var results []pgxlisten.HandlerResult
+	listener := &pgxlisten.Listener{
+		OnHandled: func(ctx context.Context, notification *pgconn.Notification, result pgxlisten.HandlerResult) {
+			results = append(results, result)
+		},
+	}
+	listener.Handle("rich", pgxlisten.ResultHandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) (pgxlisten.HandlerResult, error) {
+		return pgxlisten.HandlerResult{RowsAffected: 3, Actions: []string{"a", "b", "c"}}, nil
+	}))
+	listener.Handle("simple", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return errFailed
+	}))
+
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "rich"}, nil))
+	require.ErrorIs(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "simple"}, nil), errFailed)
+
+	require.Equal(t, []pgxlisten.HandlerResult{
+		{RowsAffected: 3, Actions: []string{"a", "b", "c"}},
+		{Err: errFailed},
+	}, results)
+}
+
+func TestListenerWithConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+
+		fooChan := make(chan string, 8)
+		handlerErrChan := make(chan error, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			// Handlers already have the connection and must not deadlock by asking for it again.
+			handlerErrChan <- listener.WithConn(ctx, func(conn *pgx.Conn) error { return nil })
+			fooChan <- notification.Payload
+			return nil
+		}))
+
+		err := listener.WithConn(ctx, func(conn *pgx.Conn) error { return nil })
+		require.ErrorIs(t, err, pgxlisten.ErrNotConnected)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		var listenerPID uint32
+		err = listener.WithConn(ctx, func(conn *pgx.Conn) error {
+			return conn.QueryRow(ctx, `select pg_backend_pid()`).Scan(&listenerPID)
+		})
+		require.NoError(t, err)
+		require.NotZero(t, listenerPID)
+		require.NotEqual(t, conn.PgConn().PID(), listenerPID)
+
+		// Concurrent calls queue behind each other instead of failing.
+		var running, maxRunning atomic.Int32
+		errChan := make(chan error, 3)
+		for range 3 {
+			go func() {
+				errChan <- listener.WithConn(ctx, func(conn *pgx.Conn) error {
+					maxRunning.Store(max(maxRunning.Load(), running.Add(1)))
+					defer running.Add(-1)
+					time.Sleep(50 * time.Millisecond)
+					_, err := conn.Exec(ctx, `select 1`)
+					return err
+				})
+			}()
+		}
+		for range 3 {
+			require.NoError(t, <-errChan)
+		}
+		require.Equal(t, int32(1), maxRunning.Load())
+
+		errFailed := errors.New("failed")
+		err = listener.WithConn(ctx, func(conn *pgx.Conn) error { return errFailed })
+		require.ErrorIs(t, err, errFailed)
+
+		// The receive loop resumes afterwards.
+		_, err = conn.Exec(ctx, `select pg_notify('foo', 'a')`)
+		require.NoError(t, err)
+
+		select {
+		case payload := <-fooChan:
+			require.Equal(t, "a", payload)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		require.ErrorIs(t, <-handlerErrChan, pgxlisten.ErrWithConnReentrant)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerOnExec(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var mu sync.Mutex
+		var statements []string
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			OnExec: func(ctx context.Context, sql string) {
+				mu.Lock()
+				defer mu.Unlock()
+				statements = append(statements, sql)
+			},
+		}
+
+		nop := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		})
+		listener.Handle("foo", nop)
+		listener.Handle("Bar Baz", nop)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		mu.Lock()
+		require.ElementsMatch(t, []string{`listen "foo"`, `listen "Bar Baz"`}, statements)
+		mu.Unlock()
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerDedupKey(t *testing.T) {
+	ctx := context.Background()
+	clock := &manualClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	metrics := &recordingMetrics{}
+
+	listener := &pgxlisten.Listener{
+		Clock:       clock,
+		Metrics:     metrics,
+		DedupWindow: time.Minute,
+		// Payloads are JSON objects whose ts field differs between otherwise identical notifications.
+		DedupKey: func(notification *pgconn.Notification) string {
+			var payload map[string]any
+			if err := json.Unmarshal([]byte(notification.Payload), &payload); err != nil {
+				return notification.Payload
+			}
+			delete(payload, "ts")
+			key, _ := json.Marshal(payload)
+			return notification.Channel + ":" + string(key)
+		},
+	}
+
+	var handled []string
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		handled = append(handled, notification.Payload)
+		return nil
+	}))
+
+	for _, payload := range []string{
+		`{"id":1,"ts":"10:00:00"}`,
+		`{"id":1,"ts":"10:00:01"}`,
+		`{"id":2,"ts":"10:00:01"}`,
+	} {
+		require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: payload}, nil))
+	}
+
+	// Once the window has passed the same key is handled again.
+	clock.Advance(2 * time.Minute)
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: `{"id":1,"ts":"10:02:01"}`}, nil))
+
+	require.Equal(t, []string{`{"id":1,"ts":"10:00:00"}`, `{"id":2,"ts":"10:00:01"}`, `{"id":1,"ts":"10:02:01"}`}, handled)
+	require.Equal(t, uint64(1), listener.Stats().Dropped)
+	require.Equal(t, map[pgxlisten.DropReason]int{pgxlisten.DropDuplicate: 1}, metrics.drops)
+}
+
+func TestListenerAddHandlerUnlisten(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		logErrorChan := make(chan error, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				logErrorChan <- err
+			},
+		}
+
+		fooChan := make(chan string, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			fooChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		barChan := make(chan string, 8)
+		sub, err := listener.AddHandler(ctx, "bar", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			barChan <- notification.Payload
+			return nil
+		}))
+		require.NoError(t, err)
+		require.Equal(t, "bar", sub.Channel())
+		require.True(t, sub.Active())
+
+		_, err = conn.Exec(ctx, `select pg_notify('bar', 'a')`)
+		require.NoError(t, err)
+
+		select {
+		case payload := <-barChan:
+			require.Equal(t, "a", payload)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		require.NoError(t, sub.Unlisten(ctx))
+		require.False(t, sub.Active())
+		require.NoError(t, sub.Unlisten(ctx))
+
+		// Notifications sent after Unlisten are no longer received. The one on foo shows the one on bar was sent first.
+		_, err = conn.Exec(ctx, `select pg_notify('bar', 'b')`)
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, `select pg_notify('foo', 'c')`)
+		require.NoError(t, err)
+
+		select {
+		case payload := <-fooChan:
+			require.Equal(t, "c", payload)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		require.Empty(t, barChan)
+		require.Empty(t, logErrorChan)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+type sleepingBacklogHandler struct {
+	errChan chan error
+}
+
+func (h *sleepingBacklogHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return nil
+}
+
+func (h *sleepingBacklogHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	_, err := conn.Exec(ctx, `select pg_sleep(10)`)
+	h.errChan <- err
+	return err
+}
+
+func TestListenerBacklogRespectsDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		connect := func(ctx context.Context) (*pgx.Conn, error) {
+			config := defaultConnTestRunner.CreateConfig(ctx, t)
+			return pgx.ConnectConfig(ctx, config)
+		}
+
+		// A deadline on the ctx passed to Listen cancels the backlog query.
+		handler := &sleepingBacklogHandler{errChan: make(chan error, 8)}
+		listener := &pgxlisten.Listener{Connect: connect}
+		listener.Handle("foo", handler)
+
+		listenerCtx, listenerCtxCancel := context.WithTimeout(ctx, time.Second)
+		defer listenerCtxCancel()
+		start := time.Now()
+		err := listener.Listen(listenerCtx)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), 5*time.Second)
+		require.Error(t, <-handler.errChan)
+
+		// BacklogTimeout cancels it while Listen keeps running.
+		handler = &sleepingBacklogHandler{errChan: make(chan error, 8)}
+		listener = &pgxlisten.Listener{
+			Connect:        connect,
+			BacklogTimeout: 200 * time.Millisecond,
+			LogError:       func(ctx context.Context, err error) {},
+		}
+		listener.Handle("foo", handler)
+
+		listenerCtx, listenerCtxCancel = context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		start = time.Now()
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		select {
+		case err := <-handler.errChan:
+			require.Error(t, err)
+			require.Less(t, time.Since(start), 5*time.Second)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		select {
+		case <-listenerDoneChan:
+			t.Fatal("Listen returned after BacklogTimeout")
+		default:
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerDisableBacklog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			BacklogInterval: 50 * time.Millisecond,
+			DisableBacklog:  true,
+		}
+
+		handler := &countingBacklogHandler{calls: make(chan string, 64)}
+		listener.Handle("foo", handler)
+
+		listenerCtx, listenerCtxCancel := context.WithTimeout(ctx, time.Second)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(500 * time.Millisecond)
+		require.ErrorIs(t, listener.RunBacklog(ctx, "foo"), pgxlisten.ErrNoBacklogHandler)
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, handler.calls)
+	})
+}
+
+func TestListenerHandleTx(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_tx_test;
+create table pgxlisten_tx_test (msg text not null);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_tx_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		handlerErrChan := make(chan error, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+
+		errRejected := errors.New("rejected")
+		listener.HandleTx("foo", func(ctx context.Context, notification *pgconn.Notification, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `insert into pgxlisten_tx_test (msg) values ($1)`, notification.Payload)
+			if err == nil && notification.Payload == "bad" {
+				err = errRejected
+			}
+			handlerErrChan <- err
+			return err
+		})
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		for _, payload := range []string{"bad", "good"} {
+			_, err := conn.Exec(ctx, `select pg_notify('foo', $1)`, payload)
+			require.NoError(t, err)
+
+			select {
+			case <-handlerErrChan:
+			case <-ctx.Done():
+				t.Fatalf("%s. %v", payload, ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		// The insert for the notification whose handler failed was rolled back.
+		rows, _ := conn.Query(ctx, `select msg from pgxlisten_tx_test`)
+		msgs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		require.Equal(t, []string{"good"}, msgs)
+	})
+}
+
+func TestListenerConnMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	require.Equal(t, pgxlisten.ConnModePrimary, pgxlisten.ModeFromContext(context.Background()))
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		connect := func(ctx context.Context) (*pgx.Conn, error) {
+			config := defaultConnTestRunner.CreateConfig(ctx, t)
+			return pgx.ConnectConfig(ctx, config)
+		}
+		failingConnect := func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, errors.New("primary unavailable")
+		}
+
+		for i, tt := range []struct {
+			listener *pgxlisten.Listener
+			mode     pgxlisten.ConnMode
+		}{
+			{listener: &pgxlisten.Listener{Connect: connect, FallbackConnect: failingConnect}, mode: pgxlisten.ConnModePrimary},
+			{listener: &pgxlisten.Listener{Connect: failingConnect, FallbackConnect: connect}, mode: pgxlisten.ConnModeFallback},
+			{listener: &pgxlisten.Listener{Connect: failingConnect, FallbackConnect: connect, MaxConcurrency: 2}, mode: pgxlisten.ConnModeFallback},
+		} {
+			modeChan := make(chan pgxlisten.ConnMode, 8)
+			tt.listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				modeChan <- pgxlisten.ModeFromContext(ctx)
+				return nil
+			}))
+
+			listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+			listenerDoneChan := make(chan struct{})
+
+			go func() {
+				tt.listener.Listen(listenerCtx)
+				close(listenerDoneChan)
+			}()
+
+			// No way to know when Listener is ready so wait a little.
+			time.Sleep(time.Second)
+
+			_, err := conn.Exec(ctx, `select pg_notify('foo', 'a')`)
+			require.NoErrorf(t, err, "%d", i)
+
+			select {
+			case mode := <-modeChan:
+				require.Equalf(t, tt.mode, mode, "%d", i)
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+
+			listenerCtxCancel()
+
+			select {
+			case <-listenerDoneChan:
+			case <-ctx.Done():
+				t.Fatalf("%d. ctx cancelled while waiting for Listen() to return: %v", i, ctx.Err())
+			}
+		}
+	})
+}
+
+func TestListenerHandleQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		metrics := &recordingMetrics{}
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			MaxConcurrency: 1,
+			Metrics:        metrics,
+		}
+
+		startedChan := make(chan struct{}, 64)
+		releaseChan := make(chan struct{})
+		handledChan := make(chan string, 64)
+		handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			startedChan <- struct{}{}
+			<-releaseChan
+			handledChan <- notification.Channel
+			return nil
+		})
+		listener.HandleQueue("bulk", 5, handler)
+		listener.HandleQueue("other", 5, handler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		// Occupy the only handler, then flood bulk while it is busy.
+		_, err := conn.Exec(ctx, `select pg_notify('bulk', '0')`)
+		require.NoError(t, err)
+		select {
+		case <-startedChan:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		_, err = conn.Exec(ctx, `select pg_notify('bulk', g::text) from generate_series(1, 20) g`)
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, `select pg_notify('other', g::text) from generate_series(1, 3) g`)
+		require.NoError(t, err)
+
+		// Give the notifications time to be queued.
+		time.Sleep(500 * time.Millisecond)
+		close(releaseChan)
+
+		handled := map[string]int{}
+		for i := 0; i < 9; i++ {
+			select {
+			case channel := <-handledChan:
+				handled[channel]++
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", i, ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		// bulk kept only as many notifications as its queue holds while other was unaffected.
+		require.Equal(t, map[string]int{"bulk": 6, "other": 3}, handled)
+		require.Equal(t, uint64(15), listener.Stats().Dropped)
+
+		metrics.mu.Lock()
+		defer metrics.mu.Unlock()
+		require.Equal(t, map[pgxlisten.DropReason]int{pgxlisten.DropQueueFull: 15}, metrics.drops)
+		require.Equal(t, map[string]int{"bulk": 5, "other": 3}, metrics.maxDepths)
+	})
+}
+
+// testGroup is a minimal errgroup.Group created with errgroup.WithContext.
+type testGroup struct {
+	wg      sync.WaitGroup
+	cancel  context.CancelFunc
+	errOnce sync.Once
+	err     error
+}
+
+func newTestGroup(ctx context.Context) (*testGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &testGroup{cancel: cancel}, ctx
+}
+
+func (g *testGroup) Go(f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+func (g *testGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+func TestListenerListenGroup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	errUnavailable := errors.New("database unavailable")
+	nopHandler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	})
+
+	// A failing Listener cancels its siblings.
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, errUnavailable
+		},
+		LogError:             func(ctx context.Context, err error) {},
+		MaxReconnectAttempts: 2,
+		ReconnectDelay:       10 * time.Millisecond,
+	}
+	listener.Handle("foo", nopHandler)
+
+	g, groupCtx := newTestGroup(ctx)
+	listener.ListenGroup(groupCtx, g)
+	siblingErrChan := make(chan error, 1)
+	g.Go(func() error {
+		<-groupCtx.Done()
+		siblingErrChan <- groupCtx.Err()
+		return nil
+	})
+
+	err := g.Wait()
+	require.ErrorIs(t, err, pgxlisten.ErrMaxReconnectAttempts)
+	require.ErrorIs(t, err, errUnavailable)
+	require.ErrorIs(t, <-siblingErrChan, context.Canceled)
+
+	// A Listener that is shut down does not fail the group.
+	listener = &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, errUnavailable
+		},
+		LogError:       func(ctx context.Context, err error) {},
+		ReconnectDelay: time.Hour,
+	}
+	listener.Handle("foo", nopHandler)
+
+	g, groupCtx = newTestGroup(ctx)
+	listener.ListenGroup(groupCtx, g)
+
+	// No way to know when Listen is running so wait a little.
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, listener.Shutdown(ctx))
+	require.NoError(t, g.Wait())
+}
+
+func TestListenerShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, errors.New("database unavailable")
+		},
+		LogError:       func(ctx context.Context, err error) {},
+		ReconnectDelay: time.Hour,
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	// Shutdown does nothing while Listen is not running.
+	require.NoError(t, listener.Shutdown(ctx))
+
+	listenErrChan := make(chan error, 1)
+	go func() {
+		listenErrChan <- listener.Listen(ctx)
+	}()
+
+	// No way to know when Listen is running so wait a little.
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, listener.Shutdown(ctx))
+
+	select {
+	case err := <-listenErrChan:
+		require.ErrorIs(t, err, pgxlisten.ErrListenerShutdown)
+	case <-ctx.Done():
+		t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+	}
+}
+
+func TestListenerListenOnce(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+
+		type result struct {
+			notification *pgconn.Notification
+			err          error
+		}
+		resultChan := make(chan result, 1)
+		go func() {
+			notification, err := listener.ListenOnce(ctx, "foo")
+			resultChan <- result{notification: notification, err: err}
+		}()
+
+		// No way to know when ListenOnce is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('bar', 'ignored')`)
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, `select pg_notify('foo', 'a')`)
+		require.NoError(t, err)
+
+		select {
+		case r := <-resultChan:
+			require.NoError(t, r.err)
+			require.Equal(t, "foo", r.notification.Channel)
+			require.Equal(t, "a", r.notification.Payload)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		// Without a notification ListenOnce returns when ctx is done.
+		onceCtx, onceCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer onceCancel()
+		_, err = listener.ListenOnce(onceCtx, "foo")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+}
+
+func TestListenerHandleRefreshCoalesces(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+
+		refreshChan := make(chan time.Time, 64)
+		listener.HandleRefresh("foo", 500*time.Millisecond, func(ctx context.Context, conn *pgx.Conn) error {
+			var one int
+			if err := conn.QueryRow(ctx, `select 1`).Scan(&one); err != nil {
+				return err
+			}
+			refreshChan <- time.Now()
+			return nil
+		})
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		receive := func() time.Time {
+			select {
+			case at := <-refreshChan:
+				return at
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+				return time.Time{}
+			}
+		}
+
+		// Refreshes once after connecting.
+		receive()
+		time.Sleep(time.Second)
+
+		// A burst refreshes immediately and once more when the interval has passed.
+		_, err := conn.Exec(ctx, `select pg_notify('foo', '') from generate_series(1, 10)`)
+		require.NoError(t, err)
+		first := receive()
+		second := receive()
+		require.GreaterOrEqual(t, second.Sub(first), 450*time.Millisecond)
+
+		time.Sleep(time.Second)
+		require.Empty(t, refreshChan)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerTrace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var mu sync.Mutex
+		var trace []string
+		connectAttempts := 0
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				connectAttempts++
+				if connectAttempts == 1 {
+					return nil, errors.New("database unavailable")
+				}
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			LogDebug: func(ctx context.Context, msg string) {
+				if strings.HasPrefix(msg, "trace: ") {
+					mu.Lock()
+					defer mu.Unlock()
+					trace = append(trace, msg)
+				}
+			},
+			ReconnectDelay: 10 * time.Millisecond,
+			Trace:          true,
+		}
+
+		handledChan := make(chan struct{}, 1)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			handledChan <- struct{}{}
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('foo', 'abc')`)
+		require.NoError(t, err)
+
+		select {
+		case <-handledChan:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		require.Len(t, trace, 10)
+		require.Equal(t, []string{
+			"trace: connecting attempt 1",
+			"trace: disconnected: connect: database unavailable",
+			"trace: reconnecting in 10ms",
+			"trace: connecting attempt 2",
+		}, trace[:4])
+		require.Regexp(t, `^trace: connected to primary backend pid \d+$`, trace[4])
+		require.Equal(t, `trace: listening to "foo"`, trace[5])
+		require.Equal(t, fmt.Sprintf(`trace: received "foo" notification with 3 byte payload from pid %d`, conn.PgConn().PID()), trace[6])
+		require.Equal(t, []string{
+			`trace: handler start "foo"`,
+			`trace: handler end "foo": <nil>`,
+			"trace: disconnected: waiting for notification: context canceled",
+		}, trace[7:])
+	})
+}
+
+// blackholeConn discards everything written to it once swallow is set, as if the network had silently failed.
+type blackholeConn struct {
+	net.Conn
+	swallow *atomic.Bool
+}
+
+func (c *blackholeConn) Write(b []byte) (int, error) {
+	if c.swallow.Load() {
+		return len(b), nil
+	}
+	return c.Conn.Write(b)
+}
+
+func TestListenerShutdownWithDeadConnection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		swallow := &atomic.Bool{}
+		var debugMsgs []string
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				dial := config.DialFunc
+				config.DialFunc = func(ctx context.Context, network, addr string) (net.Conn, error) {
+					netConn, err := dial(ctx, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					return &blackholeConn{Conn: netConn, swallow: swallow}, nil
+				}
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			LogDebug: func(ctx context.Context, msg string) {
+				debugMsgs = append(debugMsgs, msg)
+			},
+		}
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		// The server never sees the UNLISTEN sent on shutdown, so it is never answered.
+		swallow.Store(true)
+		start := time.Now()
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Less(t, time.Since(start), 3*time.Second)
+		require.Contains(t, strings.Join(debugMsgs, "\n"), "shutdown: unlisten:")
+	})
+}
+
+func TestListenerBackendPID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			ReconnectDelay: 10 * time.Millisecond,
+		}
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		_, ok := listener.BackendPID()
+		require.False(t, ok)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		pid, ok := listener.BackendPID()
+		require.True(t, ok)
+
+		var state string
+		err := conn.QueryRow(ctx, `select state from pg_stat_activity where pid = $1`, pid).Scan(&state)
+		require.NoError(t, err)
+
+		_, err = conn.Exec(ctx, `select pg_terminate_backend($1)`, pid)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			newPID, ok := listener.BackendPID()
+			return ok && newPID != pid
+		}, 5*time.Second, 10*time.Millisecond)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		_, ok = listener.BackendPID()
+		require.False(t, ok)
+	})
+}
+
+func TestListenerReconnectsDirtyConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		errChan := make(chan error, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				errChan <- err
+			},
+			ReconnectDelay: 10 * time.Millisecond,
+		}
+
+		pidChan := make(chan uint32, 8)
+		receivedChan := make(chan string, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			pidChan <- conn.PgConn().PID()
+			receivedChan <- notification.Payload
+			if notification.Payload == "1" {
+				// Leave a transaction open. Notifications are not delivered until it ends.
+				_, err := conn.Exec(ctx, "begin")
+				return err
+			}
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('foo', '1')`)
+		require.NoError(t, err)
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "1", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		firstPID := <-pidChan
+
+		select {
+		case err := <-errChan:
+			require.ErrorIs(t, err, pgxlisten.ErrConnDirty)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		// Wait for the new connection to listen.
+		time.Sleep(500 * time.Millisecond)
+
+		_, err = conn.Exec(ctx, `select pg_notify('foo', '2')`)
+		require.NoError(t, err)
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "2", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		require.NotEqual(t, firstPID, <-pidChan)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerHandleLatest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+		}
+
+		receivedChan := make(chan string, 8)
+		listener.HandleLatest("price", 200*time.Millisecond, pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		for i := 1; i <= 5; i++ {
+			_, err := conn.Exec(ctx, `select pg_notify('price', $1)`, fmt.Sprint(i))
+			require.NoError(t, err)
+		}
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "5", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		// The burst is handled only once.
+		time.Sleep(500 * time.Millisecond)
+		require.Empty(t, receivedChan)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerConnectAlternatesTargets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		// Both targets are the test database, told apart by application_name.
+		targets := []string{"pgxlisten-blue", "pgxlisten-green"}
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				config.RuntimeParams["application_name"] = targets[pgxlisten.AttemptFromContext(ctx)%len(targets)]
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			ReconnectDelay: 10 * time.Millisecond,
+		}
+
+		type target struct {
+			name string
+			pid  uint32
+		}
+		targetChan := make(chan target, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			var name string
+			if err := conn.QueryRow(ctx, "select current_setting('application_name')").Scan(&name); err != nil {
+				return err
+			}
+			targetChan <- target{name: name, pid: conn.PgConn().PID()}
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		var seen []string
+		for i := 0; i < 2; i++ {
+			// No way to know when Listener is ready so wait a little.
+			time.Sleep(2 * time.Second)
+
+			_, err := conn.Exec(ctx, `select pg_notify('foo', '1')`)
+			require.NoError(t, err)
+
+			select {
+			case target := <-targetChan:
+				seen = append(seen, target.name)
+				_, err = conn.Exec(ctx, `select pg_terminate_backend($1)`, target.pid)
+				require.NoError(t, err)
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+		require.Equal(t, []string{"pgxlisten-green", "pgxlisten-blue"}, seen)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerAddHandlerReplay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		defaultChan := make(chan string, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			ChannelsFunc: func(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+				return []string{"late"}, nil
+			},
+			DefaultHandler: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				defaultChan <- notification.Payload
+				return nil
+			}),
+			ReplayBuffer: 2,
+		}
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		for i := 1; i <= 3; i++ {
+			_, err := conn.Exec(ctx, `select pg_notify('late', $1)`, fmt.Sprint(i))
+			require.NoError(t, err)
+		}
+		for i := 1; i <= 3; i++ {
+			select {
+			case <-defaultChan:
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+
+		receivedChan := make(chan string, 8)
+		_, err := listener.AddHandlerReplay(ctx, "late", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Payload
+			return nil
+		}))
+		require.NoError(t, err)
+
+		_, err = conn.Exec(ctx, `select pg_notify('late', '4')`)
+		require.NoError(t, err)
+
+		// Only the last two buffered notifications are replayed, before the live one.
+		for _, expected := range []string{"2", "3", "4"} {
+			select {
+			case received := <-receivedChan:
+				require.Equal(t, expected, received)
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, defaultChan)
+	})
+}
+
+func TestListenerAddHandlerReplayNotConnected(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	connectAttempted := make(chan struct{}, 1)
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			select {
+			case connectAttempted <- struct{}{}:
+			default:
+			}
+			return nil, errors.New("connect failed")
+		},
+		LogError:       func(ctx context.Context, err error) {},
+		ReconnectDelay: time.Hour,
+		ReplayBuffer:   2,
+	}
+	listener.Handle("late", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "late", Payload: "1"}, nil))
+
+	receivedChan := make(chan string, 8)
+	handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		receivedChan <- notification.Payload
+		return nil
+	})
+
+	listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+	defer listenerCtxCancel()
+	listenerDoneChan := make(chan struct{})
+	go func() {
+		listener.Listen(listenerCtx)
+		close(listenerDoneChan)
+	}()
+	<-connectAttempted
+
+	// Between connections the replay is rejected rather than run concurrently with the next connection.
+	_, err := listener.AddHandlerReplay(ctx, "late", handler)
+	require.ErrorIs(t, err, pgxlisten.ErrNotConnected)
+	require.Empty(t, receivedChan)
+
+	listenerCtxCancel()
+	<-listenerDoneChan
+
+	// Once Listen has returned, the replay runs before AddHandlerReplay returns.
+	_, err = listener.AddHandlerReplay(ctx, "late", handler)
+	require.NoError(t, err)
+	require.Equal(t, "1", <-receivedChan)
+}
+
+func TestListenerAppName(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		for _, tt := range []struct {
+			appName  string
+			expected string
+		}{
+			{appName: "billing", expected: "billing: foo"},
+			{appName: strings.Repeat("ä", 40), expected: strings.Repeat("ä", 31)},
+		} {
+			listener := &pgxlisten.Listener{
+				Connect: func(ctx context.Context) (*pgx.Conn, error) {
+					config := defaultConnTestRunner.CreateConfig(ctx, t)
+					return pgx.ConnectConfig(ctx, config)
+				},
+				LogError: func(ctx context.Context, err error) {},
+				AppName:  tt.appName,
+			}
+			listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				return nil
+			}))
+
+			listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+			listenerDoneChan := make(chan struct{})
+
+			go func() {
+				listener.Listen(listenerCtx)
+				close(listenerDoneChan)
+			}()
+
+			// No way to know when Listener is ready so wait a little.
+			time.Sleep(2 * time.Second)
+
+			pid, ok := listener.BackendPID()
+			require.True(t, ok)
+
+			var appName string
+			err := conn.QueryRow(ctx, `select application_name from pg_stat_activity where pid = $1`, pid).Scan(&appName)
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, appName)
+
+			listenerCtxCancel()
+
+			select {
+			case <-listenerDoneChan:
+			case <-ctx.Done():
+				t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+			}
+		}
+	})
+}
+
+func TestListenerHandlePriority(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:      func(ctx context.Context, err error) {},
+			DrainOnCancel: 350 * time.Millisecond,
+		}
+
+		blockingChan := make(chan struct{})
+		listener.Handle("block", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			close(blockingChan)
+			<-ctx.Done()
+			return nil
+		}))
+
+		receivedChan := make(chan string, 8)
+		slowHandler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Channel + ":" + notification.Payload
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		})
+		listener.Handle("analytics", slowHandler)
+		listener.HandlePriority("payments", 10, slowHandler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := conn.Exec(ctx, `select pg_notify('block', '')`)
+		require.NoError(t, err)
+		select {
+		case <-blockingChan:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		// These queue up behind the blocked handler with analytics first.
+		for _, channel := range []string{"analytics", "payments"} {
+			for i := 1; i <= 3; i++ {
+				_, err := conn.Exec(ctx, `select pg_notify($1, $2)`, channel, fmt.Sprint(i))
+				require.NoError(t, err)
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		// The window only fits about four handlers, the first three of which must be the payments ones.
+		close(receivedChan)
+		var received []string
+		for r := range receivedChan {
+			received = append(received, r)
+		}
+		require.GreaterOrEqual(t, len(received), 3)
+		require.Less(t, len(received), 6)
+		require.Equal(t, []string{"payments:1", "payments:2", "payments:3"}, received[:3])
+	})
+}
+
+func TestListenerRelistenInterval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var mu sync.Mutex
+		listens := 0
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			OnExec: func(ctx context.Context, sql string) {
+				if sql == `listen "foo"` {
+					mu.Lock()
+					listens++
+					mu.Unlock()
+				}
+			},
+			RelistenInterval: 200 * time.Millisecond,
+		}
+
+		receivedChan := make(chan string, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		mu.Lock()
+		require.GreaterOrEqual(t, listens, 5)
+		mu.Unlock()
+
+		// Listening again does not disturb delivery.
+		_, err := conn.Exec(ctx, `select pg_notify('foo', '1')`)
+		require.NoError(t, err)
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "1", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerGeneration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			ReconnectDelay: 10 * time.Millisecond,
+		}
+
+		type observation struct {
+			generation int
+			pid        uint32
+		}
+		observedChan := make(chan observation, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			observedChan <- observation{generation: pgxlisten.GenerationFromContext(ctx), pid: conn.PgConn().PID()}
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		for _, expected := range []int{1, 2} {
+			// No way to know when Listener is ready so wait a little.
+			time.Sleep(2 * time.Second)
+
+			_, err := conn.Exec(ctx, `select pg_notify('foo', '1')`)
+			require.NoError(t, err)
+
+			select {
+			case observed := <-observedChan:
+				require.Equal(t, expected, observed.generation)
+
+				// Force a reconnect.
+				_, err = conn.Exec(ctx, `select pg_terminate_backend($1)`, observed.pid)
+				require.NoError(t, err)
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerWarnOnListenConnQuery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		errChan := make(chan error, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				errChan <- err
+			},
+			WarnOnListenConnQuery:    true,
+			ListenConnQueryThreshold: 50 * time.Millisecond,
+		}
+
+		handledChan := make(chan string, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			if notification.Payload == "slow" {
+				if _, err := conn.Exec(ctx, "select pg_sleep(0.2)"); err != nil {
+					return err
+				}
+			}
+			handledChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		for _, payload := range []string{"fast", "slow"} {
+			_, err := conn.Exec(ctx, `select pg_notify('foo', $1)`, payload)
+			require.NoError(t, err)
+
+			select {
+			case handled := <-handledChan:
+				require.Equal(t, payload, handled)
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+
+		// Only the slow handler is reported.
+		select {
+		case err := <-errChan:
+			require.ErrorIs(t, err, pgxlisten.ErrListenConnBlocked)
+			require.Contains(t, err.Error(), "foo handler")
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		require.Empty(t, errChan)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerShardFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var mu sync.Mutex
+		var listened []string
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			OnExec: func(ctx context.Context, sql string) {
+				if strings.HasPrefix(sql, "listen ") {
+					mu.Lock()
+					listened = append(listened, sql)
+					mu.Unlock()
+				}
+			},
+			ShardFilter: func(channel string) bool {
+				return strings.HasSuffix(channel, "_even")
+			},
+		}
+
+		receivedChan := make(chan string, 8)
+		handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Channel
+			return nil
+		})
+		listener.Handle("a_even", handler)
+		listener.Handle("b_odd", handler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, err := listener.AddHandler(ctx, "c_odd", handler)
+		require.NoError(t, err)
+
+		_, err = conn.Exec(ctx, `select pg_notify('b_odd', ''), pg_notify('c_odd', ''), pg_notify('a_even', '')`)
+		require.NoError(t, err)
+
+		select {
+		case received := <-receivedChan:
+			require.Equal(t, "a_even", received)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, receivedChan)
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, []string{`listen "a_even"`}, listened)
+	})
+}
+
+func TestListenerNextScheduledRuns(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := &manualClock{now: start}
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:         func(ctx context.Context, err error) {},
+			Clock:            clock,
+			KeepaliveTimeout: time.Minute,
+			BacklogInterval:  30 * time.Second,
+			Jitter:           -1,
+		}
+		listener.Handle("foo", &countingBacklogHandler{calls: make(chan string, 8)})
+		listener.Handle("bar", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		_, ok := listener.NextKeepalive()
+		require.False(t, ok)
+		_, ok = listener.NextBacklogRun("foo")
+		require.False(t, ok)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		keepaliveAt, ok := listener.NextKeepalive()
+		require.True(t, ok)
+		require.True(t, keepaliveAt.After(start.Add(50*time.Second)), keepaliveAt)
+		require.False(t, keepaliveAt.After(start.Add(time.Minute)), keepaliveAt)
+
+		backlogAt, ok := listener.NextBacklogRun("foo")
+		require.True(t, ok)
+		require.True(t, backlogAt.After(start.Add(20*time.Second)), backlogAt)
+		require.False(t, backlogAt.After(start.Add(30*time.Second)), backlogAt)
+
+		_, ok = listener.NextBacklogRun("bar")
+		require.False(t, ok)
+
+		// Times follow Clock.
+		clock.Advance(time.Hour)
+		keepaliveAt, ok = listener.NextKeepalive()
+		require.True(t, ok)
+		require.True(t, keepaliveAt.After(start.Add(time.Hour)), keepaliveAt)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		_, ok = listener.NextKeepalive()
+		require.False(t, ok)
+	})
+}
+
+func TestListenerOnQueueHighWater(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	// The usage cannot be raised on demand, so the listener's connections resolve pg_notification_queue_usage to a
+	// function in a schema searched before pg_catalog that reads it from a table.
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop schema if exists pgxlisten_queue_usage_test cascade;
+create schema pgxlisten_queue_usage_test;
+create table pgxlisten_queue_usage_test.usage (usage float8 not null);
+insert into pgxlisten_queue_usage_test.usage values (0.1);
+create function pgxlisten_queue_usage_test.pg_notification_queue_usage() returns float8
+	language sql as 'select usage from pgxlisten_queue_usage_test.usage';
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop schema if exists pgxlisten_queue_usage_test cascade;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		highWaterChan := make(chan float64, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				config.RuntimeParams["search_path"] = "pgxlisten_queue_usage_test, pg_catalog"
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			OnQueueHighWater: func(usage float64) {
+				highWaterChan <- usage
+			},
+			QueueCheckInterval: 50 * time.Millisecond,
+		}
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		setUsage := func(usage float64) {
+			_, err := conn.Exec(ctx, `update pgxlisten_queue_usage_test.usage set usage = $1`, usage)
+			require.NoError(t, err)
+			// Give the listener a few checks.
+			time.Sleep(300 * time.Millisecond)
+		}
+
+		setUsage(0.3)
+		require.Empty(t, highWaterChan)
+
+		// Rising past the threshold is reported once while usage stays high.
+		setUsage(0.6)
+		setUsage(0.7)
+		require.Len(t, highWaterChan, 1)
+		require.Equal(t, 0.6, <-highWaterChan)
+
+		// Falling below and crossing again is reported again.
+		setUsage(0.2)
+		setUsage(0.8)
+		require.Len(t, highWaterChan, 1)
+		require.Equal(t, 0.8, <-highWaterChan)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+// dripBacklogHandler works off remaining items, as many per run as BacklogLimitFromContext allows.
+type dripBacklogHandler struct {
+	mu        sync.Mutex
+	remaining int
+	runs      chan int
+}
+
+func (h *dripBacklogHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return nil
+}
+
+func (h *dripBacklogHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := h.remaining
+	if limit := pgxlisten.BacklogLimitFromContext(ctx); limit > 0 {
+		n = min(n, limit)
+	}
+	if n == 0 {
+		return pgxlisten.ErrBacklogEmpty
+	}
+	h.remaining -= n
+	h.runs <- n
+	return nil
+}
+
+func TestListenerBacklogMaxPerRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:         func(ctx context.Context, err error) {},
+			BacklogInterval:  50 * time.Millisecond,
+			BacklogMaxPerRun: 3,
+		}
+		handler := &dripBacklogHandler{remaining: 7, runs: make(chan int, 8)}
+		listener.Handle("foo", handler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		var runs []int
+		for len(runs) < 3 {
+			select {
+			case n := <-handler.runs:
+				runs = append(runs, n)
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+		require.Equal(t, []int{3, 3, 1}, runs)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, handler.runs)
+	})
+}
+
+func TestListenerBeforeWait(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		errHeartbeat := errors.New("heartbeat failed")
+		var mu sync.Mutex
+		calls := 0
+		fail := false
+		errChan := make(chan error, 8)
+		connectsChan := make(chan struct{}, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				connectsChan <- struct{}{}
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				if errors.Is(err, errHeartbeat) {
+					errChan <- err
+				}
+			},
+			ReconnectDelay: 10 * time.Millisecond,
+			BeforeWait: func(ctx context.Context, conn *pgx.Conn) error {
+				mu.Lock()
+				defer mu.Unlock()
+				calls++
+				if fail {
+					fail = false
+					return errHeartbeat
+				}
+				var one int
+				return conn.QueryRow(ctx, `select 1`).Scan(&one)
+			},
+		}
+
+		receivedChan := make(chan string, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			receivedChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+		<-connectsChan
+
+		mu.Lock()
+		require.Equal(t, 1, calls)
+		mu.Unlock()
+
+		// Each notification is followed by another call before the next wait.
+		for _, payload := range []string{"1", "2"} {
+			_, err := conn.Exec(ctx, `select pg_notify('foo', $1)`, payload)
+			require.NoError(t, err)
+			select {
+			case received := <-receivedChan:
+				require.Equal(t, payload, received)
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return calls == 3
+		}, time.Second, 10*time.Millisecond)
+
+		// An error reconnects.
+		mu.Lock()
+		fail = true
+		mu.Unlock()
+		_, err := conn.Exec(ctx, `select pg_notify('foo', '3')`)
+		require.NoError(t, err)
+		select {
+		case err := <-errChan:
+			require.ErrorIs(t, err, errHeartbeat)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		select {
+		case <-connectsChan:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerReady(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		releaseChan := make(chan struct{})
+		var releaseOnce sync.Once
+		handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		})
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			ReconnectDelay: 10 * time.Millisecond,
+			// Channels from ChannelsFunc are listened to after those of handlers.
+			ChannelsFunc: func(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+				return []string{"slow"}, nil
+			},
+			DefaultHandler: handler,
+			// Hold up listening to slow the first time.
+			OnExec: func(ctx context.Context, sql string) {
+				if sql == `listen "slow"` {
+					<-releaseChan
+				}
+			},
+		}
+		listener.Handle("jobs", handler)
+
+		jobsReady := listener.Ready("jobs")
+		slowReady := listener.Ready("slow")
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+		defer releaseOnce.Do(func() { close(releaseChan) })
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		select {
+		case <-jobsReady:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		select {
+		case <-slowReady:
+			t.Fatal("slow is ready before it is listened to")
+		default:
+		}
+
+		releaseOnce.Do(func() { close(releaseChan) })
+		select {
+		case <-slowReady:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+		require.Equal(t, jobsReady, listener.Ready("jobs"))
+
+		// After a reconnect readiness is signaled anew.
+		pid, ok := listener.BackendPID()
+		require.True(t, ok)
+		_, err := conn.Exec(ctx, `select pg_terminate_backend($1)`, pid)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			newPID, ok := listener.BackendPID()
+			return ok && newPID != pid
+		}, 5*time.Second, 10*time.Millisecond)
+
+		newJobsReady := listener.Ready("jobs")
+		require.NotEqual(t, jobsReady, newJobsReady)
+		select {
+		case <-newJobsReady:
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerAlreadyListening(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			return nil, errors.New("unreachable")
+		},
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	receiver := &scriptedReceiver{exhausted: make(chan struct{})}
+	exhaustedChan := receiver.exhausted
+
+	listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+	defer listenerCtxCancel()
+	listenerDoneChan := make(chan error, 1)
+	go func() {
+		listenerDoneChan <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	select {
+	case <-exhaustedChan:
+	case <-ctx.Done():
+		t.Fatalf("%v", ctx.Err())
+	}
+
+	require.ErrorIs(t, listener.Listen(ctx), pgxlisten.ErrAlreadyListening)
+	require.ErrorIs(t, listener.ListenReceiver(ctx, &scriptedReceiver{err: io.EOF}), pgxlisten.ErrAlreadyListening)
+
+	listenerCtxCancel()
+	select {
+	case err := <-listenerDoneChan:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-ctx.Done():
+		t.Fatalf("ctx cancelled while waiting for ListenReceiver() to return: %v", ctx.Err())
+	}
+
+	// Listening again works once the first call has returned.
+	require.NoError(t, listener.ListenReceiver(ctx, &scriptedReceiver{err: io.EOF}))
+}
+
+func TestListenerQueueSurvivesReconnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			ReconnectDelay: 10 * time.Millisecond,
+			MaxConcurrency: 1,
+		}
+
+		blockedChan := make(chan struct{})
+		releaseChan := make(chan struct{})
+		listener.Handle("block", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			close(blockedChan)
+			<-releaseChan
+			return nil
+		}))
+		handledChan := make(chan int, 8)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			handledChan <- pgxlisten.GenerationFromContext(ctx)
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		// The block handler holds the only slot, so the foo notifications stay queued.
+		_, err := conn.Exec(ctx, `select pg_notify('block', '1')`)
+		require.NoError(t, err)
+		<-blockedChan
+		for i := range 3 {
+			_, err := conn.Exec(ctx, `select pg_notify('foo', $1)`, fmt.Sprint(i))
+			require.NoError(t, err)
+		}
+		require.Eventually(t, func() bool {
+			return listener.Stats().Received == 4
+		}, 5*time.Second, 10*time.Millisecond)
+
+		pid, ok := listener.BackendPID()
+		require.True(t, ok)
+		_, err = conn.Exec(ctx, `select pg_terminate_backend($1)`, pid)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			newPID, ok := listener.BackendPID()
+			return ok && newPID != pid
+		}, 5*time.Second, 10*time.Millisecond)
+
+		close(releaseChan)
+		for range 3 {
+			select {
+			case generation := <-handledChan:
+				require.Equal(t, 1, generation)
+			case <-ctx.Done():
+				t.Fatalf("%v", ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerConnectedSince(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		clock := &manualClock{now: start}
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			Clock:          clock,
+			ReconnectDelay: 10 * time.Millisecond,
+		}
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		_, ok := listener.ConnectedSince()
+		require.False(t, ok)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		connectedSince, ok := listener.ConnectedSince()
+		require.True(t, ok)
+		require.Equal(t, start, connectedSince)
+
+		// A reconnect resets it.
+		clock.Advance(time.Hour)
+		pid, ok := listener.BackendPID()
+		require.True(t, ok)
+		_, err := conn.Exec(ctx, `select pg_terminate_backend($1)`, pid)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			connectedSince, ok := listener.ConnectedSince()
+			return ok && connectedSince.Equal(start.Add(time.Hour))
+		}, 5*time.Second, 10*time.Millisecond)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		_, ok = listener.ConnectedSince()
+		require.False(t, ok)
+	})
+}
+
+func TestListenerStrictInitialListen(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		for _, strict := range []bool{true, false} {
+			var listenConn *pgx.Conn
+			listener := &pgxlisten.Listener{
+				Connect: func(ctx context.Context) (*pgx.Conn, error) {
+					config := defaultConnTestRunner.CreateConfig(ctx, t)
+					var err error
+					listenConn, err = pgx.ConnectConfig(ctx, config)
+					return listenConn, err
+				},
+				// Abort a transaction so that LISTEN of bad fails. OnExec runs on the receive loop just before LISTEN.
+				OnExec: func(ctx context.Context, sql string) {
+					if sql == `listen "bad"` {
+						listenConn.Exec(ctx, `begin; select 1/0`)
+					}
+				},
+				LogError:             func(ctx context.Context, err error) {},
+				ReconnectDelay:       10 * time.Millisecond,
+				MaxReconnectAttempts: 2,
+				StrictInitialListen:  strict,
+			}
+			for _, channel := range []string{"bad", "good"} {
+				listener.Handle(channel, pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+					return nil
+				}))
+			}
+
+			err := listener.Listen(ctx)
+			if strict {
+				require.ErrorIs(t, err, pgxlisten.ErrInitialListen)
+				require.NotErrorIs(t, err, pgxlisten.ErrMaxReconnectAttempts)
+				require.ErrorContains(t, err, `listen "bad"`)
+			} else {
+				require.ErrorIs(t, err, pgxlisten.ErrMaxReconnectAttempts)
+				require.NotErrorIs(t, err, pgxlisten.ErrInitialListen)
+			}
+		}
+	})
+}
+
+func TestListenerOnSubscribed(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		// Backlog runs and OnSubscribed calls are recorded in order.
+		events := make(chan string, 16)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:       func(ctx context.Context, err error) {},
+			ReconnectDelay: 10 * time.Millisecond,
+			OnSubscribed: func(ctx context.Context, channels []string) {
+				events <- fmt.Sprintf("subscribed %v", channels)
+			},
+		}
+		listener.Handle("foo", &countingBacklogHandler{calls: events})
+		listener.Handle("bar", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		receive := func(expected string) {
+			select {
+			case event := <-events:
+				require.Equal(t, expected, event)
+			case <-ctx.Done():
+				t.Fatalf("%s: %v", expected, ctx.Err())
+			}
+		}
+
+		receive("foo")
+		receive("subscribed [bar foo]")
+
+		// It is called again once resubscribed after a reconnect.
+		pid, ok := listener.BackendPID()
+		require.True(t, ok)
+		_, err := conn.Exec(ctx, `select pg_terminate_backend($1)`, pid)
+		require.NoError(t, err)
+
+		receive("foo")
+		receive("subscribed [bar foo]")
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerReconnectLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	var attempts int
+	var limited bool
+	errConnect := errors.New("connect failed")
+	listener := &pgxlisten.Listener{
+		Connect: func(ctx context.Context) (*pgx.Conn, error) {
+			attempts++
+			return nil, errConnect
+		},
+		LogError: func(ctx context.Context, err error) {},
+		LogDebug: func(ctx context.Context, msg string) {
+			limited = limited || strings.HasPrefix(msg, "reconnects rate limited")
+		},
+		// Without the limit Listen would reconnect without waiting.
+		ReconnectDelay:       -1,
+		ReconnectLimit:       4,
+		ReconnectLimitPeriod: time.Second,
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	err := listener.Listen(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// The first attempt, a burst of 4 reconnects, and one reconnect every 250ms after that.
+	require.LessOrEqual(t, attempts, 9)
+	require.GreaterOrEqual(t, attempts, 6)
+	require.True(t, limited)
+}
+
+func TestListenerReconnectInitialDelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		connectedChan := make(chan time.Time, 8)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				connectedChan <- time.Now()
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+			// Without the initial delay the reconnect would not happen before ctx is done.
+			ReconnectDelay:        time.Hour,
+			ReconnectInitialDelay: 500 * time.Millisecond,
+		}
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		<-connectedChan
+		select {
+		case <-listener.Ready("foo"):
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		pid, ok := listener.BackendPID()
+		require.True(t, ok)
+		dropped := time.Now()
+		_, err := conn.Exec(ctx, `select pg_terminate_backend($1)`, pid)
+		require.NoError(t, err)
+
+		select {
+		case reconnected := <-connectedChan:
+			require.GreaterOrEqual(t, reconnected.Sub(dropped), 500*time.Millisecond)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for reconnect: %v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+type concurrentBacklogHandler struct {
+	running    *atomic.Int32
+	maxRunning *atomic.Int32
+	calls      chan *pgx.Conn
+}
+
+func (h *concurrentBacklogHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return nil
+}
+
+func (h *concurrentBacklogHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	running := h.running.Add(1)
+	defer h.running.Add(-1)
+	for {
+		maxRunning := h.maxRunning.Load()
+		if running <= maxRunning || h.maxRunning.CompareAndSwap(maxRunning, running) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	h.calls <- conn
+	return nil
+}
+
+func TestListenerBacklogConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:           func(ctx context.Context, err error) {},
+			BacklogConcurrency: 3,
+		}
+		handler := &concurrentBacklogHandler{
+			running:    &atomic.Int32{},
+			maxRunning: &atomic.Int32{},
+			calls:      make(chan *pgx.Conn, 10),
+		}
+		for i := range 10 {
+			listener.Handle(fmt.Sprintf("backlog%d", i), handler)
+		}
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		for range 10 {
+			select {
+			case backlogConn := <-handler.calls:
+				require.Nil(t, backlogConn)
+			case <-ctx.Done():
+				t.Fatalf("ctx cancelled while waiting for backlogs: %v", ctx.Err())
+			}
+		}
+		require.Equal(t, int32(3), handler.maxRunning.Load())
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerBacklogConcurrencyInterval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		// The backlogs scheduled concurrently each compute their next run with jitter, which must be safe under -race.
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:           func(ctx context.Context, err error) {},
+			BacklogConcurrency: 4,
+			BacklogInterval:    time.Hour,
+		}
+		handler := &concurrentBacklogHandler{
+			running:    &atomic.Int32{},
+			maxRunning: &atomic.Int32{},
+			calls:      make(chan *pgx.Conn, 8),
+		}
+		for i := range 8 {
+			listener.Handle(fmt.Sprintf("backlog%d", i), handler)
+		}
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		for range 8 {
+			select {
+			case <-handler.calls:
+			case <-ctx.Done():
+				t.Fatalf("ctx cancelled while waiting for backlogs: %v", ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerChannelCaseMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		for _, tt := range []struct {
+			mode     pgxlisten.ChannelCaseMode
+			notify   string
+			ignored  string
+			expected string
+		}{
+			{mode: pgxlisten.ChannelCasePreserve, notify: `select pg_notify('MixedCase', 'x')`, ignored: `notify MixedCase`, expected: "MixedCase"},
+			{mode: pgxlisten.ChannelCaseLower, notify: `notify MixedCase`, ignored: `select pg_notify('MixedCase', 'x')`, expected: "mixedcase"},
+			{mode: pgxlisten.ChannelCaseUpper, notify: `select pg_notify('MIXEDCASE', 'x')`, ignored: `notify MixedCase`, expected: "MIXEDCASE"},
+		} {
+			listener := &pgxlisten.Listener{
+				Connect: func(ctx context.Context) (*pgx.Conn, error) {
+					config := defaultConnTestRunner.CreateConfig(ctx, t)
+					return pgx.ConnectConfig(ctx, config)
+				},
+				LogError:        func(ctx context.Context, err error) {},
+				ChannelCaseMode: tt.mode,
+			}
+			channelChan := make(chan string, 8)
+			listener.Handle("MixedCase", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				channelChan <- notification.Channel
+				return nil
+			}))
+
+			listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+			listenerDoneChan := make(chan struct{})
+
+			go func() {
+				listener.Listen(listenerCtx)
+				close(listenerDoneChan)
+			}()
+
+			select {
+			case <-listener.Ready("MixedCase"):
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", tt.mode, ctx.Err())
+			}
+
+			_, err := conn.Exec(ctx, tt.ignored)
+			require.NoError(t, err)
+			_, err = conn.Exec(ctx, tt.notify)
+			require.NoError(t, err)
+
+			// Notifications are delivered in order, so the ignored one would have been handled first.
+			select {
+			case channel := <-channelChan:
+				require.Equal(t, tt.expected, channel, tt.mode)
+			case <-ctx.Done():
+				t.Fatalf("%d. %v", tt.mode, ctx.Err())
+			}
+
+			listenerCtxCancel()
+
+			select {
+			case <-listenerDoneChan:
+			case <-ctx.Done():
+				t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+			}
+			require.Empty(t, channelChan)
+		}
+	})
+}
+
+func TestListenerHandleBacklogTrigger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+		}
+		backlogHandler := &countingBacklogHandler{calls: make(chan string, 10)}
+		listener.HandleBacklogTrigger("jobs", 200*time.Millisecond, 0, backlogHandler)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// The backlog is handled on connect.
+		select {
+		case channel := <-backlogHandler.calls:
+			require.Equal(t, "jobs", channel)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for backlog: %v", ctx.Err())
+		}
+
+		burstStart := time.Now()
+		for range 5 {
+			_, err := conn.Exec(ctx, `select pg_notify('jobs', '')`)
+			require.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+		}
+
+		select {
+		case channel := <-backlogHandler.calls:
+			require.Equal(t, "jobs", channel)
+			require.GreaterOrEqual(t, time.Since(burstStart), 400*time.Millisecond)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for backlog: %v", ctx.Err())
+		}
+
+		// The burst is coalesced into a single run.
+		time.Sleep(500 * time.Millisecond)
+		require.Empty(t, backlogHandler.calls)
+
+		// A steady stream of notifications does not postpone the run past maxDelay, 2s for a window of 200ms.
+		burstStart = time.Now()
+		ranChan := make(chan time.Duration, 1)
+		go func() {
+			select {
+			case <-backlogHandler.calls:
+				ranChan <- time.Since(burstStart)
+			case <-ctx.Done():
+			}
+		}()
+		for time.Since(burstStart) < 3*time.Second {
+			_, err := conn.Exec(ctx, `select pg_notify('jobs', '')`)
+			require.NoError(t, err)
+			time.Sleep(50 * time.Millisecond)
+		}
+		select {
+		case d := <-ranChan:
+			require.GreaterOrEqual(t, d, 2*time.Second)
+			require.Less(t, d, 3*time.Second)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for backlog: %v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerFatalHandlerErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var logged []error
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {
+				logged = append(logged, err)
+			},
+			FatalHandlerErrors: true,
+		}
+		errBroken := errors.New("broken")
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			if notification.Payload == "fail" {
+				return errBroken
+			}
+			return nil
+		}))
+
+		listenerErrChan := make(chan error, 1)
+		go func() {
+			listenerErrChan <- listener.Listen(ctx)
+		}()
+
+		select {
+		case <-listener.Ready("foo"):
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+
+		_, err := conn.Exec(ctx, `select pg_notify('foo', 'ok')`)
+		require.NoError(t, err)
+		_, err = conn.Exec(ctx, `select pg_notify('foo', 'fail')`)
+		require.NoError(t, err)
+
+		select {
+		case err := <-listenerErrChan:
+			require.ErrorIs(t, err, pgxlisten.ErrHandlerFailed)
+			require.ErrorIs(t, err, errBroken)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+		require.NotEmpty(t, logged)
+		require.ErrorIs(t, logged[0], errBroken)
+	})
+}
+
+func TestListenerSelfTestOnConnect(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var listenConn *pgx.Conn
+		var execsMu sync.Mutex
+		var execs []string
+		subscribedChan := make(chan struct{}, 1)
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				var err error
+				listenConn, err = pgx.ConnectConfig(ctx, config)
+				return listenConn, err
+			},
+			OnExec: func(ctx context.Context, sql string) {
+				execsMu.Lock()
+				defer execsMu.Unlock()
+				execs = append(execs, sql)
+			},
+			OnSubscribed: func(ctx context.Context, channels []string) {
+				subscribedChan <- struct{}{}
+			},
+			SelfTestOnConnect: true,
+		}
+		notificationChan := make(chan string, 1)
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			notificationChan <- notification.Payload
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		select {
+		case <-subscribedChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for OnSubscribed: %v", ctx.Err())
+		}
+
+		// The round-trip runs on the private channel before the Listener subscribes to its own channels.
+		execsMu.Lock()
+		selfTestChannel := fmt.Sprintf(`"pgxlisten_self_test_%d"`, listenConn.PgConn().PID())
+		require.Equal(t, []string{
+			"listen " + selfTestChannel,
+			"select pg_notify($1, $2)",
+			"unlisten " + selfTestChannel,
+			`listen "foo"`,
+		}, execs)
+		execsMu.Unlock()
+
+		_, err := conn.Exec(ctx, `select pg_notify('foo', 'live')`)
+		require.NoError(t, err)
+		select {
+		case payload := <-notificationChan:
+			require.Equal(t, "live", payload)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for notification: %v", ctx.Err())
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		// A connection that does not deliver the test notification is reported and replaced.
+		var loggedErrs []error
+		listener = &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				var err error
+				listenConn, err = pgx.ConnectConfig(ctx, config)
+				return listenConn, err
+			},
+			// Break delivery by unlistening just before the test notification is sent.
+			OnExec: func(ctx context.Context, sql string) {
+				if sql == "select pg_notify($1, $2)" {
+					listenConn.Exec(ctx, `unlisten *`)
+				}
+			},
+			LogError: func(ctx context.Context, err error) {
+				loggedErrs = append(loggedErrs, err)
+			},
+			ReconnectDelay:       10 * time.Millisecond,
+			MaxReconnectAttempts: 2,
+			SelfTestOnConnect:    true,
+			SelfTestTimeout:      100 * time.Millisecond,
+		}
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		err = listener.Listen(ctx)
+		require.ErrorIs(t, err, pgxlisten.ErrMaxReconnectAttempts)
+		require.Len(t, loggedErrs, 2)
+		for _, err := range loggedErrs {
+			require.ErrorIs(t, err, pgxlisten.ErrSelfTest)
+		}
+	})
+}
+
+func TestListenerBacklogConcurrencySingleThreaded(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:           func(ctx context.Context, err error) {},
+			BacklogConcurrency: 3,
+			SingleThreaded:     true,
+		}
+		handler := &concurrentBacklogHandler{
+			running:    &atomic.Int32{},
+			maxRunning: &atomic.Int32{},
+			calls:      make(chan *pgx.Conn, 4),
+		}
+		for i := range 4 {
+			listener.Handle(fmt.Sprintf("backlog%d", i), handler)
+		}
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// BacklogConcurrency is ignored, so the backlogs run one at a time on the listening connection.
+		for range 4 {
+			select {
+			case backlogConn := <-handler.calls:
+				require.NotNil(t, backlogConn)
+			case <-ctx.Done():
+				t.Fatalf("ctx cancelled while waiting for backlogs: %v", ctx.Err())
+			}
+		}
+		require.Equal(t, int32(1), handler.maxRunning.Load())
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
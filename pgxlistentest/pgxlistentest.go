@@ -0,0 +1,152 @@
+// Package pgxlistentest provides utilities for testing code that uses pgxlisten. It is intended for use in tests only.
+package pgxlistentest
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+// NewNotification returns a notification as it would be received from PostgreSQL for channel with payload.
+func NewNotification(channel, payload string) *pgconn.Notification {
+	return NewNotificationWithPID(0, channel, payload)
+}
+
+// NewNotificationWithPID returns a notification like NewNotification that appears to be sent by the backend with
+// process ID pid.
+func NewNotificationWithPID(pid uint32, channel, payload string) *pgconn.Notification {
+	return &pgconn.Notification{
+		PID:     pid,
+		Channel: channel,
+		Payload: payload,
+	}
+}
+
+// DispatchForTest runs notification through the handlers registered on listener without a database connection and
+// returns the handler's error. Handlers receive a nil *pgx.Conn, so handlers under test must not use it.
+func DispatchForTest(ctx context.Context, listener *pgxlisten.Listener, notification *pgconn.Notification) error {
+	return listener.Dispatch(ctx, notification, nil)
+}
+
+// Receiver is a pgxlisten.Receiver that yields the notifications passed to Send, so a Listener can be run with
+// ListenReceiver in tests without a database. Use NewReceiver to create one.
+type Receiver struct {
+	notifications chan *pgconn.Notification
+	closed        chan struct{}
+}
+
+// NewReceiver returns a Receiver without any notifications.
+func NewReceiver() *Receiver {
+	return &Receiver{
+		notifications: make(chan *pgconn.Notification),
+		closed:        make(chan struct{}),
+	}
+}
+
+// Send delivers notification to the Listener and returns once it has been received, or returns ctx.Err() if ctx is
+// done first. Handlers of the notification may still be running when Send returns.
+func (r *Receiver) Send(ctx context.Context, notification *pgconn.Notification) error {
+	select {
+	case r.notifications <- notification:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close makes WaitForNotification return io.EOF, so ListenReceiver returns nil. It must not be called concurrently
+// with Send or more than once.
+func (r *Receiver) Close() {
+	close(r.closed)
+}
+
+// WaitForNotification implements pgxlisten.Receiver.
+func (r *Receiver) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case notification := <-r.notifications:
+		return notification, nil
+	case <-r.closed:
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// FlappyConnect wraps a Listener's Connect function so tests can drop the listening connection on demand, e.g. to
+// test reconnects, backlog handling after reconnecting, or generations without relying on the timing of
+// pg_terminate_backend. Use NewFlappyConnect to create one and set its Connect method as Listener.Connect.
+type FlappyConnect struct {
+	connect func(ctx context.Context) (*pgx.Conn, error)
+
+	mu       sync.Mutex
+	conns    []*pgx.Conn
+	connects int
+	changed  chan struct{}
+}
+
+// NewFlappyConnect returns a FlappyConnect whose connections are established by connect.
+func NewFlappyConnect(connect func(ctx context.Context) (*pgx.Conn, error)) *FlappyConnect {
+	return &FlappyConnect{connect: connect, changed: make(chan struct{})}
+}
+
+// Connect establishes a connection with the wrapped function and keeps it so Drop can break it. It is meant to be used
+// as Listener.Connect.
+func (f *FlappyConnect) Connect(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := f.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.conns = append(f.conns, conn)
+	f.connects++
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return conn, nil
+}
+
+// Drop breaks the connections returned by Connect by closing their network connections, as if the database or the
+// network had dropped them. The Listener sees an error on its next use of the connection, which is immediate if it is
+// waiting for notifications, and reconnects.
+func (f *FlappyConnect) Drop() {
+	f.mu.Lock()
+	conns := f.conns
+	f.conns = nil
+	f.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.PgConn().Conn().Close()
+	}
+}
+
+// Connects returns how many connections Connect has established.
+func (f *FlappyConnect) Connects() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects
+}
+
+// WaitForConnects waits until Connect has established n connections in total. It returns ctx.Err() if ctx is done
+// first.
+func (f *FlappyConnect) WaitForConnects(ctx context.Context, n int) error {
+	for {
+		f.mu.Lock()
+		connects, changed := f.connects, f.changed
+		f.mu.Unlock()
+		if connects >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
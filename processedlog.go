@@ -0,0 +1,44 @@
+package pgxlisten
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ProcessedLog records the notifications handled by HandleTx handlers in a table, as a durable log for auditing and
+// replay. The table needs columns named channel, payload_sha256, and processed_at, e.g.
+//
+//	create table notification_log (channel text not null, payload_sha256 text not null, processed_at timestamptz not null);
+type ProcessedLog struct {
+	// Table is the name of the table. It may be schema qualified. Table is required.
+	Table string
+}
+
+func (p *ProcessedLog) table() string {
+	return pgx.Identifier(strings.Split(p.Table, ".")).Sanitize()
+}
+
+// Wrap returns a function for Listener.HandleTx that calls fn and, if it succeeds, records the notification's channel,
+// the hex-encoded SHA-256 hash of its payload, and the transaction's timestamp in the same transaction. The record is
+// therefore committed if and only if fn's work is. fn may itself be an adapter, e.g. one that decodes the payload.
+// Listener.DB should be set to a pool so that the log is not written on the listening connection.
+func (p *ProcessedLog) Wrap(fn func(ctx context.Context, notification *pgconn.Notification, tx pgx.Tx) error) func(ctx context.Context, notification *pgconn.Notification, tx pgx.Tx) error {
+	return func(ctx context.Context, notification *pgconn.Notification, tx pgx.Tx) error {
+		if err := fn(ctx, notification, tx); err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256([]byte(notification.Payload))
+		sql := fmt.Sprintf("insert into %s (channel, payload_sha256, processed_at) values ($1, $2, now())", p.table())
+		if _, err := tx.Exec(ctx, sql, notification.Channel, hex.EncodeToString(hash[:])); err != nil {
+			return fmt.Errorf("record processed %s notification: %w", notification.Channel, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,70 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestProcessedLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_work_test, pgxlisten_log_test;
+create table pgxlisten_work_test (key text not null);
+create table pgxlisten_log_test (channel text not null, payload_sha256 text not null, processed_at timestamptz not null);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_work_test, pgxlisten_log_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		errInvalid := errors.New("invalid")
+		log := &pgxlisten.ProcessedLog{Table: "pgxlisten_log_test"}
+
+		listener := &pgxlisten.Listener{DB: conn}
+		listener.HandleTx("work", log.Wrap(func(ctx context.Context, notification *pgconn.Notification, tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, `insert into pgxlisten_work_test (key) values ($1)`, notification.Payload); err != nil {
+				return err
+			}
+			if notification.Payload == "fail" {
+				return errInvalid
+			}
+			return nil
+		}))
+
+		require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "work", Payload: "ok"}, nil))
+		require.ErrorIs(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "work", Payload: "fail"}, nil), errInvalid)
+
+		rows, _ := conn.Query(ctx, `select key from pgxlisten_work_test`)
+		keys, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		require.NoError(t, err)
+		require.Equal(t, []string{"ok"}, keys)
+
+		// Only the successful notification is logged, along with its work.
+		type record struct {
+			Channel       string
+			PayloadSHA256 string
+			Recent        bool
+		}
+		rows, _ = conn.Query(ctx, `select channel, payload_sha256, processed_at > now() - interval '1 minute' from pgxlisten_log_test`)
+		records, err := pgx.CollectRows(rows, pgx.RowToStructByPos[record])
+		require.NoError(t, err)
+		hash := sha256.Sum256([]byte("ok"))
+		require.Equal(t, []record{{Channel: "work", PayloadSHA256: hex.EncodeToString(hash[:]), Recent: true}}, records)
+	})
+}
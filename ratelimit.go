@@ -0,0 +1,45 @@
+package pgxlisten
+
+import (
+	"time"
+)
+
+const defaultReconnectLimitPeriod = time.Minute
+
+// tokenBucket limits the rate of reconnects. It starts full and refills continuously.
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// take takes a token at now from a bucket holding up to limit tokens that refills limit tokens per period. It returns
+// how long to wait until the token is available, which is 0 if the bucket was not empty.
+func (b *tokenBucket) take(now time.Time, limit int, period time.Duration) time.Duration {
+	rate := float64(limit) / float64(period)
+	if b.at.IsZero() {
+		b.tokens = float64(limit)
+	} else {
+		b.tokens = min(float64(limit), b.tokens+float64(now.Sub(b.at))*rate)
+	}
+	b.at = now
+
+	// The token is taken even if it is not available yet, so the next one is due 1/rate later.
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate)
+}
+
+// reconnectLimitWait takes a token for the next reconnect and returns how long to wait for it. It returns 0 if
+// ReconnectLimit is not set.
+func (l *Listener) reconnectLimitWait() time.Duration {
+	if l.ReconnectLimit <= 0 {
+		return 0
+	}
+	period := l.ReconnectLimitPeriod
+	if period == 0 {
+		period = defaultReconnectLimitPeriod
+	}
+	return l.reconnectBucket.take(l.now(), l.ReconnectLimit, period)
+}
@@ -0,0 +1,54 @@
+package pgxlisten
+
+// Ready returns a channel that is closed once channel is listened to on the current connection, e.g. to wait until
+// "jobs" is live before enqueueing work. It is already closed if channel is listened to now. Once the connection is
+// lost, or the channel is unlistened with Subscription.Unlisten, Ready returns a new channel that is closed when
+// LISTEN succeeds again. A channel that is never listened to, e.g. because it is not in the Listener's shard, is never
+// ready.
+func (l *Listener) Ready(channel string) <-chan struct{} {
+	channel = l.channelName(channel)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.readyChan(channel)
+}
+
+// readyChan returns the readiness channel of channel, creating it if needed. l.mu must be held.
+func (l *Listener) readyChan(channel string) chan struct{} {
+	if l.ready == nil {
+		l.ready = make(map[string]chan struct{})
+	}
+	ch, ok := l.ready[channel]
+	if !ok {
+		ch = make(chan struct{})
+		l.ready[channel] = ch
+	}
+	return ch
+}
+
+// setReady closes the readiness channel of channel after LISTEN succeeded.
+func (l *Listener) setReady(channel string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ch := l.readyChan(channel)
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// resetReady replaces the readiness channel of channel if it was closed, since channel is no longer listened to.
+// Channels that were not closed yet are kept for those waiting on them. l.mu must be held.
+func (l *Listener) resetReady(channel string) {
+	ch, ok := l.ready[channel]
+	if !ok {
+		return
+	}
+	select {
+	case <-ch:
+		delete(l.ready, channel)
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Receiver is a source of notifications. *pgx.Conn implements Receiver and is what Listen uses. Other implementations
+// can deliver notifications from another transport, such as logical replication, or from a script in tests, through
+// ListenReceiver.
+type Receiver interface {
+	// WaitForNotification waits for the next notification and returns it. It returns an error if ctx is done or the
+	// Receiver fails. io.EOF means there are no more notifications.
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+}
+
+var _ Receiver = (*pgx.Conn)(nil)
+
+// ListenReceiver handles the notifications of r like Listen handles those it receives, applying the same handlers,
+// Interceptors, deduplication, concurrency, and draining. Since r owns its transport there is nothing to listen to,
+// reconnect, or keep alive, so Connect, ChannelsFunc, backlogs, and methods that use the listening connection, such
+// as WithConn, do not apply. Handlers receive r as conn if it is a *pgx.Conn and nil otherwise.
+//
+// ListenReceiver returns when ctx is cancelled, with ctx.Err() or ErrListenerShutdown as Listen does, or when r fails,
+// with its error. It returns nil when r returns io.EOF.
+func (l *Listener) ListenReceiver(ctx context.Context, r Receiver) error {
+	if !l.running.CompareAndSwap(false, true) {
+		return ErrAlreadyListening
+	}
+	defer l.running.Store(false)
+	ctx = l.nameContext(ctx)
+
+	if r == nil {
+		return errors.New("ListenReceiver: Receiver is nil")
+	}
+	if err := l.checkHandlers(); err != nil {
+		return fmt.Errorf("ListenReceiver: %w", err)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	defer l.startRun(cancel)()
+	defer l.startDispatcher(ctx)()
+
+	conn, _ := r.(*pgx.Conn)
+	for {
+		notification, err := r.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("receive: %w", err)
+		}
+
+		l.releaseSuppressed(ctx, conn)
+		l.dispatch(ctx, notification, conn)
+	}
+}
@@ -0,0 +1,742 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+// scriptedReceiver yields notifications in order and then err. If err is nil it closes exhausted, if set, and waits
+// for ctx to be done instead.
+type scriptedReceiver struct {
+	notifications []*pgconn.Notification
+	err           error
+	exhausted     chan struct{}
+}
+
+func (r *scriptedReceiver) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	if len(r.notifications) == 0 {
+		if r.err == nil {
+			if r.exhausted != nil {
+				close(r.exhausted)
+				r.exhausted = nil
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, r.err
+	}
+	notification := r.notifications[0]
+	r.notifications = r.notifications[1:]
+	return notification, nil
+}
+
+func TestListenReceiver(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	var received []string
+	var errs []error
+	listener := &pgxlisten.Listener{
+		LogError: func(ctx context.Context, err error) {
+			errs = append(errs, err)
+		},
+		Interceptors: []func(*pgconn.Notification) (*pgconn.Notification, bool){
+			func(notification *pgconn.Notification) (*pgconn.Notification, bool) {
+				return notification, notification.Payload != "skip"
+			},
+		},
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		require.Nil(t, conn)
+		received = append(received, notification.Payload)
+		return nil
+	}))
+
+	receiver := &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "foo", Payload: "1"},
+			{Channel: "foo", Payload: "skip"},
+			{Channel: "bar", Payload: "unrouted"},
+			{Channel: "foo", Payload: "2"},
+		},
+		err: io.EOF,
+	}
+
+	err := listener.ListenReceiver(ctx, receiver)
+	require.NoError(t, err)
+	require.Equal(t, []string{"1", "2"}, received)
+	require.Len(t, errs, 1)
+	require.Equal(t, uint64(4), listener.Stats().Received)
+}
+
+func TestListenReceiverError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	listener := &pgxlisten.Listener{}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	errBroken := errors.New("broken")
+	err := listener.ListenReceiver(ctx, &scriptedReceiver{err: errBroken})
+	require.ErrorIs(t, err, errBroken)
+
+	ctx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err = listener.ListenReceiver(ctx, &scriptedReceiver{})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestListenReceiverPrioritizer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	listener := &pgxlisten.Listener{
+		MaxConcurrency: 1,
+		// Lower payloads first.
+		Prioritizer: func(a, b *pgconn.Notification) bool {
+			return a.Payload < b.Payload
+		},
+	}
+
+	releaseChan := make(chan struct{})
+	listener.Handle("block", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		<-releaseChan
+		return nil
+	}))
+
+	receivedChan := make(chan string, 8)
+	handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		receivedChan <- notification.Channel + ":" + notification.Payload
+		return nil
+	})
+	listener.Handle("a", handler)
+	listener.Handle("b", handler)
+	listener.Handle("c", handler)
+
+	// These queue up behind the blocked handler.
+	receiver := &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "block"},
+			{Channel: "a", Payload: "5"},
+			{Channel: "b", Payload: "3"},
+			{Channel: "a", Payload: "1"},
+			{Channel: "c", Payload: "2"},
+			{Channel: "b", Payload: "4"},
+		},
+		exhausted: make(chan struct{}),
+	}
+	exhaustedChan := receiver.exhausted
+
+	listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+	defer listenerCtxCancel()
+	listenerDoneChan := make(chan struct{})
+
+	go func() {
+		listener.ListenReceiver(listenerCtx, receiver)
+		close(listenerDoneChan)
+	}()
+
+	select {
+	case <-exhaustedChan:
+	case <-ctx.Done():
+		t.Fatalf("%v", ctx.Err())
+	}
+	close(releaseChan)
+
+	var received []string
+	for len(received) < 5 {
+		select {
+		case r := <-receivedChan:
+			received = append(received, r)
+		case <-ctx.Done():
+			t.Fatalf("%v", ctx.Err())
+		}
+	}
+
+	listenerCtxCancel()
+	<-listenerDoneChan
+
+	// a:1 stays behind a:5 since notifications of a channel are handled in order.
+	require.Equal(t, []string{"c:2", "b:3", "b:4", "a:5", "a:1"}, received)
+}
+
+func TestListenerFlush(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var received []string
+	listener := &pgxlisten.Listener{MaxConcurrency: 1}
+	listener.Handle("block", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		close(blocked)
+		<-release
+		return nil
+	}))
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, notification.Payload)
+		return nil
+	}))
+
+	require.NoError(t, listener.Flush(ctx, "foo"))
+
+	exhausted := make(chan struct{})
+	receiver := &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "block", Payload: "1"},
+			{Channel: "foo", Payload: "1"},
+			{Channel: "foo", Payload: "2"},
+			{Channel: "foo", Payload: "3"},
+		},
+		exhausted: exhausted,
+	}
+	listenerCtx, listenerCancel := context.WithCancel(ctx)
+	defer listenerCancel()
+	listenerDone := make(chan error)
+	go func() {
+		listenerDone <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	// The block handler holds the only slot, so the foo notifications stay queued.
+	<-blocked
+	<-exhausted
+
+	require.NoError(t, listener.Flush(ctx, "foo"))
+	mu.Lock()
+	require.Equal(t, []string{"1", "2", "3"}, received)
+	mu.Unlock()
+	require.NoError(t, listener.Flush(ctx, "bar"))
+
+	flushCtx, flushCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer flushCancel()
+	require.ErrorIs(t, listener.Flush(flushCtx, "block"), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, listener.Flush(ctx, "block"))
+
+	listenerCancel()
+	require.ErrorIs(t, <-listenerDone, context.Canceled)
+	mu.Lock()
+	require.Equal(t, []string{"1", "2", "3"}, received)
+	mu.Unlock()
+}
+
+// chanReceiver yields the notifications sent on its channel until ctx is cancelled.
+type chanReceiver chan *pgconn.Notification
+
+func (r chanReceiver) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case notification := <-r:
+		return notification, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestListenerUnlistenWithQueuedNotifications(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	metrics := &recordingMetrics{}
+	var errs []error
+	listener := &pgxlisten.Listener{
+		MaxConcurrency: 1,
+		Metrics:        metrics,
+		LogError: func(ctx context.Context, err error) {
+			errs = append(errs, err)
+		},
+		DefaultHandler: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return errors.New("unexpected default handler call")
+		}),
+	}
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	listener.Handle("block", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		close(blocked)
+		<-release
+		return nil
+	}))
+	listener.Handle("bar", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+	var mu sync.Mutex
+	var received []string
+	sub, err := listener.AddHandler(ctx, "foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, notification.Payload)
+		return nil
+	}))
+	require.NoError(t, err)
+
+	receiver := make(chanReceiver)
+	listenerCtx, listenerCancel := context.WithCancel(ctx)
+	defer listenerCancel()
+	listenerDone := make(chan error)
+	go func() {
+		listenerDone <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	// The block handler holds the only slot, so the foo notifications stay queued. Once the receiver takes the
+	// following bar notification the ones before it have been queued.
+	receiver <- &pgconn.Notification{Channel: "block"}
+	<-blocked
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "1"}
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "2"}
+	receiver <- &pgconn.Notification{Channel: "bar"}
+
+	require.NoError(t, sub.Unlisten(ctx))
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "3"}
+	receiver <- &pgconn.Notification{Channel: "bar"}
+
+	close(release)
+	require.NoError(t, listener.Flush(ctx, "foo"))
+	require.NoError(t, listener.Flush(ctx, "bar"))
+
+	// Notifications passed to Dispatch were not received before the unlisten either.
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "4"}, nil))
+
+	mu.Lock()
+	require.Equal(t, []string{"1", "2"}, received)
+	mu.Unlock()
+	metrics.mu.Lock()
+	require.Equal(t, 2, metrics.drops[pgxlisten.DropUnlistened])
+	metrics.mu.Unlock()
+
+	listenerCancel()
+	require.ErrorIs(t, <-listenerDone, context.Canceled)
+	require.Empty(t, errs)
+}
+
+func TestListenerDedupKeyWithPID(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	for _, tt := range []struct {
+		name     string
+		dedupKey func(*pgconn.Notification) string
+		expected []uint32
+	}{
+		{name: "default", expected: []uint32{1}},
+		{name: "with PID", dedupKey: pgxlisten.DedupKeyWithPID, expected: []uint32{1, 2}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var received []uint32
+			listener := &pgxlisten.Listener{
+				DedupWindow: time.Minute,
+				DedupKey:    tt.dedupKey,
+			}
+			listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				received = append(received, notification.PID)
+				return nil
+			}))
+
+			// Two writers notify the same event, and the first one notifies it again.
+			err := listener.ListenReceiver(ctx, &scriptedReceiver{
+				notifications: []*pgconn.Notification{
+					{PID: 1, Channel: "foo", Payload: "event 1"},
+					{PID: 2, Channel: "foo", Payload: "event 1"},
+					{PID: 1, Channel: "foo", Payload: "event 1"},
+				},
+				err: io.EOF,
+			})
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, received)
+		})
+	}
+}
+
+func TestListenerSuppress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	metrics := &recordingMetrics{}
+	listener := &pgxlisten.Listener{
+		Metrics:           metrics,
+		SuppressQueueSize: 2,
+	}
+	var mu sync.Mutex
+	var received []string
+	for _, channel := range []string{"foo", "bar"} {
+		listener.Handle(channel, pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, notification.Channel+" "+notification.Payload)
+			return nil
+		}))
+	}
+	listener.Handle("sync", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+	requireReceived := func(expected ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, expected, received)
+		received = nil
+	}
+
+	receiver := make(chanReceiver)
+	listenerCtx, listenerCancel := context.WithCancel(ctx)
+	defer listenerCancel()
+	listenerDone := make(chan error)
+	go func() {
+		listenerDone <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	listener.Suppress("foo")
+	require.True(t, listener.Suppressed("foo"))
+	require.False(t, listener.Suppressed("bar"))
+
+	// Notifications are handled synchronously, so once the receiver takes the one on sync the previous ones have been
+	// handled.
+	for _, payload := range []string{"1", "2", "3"} {
+		receiver <- &pgconn.Notification{Channel: "foo", Payload: payload}
+	}
+	receiver <- &pgconn.Notification{Channel: "bar", Payload: "1"}
+	receiver <- &pgconn.Notification{Channel: "sync"}
+	requireReceived("bar 1")
+	metrics.mu.Lock()
+	require.Equal(t, 1, metrics.drops[pgxlisten.DropSuppressed])
+	metrics.mu.Unlock()
+
+	// The held notifications are handed back to the receive loop, which handles them before the next one it receives.
+	listener.Unsuppress("foo")
+	require.False(t, listener.Suppressed("foo"))
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "4"}
+	receiver <- &pgconn.Notification{Channel: "sync"}
+	requireReceived("foo 1", "foo 2", "foo 4")
+
+	listenerCancel()
+	require.ErrorIs(t, <-listenerDone, context.Canceled)
+
+	// Without Listen the held notifications are handled by Unsuppress.
+	listener.Suppress("foo")
+	require.NoError(t, listener.Dispatch(ctx, &pgconn.Notification{Channel: "foo", Payload: "5"}, nil))
+	requireReceived()
+	listener.Unsuppress("foo")
+	requireReceived("foo 5")
+}
+
+func TestListenerSuppressMaxConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	listener := &pgxlisten.Listener{
+		MaxConcurrency:    1,
+		SuppressQueueSize: 2,
+	}
+	received := make(chan string, 4)
+	release := make(chan struct{})
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		received <- notification.Payload
+		return nil
+	}))
+	listener.Handle("block", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		<-release
+		return nil
+	}))
+	listener.HandleInline("sync", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	receiver := make(chanReceiver)
+	listenerCtx, listenerCancel := context.WithCancel(ctx)
+	defer listenerCancel()
+	listenerDone := make(chan error)
+	go func() {
+		listenerDone <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	listener.Suppress("foo")
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "1"}
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "2"}
+	// Once the receive loop takes the next notification both are queued, and once they are flushed both are held.
+	receiver <- &pgconn.Notification{Channel: "sync"}
+	require.NoError(t, listener.Flush(ctx, "foo"))
+
+	// While the only handler slot is taken, a new notification is queued behind the held ones once they are released.
+	receiver <- &pgconn.Notification{Channel: "block"}
+	listener.Unsuppress("foo")
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "3"}
+	close(release)
+	for _, expected := range []string{"1", "2", "3"} {
+		select {
+		case payload := <-received:
+			require.Equal(t, expected, payload)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for %q: %v", expected, ctx.Err())
+		}
+	}
+
+	listenerCancel()
+	require.ErrorIs(t, <-listenerDone, context.Canceled)
+}
+
+func TestListenerHandleInline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	listener := &pgxlisten.Listener{
+		MaxConcurrency: 2,
+	}
+	dispatchedBlocked := make(chan struct{})
+	dispatchedRelease := make(chan struct{})
+	listener.Handle("dispatched", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		close(dispatchedBlocked)
+		<-dispatchedRelease
+		return nil
+	}))
+	inlineBlocked := make(chan struct{})
+	inlineRelease := make(chan struct{})
+	listener.HandleInline("inline", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		close(inlineBlocked)
+		<-inlineRelease
+		return nil
+	}))
+	listener.Handle("sync", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	receiver := make(chanReceiver)
+	listenerCtx, listenerCancel := context.WithCancel(ctx)
+	defer listenerCancel()
+	listenerDone := make(chan error)
+	go func() {
+		listenerDone <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	// A dispatched handler that blocks does not keep the receive goroutine from taking the next notification.
+	receiver <- &pgconn.Notification{Channel: "dispatched"}
+	<-dispatchedBlocked
+	receiver <- &pgconn.Notification{Channel: "inline"}
+	<-inlineBlocked
+
+	// An inline handler that blocks does.
+	select {
+	case receiver <- &pgconn.Notification{Channel: "sync"}:
+		t.Fatal("notification received while inline handler was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(inlineRelease)
+	receiver <- &pgconn.Notification{Channel: "sync"}
+	close(dispatchedRelease)
+
+	listenerCancel()
+	require.ErrorIs(t, <-listenerDone, context.Canceled)
+}
+
+func TestListenerCounters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	var received, errs atomic.Int64
+	listener := &pgxlisten.Listener{
+		ReceivedCounter: &received,
+		ErrorCounter:    &errs,
+	}
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		if notification.Payload == "fail" {
+			return errors.New("failed")
+		}
+		return nil
+	}))
+	listener.HandleWithError("bar", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return errors.New("failed")
+	}), func(ctx context.Context, notification *pgconn.Notification, err error) {})
+
+	receiver := &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "foo", Payload: "1"},
+			{Channel: "foo", Payload: "fail"},
+			{Channel: "bar", Payload: "1"},
+			{Channel: "baz", Payload: "unrouted"},
+			{Channel: "foo", Payload: "2"},
+		},
+		err: io.EOF,
+	}
+
+	err := listener.ListenReceiver(ctx, receiver)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), received.Load())
+	require.Equal(t, int64(3), errs.Load())
+	require.Equal(t, uint64(5), listener.Stats().Received)
+}
+
+func TestListenerReplaceHandler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	listener := &pgxlisten.Listener{
+		MaxConcurrency: 2,
+	}
+	var mu sync.Mutex
+	var received []string
+	record := func(handler string) pgxlisten.Handler {
+		return pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, handler+" "+notification.Payload)
+			return nil
+		})
+	}
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	old := record("old")
+	listener.HandleQueue("foo", 10, pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		if notification.Payload == "1" {
+			close(blocked)
+			<-release
+		}
+		return old.HandleNotification(ctx, notification, conn)
+	}))
+
+	listener.Handle("sync", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	require.ErrorIs(t, listener.ReplaceHandler("bar", record("new")), pgxlisten.ErrNotRegistered)
+
+	receiver := make(chanReceiver)
+	listenerCtx, listenerCancel := context.WithCancel(ctx)
+	defer listenerCancel()
+	listenerDone := make(chan error)
+	go func() {
+		listenerDone <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	// The old handler is still running when it is replaced.
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "1"}
+	<-blocked
+	require.NoError(t, listener.ReplaceHandler("foo", record("new")))
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "2"}
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "3"}
+	close(release)
+
+	// Once the receiver takes the notification on sync the ones before it have been queued.
+	receiver <- &pgconn.Notification{Channel: "sync"}
+	require.NoError(t, listener.Flush(ctx, "foo"))
+	mu.Lock()
+	require.ElementsMatch(t, []string{"old 1", "new 2", "new 3"}, received)
+	mu.Unlock()
+
+	registrations := listener.Registrations()
+	require.Len(t, registrations, 2)
+	require.Equal(t, "foo", registrations[0].Channel)
+	require.Equal(t, 10, registrations[0].QueueSize)
+
+	listenerCancel()
+	require.ErrorIs(t, <-listenerDone, context.Canceled)
+}
+
+func TestListenerHandleWithMeta(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	type destination struct {
+		queue string
+	}
+	listener := &pgxlisten.Listener{}
+	var received []string
+	handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		queue := "none"
+		if dest, ok := pgxlisten.MetaFromContext(ctx).(destination); ok {
+			queue = dest.queue
+		}
+		received = append(received, notification.Channel+" "+queue)
+		return nil
+	})
+	listener.HandleWithMeta("foo", destination{queue: "foo-queue"}, handler)
+	listener.HandleWithMeta("bar", destination{queue: "bar-queue"}, handler)
+	listener.Handle("baz", handler)
+
+	err := listener.ListenReceiver(ctx, &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "foo"},
+			{Channel: "bar"},
+			{Channel: "baz"},
+			{Channel: "foo"},
+		},
+		err: io.EOF,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"foo foo-queue", "bar bar-queue", "baz none", "foo foo-queue"}, received)
+	require.Nil(t, pgxlisten.MetaFromContext(ctx))
+}
+
+func TestListenerShutdownTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	var mu sync.Mutex
+	var errs []error
+	metrics := &recordingMetrics{}
+	listener := &pgxlisten.Listener{
+		MaxConcurrency:  1,
+		DrainOnCancel:   200 * time.Millisecond,
+		ShutdownTimeout: 100 * time.Millisecond,
+		Metrics:         metrics,
+		LogError: func(ctx context.Context, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			errs = append(errs, err)
+		},
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		// The handler ignores its context, so only ShutdownTimeout ends the wait for it.
+		close(started)
+		<-release
+		return nil
+	}))
+	listener.Handle("sync", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	}))
+
+	receiver := make(chanReceiver)
+	listenerCtx, listenerCancel := context.WithCancel(ctx)
+	defer listenerCancel()
+	listenerDone := make(chan error)
+	go func() {
+		listenerDone <- listener.ListenReceiver(listenerCtx, receiver)
+	}()
+
+	// The second notification stays queued behind the first until the drain window is over. Once the receiver takes
+	// the sync notification it has been queued.
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "1"}
+	<-started
+	receiver <- &pgconn.Notification{Channel: "foo", Payload: "2"}
+	receiver <- &pgconn.Notification{Channel: "sync"}
+
+	cancelledAt := time.Now()
+	listenerCancel()
+	require.ErrorIs(t, <-listenerDone, context.Canceled)
+	require.GreaterOrEqual(t, time.Since(cancelledAt), 300*time.Millisecond)
+
+	metrics.mu.Lock()
+	require.GreaterOrEqual(t, metrics.drops[pgxlisten.DropShutdown], 1)
+	metrics.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, errs, 1)
+	require.ErrorIs(t, errs[0], pgxlisten.ErrHandlerAbandoned)
+}
@@ -0,0 +1,83 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// HandleRefresh sets fn as the handler for notifications sent to channel, ignoring their payloads. It suits channels
+// whose notifications only mean that something changed and should be queried again. fn is also called after each
+// connect, and every BacklogInterval if that is set, since changes may have been missed while disconnected.
+//
+// If interval is greater than 0 bursts of notifications are coalesced so fn runs at most once per interval: a
+// notification that arrives sooner after the previous refresh schedules a single refresh for when interval has
+// passed, which runs on the listening connection like WithConn. Errors from scheduled refreshes are passed to
+// LogError. If interval is 0, fn is called for every notification.
+//
+// conn is nil when fn is called for a notification while MaxConcurrency or Semaphore is set.
+func (l *Listener) HandleRefresh(channel string, interval time.Duration, fn func(ctx context.Context, conn *pgx.Conn) error) {
+	l.Handle(channel, &refreshHandler{l: l, channel: channel, interval: interval, fn: fn})
+}
+
+type refreshHandler struct {
+	l        *Listener
+	channel  string
+	interval time.Duration
+	fn       func(ctx context.Context, conn *pgx.Conn) error
+
+	mu        sync.Mutex
+	last      time.Time
+	scheduled bool
+}
+
+func (h *refreshHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	if h.interval <= 0 {
+		return h.fn(ctx, conn)
+	}
+
+	h.mu.Lock()
+	if h.scheduled {
+		h.mu.Unlock()
+		return nil
+	}
+	if wait := h.interval - time.Since(h.last); wait > 0 {
+		h.scheduled = true
+		h.mu.Unlock()
+
+		scheduledCtx := detachedContext(ctx)
+		time.AfterFunc(wait, func() { h.refreshLater(scheduledCtx) })
+		return nil
+	}
+	h.last = time.Now()
+	h.mu.Unlock()
+
+	return h.fn(ctx, conn)
+}
+
+func (h *refreshHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	h.mu.Lock()
+	h.last = time.Now()
+	h.mu.Unlock()
+
+	return h.fn(ctx, conn)
+}
+
+// refreshLater runs a refresh that was scheduled to coalesce a burst of notifications.
+func (h *refreshHandler) refreshLater(ctx context.Context) {
+	h.mu.Lock()
+	h.scheduled = false
+	h.last = time.Now()
+	h.mu.Unlock()
+
+	err := h.l.withConn(ctx, h.fn)
+	// If the connection was lost the refresh after reconnecting takes care of it.
+	if err != nil && !errors.Is(err, ErrNotConnected) {
+		h.l.logError(ctx, fmt.Errorf("refresh %s: %w", h.channel, err))
+	}
+}
@@ -0,0 +1,71 @@
+package pgxlisten
+
+import (
+	"slices"
+	"strings"
+)
+
+// Registration describes how the notifications of a channel are handled. See Listener.Registrations.
+type Registration struct {
+	// Channel is the channel the handler was registered for.
+	Channel string
+
+	// Handler is the registered handler. It is a wrapper for handlers registered with HandleTx, HandleLatest, and
+	// similar methods that adapt them.
+	Handler Handler
+
+	// Backlog reports whether the channel's backlog is handled, i.e. Handler implements BacklogHandler and
+	// DisableBacklog is not set.
+	Backlog bool
+
+	// ErrorHandler reports whether errors are passed to an error handler given to HandleWithError instead of LogError.
+	ErrorHandler bool
+
+	// Retryable reports whether errors are classified for HandlerRetries, see HandleRetryable.
+	Retryable bool
+
+	// Inline reports whether the channel was registered with HandleInline.
+	Inline bool
+
+	// Weight is the channel's weight when MaxConcurrency is set, see HandleWeighted.
+	Weight int
+
+	// QueueSize bounds the channel's queue when MaxConcurrency or Semaphore is set, see HandleQueue. It is 0 if the
+	// queue is unbounded.
+	QueueSize int
+
+	// Priority is the channel's priority when draining at shutdown, see HandlePriority.
+	Priority int
+
+	// Meta is the metadata attached with HandleWithMeta, or nil.
+	Meta any
+}
+
+// Registrations returns a snapshot of the Listener's registered handlers sorted by channel, e.g. to generate
+// documentation or show in an admin UI what a service listens to and how. Channels unlistened with
+// Subscription.Unlisten are not included. It is safe to call concurrently with Listen and with registering handlers.
+func (l *Listener) Registrations() []Registration {
+	l.handlersMu.RLock()
+	defer l.handlersMu.RUnlock()
+
+	registrations := make([]Registration, 0, len(l.handlers))
+	for channel, reg := range l.handlers {
+		_, backlog := reg.handler.(BacklogHandler)
+		registrations = append(registrations, Registration{
+			Channel:      channel,
+			Handler:      reg.handler,
+			Backlog:      backlog && !l.DisableBacklog,
+			ErrorHandler: reg.onError != nil,
+			Retryable:    reg.isRetryable != nil,
+			Inline:       reg.inline,
+			Weight:       max(reg.weight, 1),
+			QueueSize:    reg.queueSize,
+			Priority:     reg.priority,
+			Meta:         reg.meta,
+		})
+	}
+	slices.SortFunc(registrations, func(a, b Registration) int {
+		return strings.Compare(a.Channel, b.Channel)
+	})
+	return registrations
+}
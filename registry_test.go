@@ -0,0 +1,54 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerRegistrations(t *testing.T) {
+	listener := &pgxlisten.Listener{}
+	require.Empty(t, listener.Registrations())
+
+	handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return nil
+	})
+	backlogHandler := &emptyBacklogHandler{}
+	listener.Handle("plain", handler)
+	listener.Handle("backlog", backlogHandler)
+	listener.HandleWithError("errors", handler, func(ctx context.Context, notification *pgconn.Notification, err error) {})
+	listener.HandleRetryable("retryable", handler, func(err error) bool { return true })
+	listener.HandleInline("inline", handler)
+	listener.HandleWeighted("weighted", 3, handler)
+	listener.HandleQueue("queue", 10, handler)
+	listener.HandlePriority("priority", 5, handler)
+
+	registrations := listener.Registrations()
+	for i := range registrations {
+		require.NotNil(t, registrations[i].Handler)
+		registrations[i].Handler = nil
+	}
+	require.Equal(t, []pgxlisten.Registration{
+		{Channel: "backlog", Backlog: true, Weight: 1},
+		{Channel: "errors", ErrorHandler: true, Weight: 1},
+		{Channel: "inline", Inline: true, Weight: 1},
+		{Channel: "plain", Weight: 1},
+		{Channel: "priority", Weight: 1, Priority: 5},
+		{Channel: "queue", Weight: 1, QueueSize: 10},
+		{Channel: "retryable", Retryable: true, Weight: 1},
+		{Channel: "weighted", Weight: 3},
+	}, registrations)
+
+	// The snapshot is not affected by later registrations.
+	listener.HandleInline("plain", handler)
+	require.False(t, registrations[3].Inline)
+	require.True(t, listener.Registrations()[3].Inline)
+
+	listener.DisableBacklog = true
+	require.False(t, listener.Registrations()[0].Backlog)
+}
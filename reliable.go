@@ -0,0 +1,219 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// WatermarkStore persists the watermark of each channel handled by a ReliableMode handler. The watermark is the id of
+// the last item that was successfully processed.
+type WatermarkStore interface {
+	// LoadWatermark returns the watermark saved for channel, or 0 if none has been saved.
+	LoadWatermark(ctx context.Context, channel string) (int64, error)
+
+	// SaveWatermark saves id as the watermark for channel.
+	SaveWatermark(ctx context.Context, channel string, id int64) error
+}
+
+// MemoryWatermarkStore is a WatermarkStore that keeps watermarks in memory. They are lost when the process exits, so
+// it is mostly useful for tests or for items that are also tracked elsewhere. The zero value is ready to use.
+type MemoryWatermarkStore struct {
+	mu         sync.Mutex
+	watermarks map[string]int64
+}
+
+// LoadWatermark implements WatermarkStore.
+func (s *MemoryWatermarkStore) LoadWatermark(ctx context.Context, channel string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.watermarks[channel], nil
+}
+
+// SaveWatermark implements WatermarkStore.
+func (s *MemoryWatermarkStore) SaveWatermark(ctx context.Context, channel string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.watermarks == nil {
+		s.watermarks = make(map[string]int64)
+	}
+	s.watermarks[channel] = id
+	return nil
+}
+
+// ReliableMode is a Handler and BacklogHandler that ties LISTEN, backlog handling, and a persisted watermark together
+// so that no item is missed, even across reconnects and restarts. Items are identified by int64 ids. Whenever a
+// notification arrives and whenever the backlog is handled (after every connect and every Listener.BacklogInterval),
+// ReliableMode fetches the ids after the channel's watermark, processes them in ascending order, and advances the
+// watermark after each one.
+//
+// Every id greater than the watermark is eventually processed at least once: an item may be processed again if the
+// process stops or SaveWatermark fails after it was processed. This relies on ids becoming visible to Fetch in
+// increasing order. An id that is committed after a greater id has already been processed is skipped, so ids should
+// be assigned by a single writer or under a lock rather than by a sequence shared by concurrent transactions.
+//
+// conn is the connection passed to the handler by the Listener. It is nil when Listener.MaxConcurrency or
+// Listener.Semaphore is set, in which case Fetch and Process must get their own connection.
+type ReliableMode struct {
+	// Store persists the watermarks. Store is required.
+	Store WatermarkStore
+
+	// Fetch returns the ids after the watermark after on channel that are ready to be processed in ascending order. It
+	// may return a limited batch; it is called again until it returns none. Fetch is required.
+	Fetch func(ctx context.Context, conn *pgx.Conn, channel string, after int64) ([]int64, error)
+
+	// Process processes the item with id on channel. If it returns an error the watermark is not advanced and the item
+	// is tried again by the next notification or backlog run. Process is required.
+	Process func(ctx context.Context, conn *pgx.Conn, channel string, id int64) error
+
+	// ParseID returns the id carried in the payload of notification. It lets ReliableMode skip notifications for items
+	// that have already been processed. If nil, every notification causes a Fetch. ParseID is optional.
+	ParseID func(notification *pgconn.Notification) (int64, error)
+
+	channels reliableChannels
+}
+
+// reliableChannels holds the state of each channel handled by a ReliableMode or CatchUpMode.
+type reliableChannels struct {
+	mu       sync.Mutex
+	channels map[string]*reliableChannel
+}
+
+// get returns the state of channel, creating it the first time.
+func (c *reliableChannels) get(channel string) *reliableChannel {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channels == nil {
+		c.channels = make(map[string]*reliableChannel)
+	}
+	rc, ok := c.channels[channel]
+	if !ok {
+		rc = &reliableChannel{}
+		c.channels[channel] = rc
+	}
+	return rc
+}
+
+type reliableChannel struct {
+	mu        sync.Mutex
+	loaded    bool
+	watermark int64
+}
+
+// load returns the watermark of rc, loading it from store the first time. The watermark starts at 0 if store is nil.
+// rc.mu must be held.
+func (rc *reliableChannel) load(ctx context.Context, store WatermarkStore, channel string) (int64, error) {
+	if !rc.loaded {
+		if store != nil {
+			watermark, err := store.LoadWatermark(ctx, channel)
+			if err != nil {
+				return 0, fmt.Errorf("load watermark: %w", err)
+			}
+			rc.watermark = watermark
+		}
+		rc.loaded = true
+	}
+	return rc.watermark, nil
+}
+
+// advance records id as the watermark of rc, saving it to store unless store is nil. rc.mu must be held.
+func (rc *reliableChannel) advance(ctx context.Context, store WatermarkStore, channel string, id int64) error {
+	if store != nil {
+		if err := store.SaveWatermark(ctx, channel, id); err != nil {
+			return fmt.Errorf("save watermark %d: %w", id, err)
+		}
+	}
+	rc.watermark = id
+	return nil
+}
+
+// Watermark returns the id of the last item processed on channel.
+func (r *ReliableMode) Watermark(ctx context.Context, channel string) (int64, error) {
+	rc := r.channels.get(channel)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.load(ctx, r.Store, channel)
+}
+
+// HandleNotification implements Handler.
+func (r *ReliableMode) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	rc := r.channels.get(notification.Channel)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if r.ParseID != nil {
+		id, err := r.ParseID(notification)
+		if err != nil {
+			return fmt.Errorf("parse id: %w", err)
+		}
+		watermark, err := rc.load(ctx, r.Store, notification.Channel)
+		if err != nil {
+			return err
+		}
+		if id <= watermark {
+			return nil
+		}
+	}
+
+	_, err := r.catchUp(ctx, conn, notification.Channel, rc, 0)
+	return err
+}
+
+// HandleBacklog implements BacklogHandler. It processes up to BacklogLimitFromContext items if set, and returns
+// ErrBacklogEmpty if there was nothing to process.
+func (r *ReliableMode) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	rc := r.channels.get(channel)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	processed, err := r.catchUp(ctx, conn, channel, rc, BacklogLimitFromContext(ctx))
+	if err != nil {
+		return err
+	}
+	if processed == 0 {
+		return ErrBacklogEmpty
+	}
+	return nil
+}
+
+// catchUp processes the ids after the watermark of channel, at most limit unless it is 0, and returns how many it
+// processed. rc.mu must be held.
+func (r *ReliableMode) catchUp(ctx context.Context, conn *pgx.Conn, channel string, rc *reliableChannel, limit int) (int, error) {
+	watermark, err := rc.load(ctx, r.Store, channel)
+	if err != nil {
+		return 0, err
+	}
+
+	processed := 0
+	for limit == 0 || processed < limit {
+		ids, err := r.Fetch(ctx, conn, channel, watermark)
+		if err != nil {
+			return processed, fmt.Errorf("fetch after %d: %w", watermark, err)
+		}
+		if len(ids) == 0 {
+			return processed, nil
+		}
+
+		for _, id := range ids {
+			if id <= watermark {
+				return processed, fmt.Errorf("fetch after %d returned id %d out of order", watermark, id)
+			}
+			if err := r.Process(ctx, conn, channel, id); err != nil {
+				return processed, fmt.Errorf("process %d: %w", id, err)
+			}
+			if err := rc.advance(ctx, r.Store, channel, id); err != nil {
+				return processed, err
+			}
+			watermark = id
+			processed++
+			if processed == limit {
+				break
+			}
+		}
+	}
+	return processed, nil
+}
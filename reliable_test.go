@@ -0,0 +1,130 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerReliableMode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_reliable_test;
+create table pgxlisten_reliable_test (id bigint primary key generated by default as identity, msg text not null);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_reliable_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		insert := func(msg string, notify bool) int64 {
+			var id int64
+			err := conn.QueryRow(ctx, `insert into pgxlisten_reliable_test (msg) values ($1) returning id`, msg).Scan(&id)
+			require.NoError(t, err)
+			if notify {
+				_, err = conn.Exec(ctx, `select pg_notify('foo', $1)`, strconv.FormatInt(id, 10))
+				require.NoError(t, err)
+			}
+			return id
+		}
+
+		// The first item was processed before a restart.
+		store := &pgxlisten.MemoryWatermarkStore{}
+		require.NoError(t, store.SaveWatermark(ctx, "foo", insert("a", false)))
+		insert("b", false)
+		insert("c", false)
+
+		processedChan := make(chan string, 8)
+		reliable := &pgxlisten.ReliableMode{
+			Store: store,
+			Fetch: func(ctx context.Context, conn *pgx.Conn, channel string, after int64) ([]int64, error) {
+				rows, _ := conn.Query(ctx, `select id from pgxlisten_reliable_test where id > $1 order by id limit 2`, after)
+				return pgx.CollectRows(rows, pgx.RowTo[int64])
+			},
+			Process: func(ctx context.Context, conn *pgx.Conn, channel string, id int64) error {
+				var msg string
+				err := conn.QueryRow(ctx, `select msg from pgxlisten_reliable_test where id = $1`, id).Scan(&msg)
+				if err != nil {
+					return err
+				}
+				processedChan <- msg
+				return nil
+			},
+			ParseID: func(notification *pgconn.Notification) (int64, error) {
+				return strconv.ParseInt(notification.Payload, 10, 64)
+			},
+		}
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+		listener.Handle("foo", reliable)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		receive := func(expected string) {
+			select {
+			case actual := <-processedChan:
+				require.Equal(t, expected, actual)
+			case <-ctx.Done():
+				t.Fatalf("%s. %v", expected, ctx.Err())
+			}
+		}
+
+		// The backlog resumes after the watermark.
+		receive("b")
+		receive("c")
+
+		// An item inserted without a notification is picked up by the next notification.
+		insert("d", false)
+		insert("e", true)
+		receive("d")
+		receive("e")
+
+		// A notification for an item that was already processed is skipped.
+		_, err := conn.Exec(ctx, `select pg_notify('foo', '1')`)
+		require.NoError(t, err)
+		last := insert("f", true)
+		receive("f")
+
+		watermark, err := reliable.Watermark(ctx, "foo")
+		require.NoError(t, err)
+		require.Equal(t, last, watermark)
+		saved, err := store.LoadWatermark(ctx, "foo")
+		require.NoError(t, err)
+		require.Equal(t, last, saved)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, processedChan)
+	})
+}
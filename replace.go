@@ -0,0 +1,58 @@
+package pgxlisten
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotRegistered is returned by ReplaceHandler when no handler is registered for a channel.
+var ErrNotRegistered = errors.New("no handler registered")
+
+// ReplaceHandler replaces the handler registered for channel with handler, e.g. to swap in new handler code without
+// restarting the Listener, and may be called while Listen is running. The swap is atomic: handlers that are already
+// running when ReplaceHandler is called finish with the old handler, and every notification that starts being handled
+// afterwards, including those still queued for MaxConcurrency or Semaphore, is handled by the new one, so no
+// notification is dropped or handled by both. ReplaceHandler does not wait for the old handler to return. The backlog
+// of channel is handled by handler from its next run if handler is a BacklogHandler, and no longer handled otherwise.
+//
+// The options channel was registered with, such as its weight, queue size, priority, and error handler, are kept.
+// Since handler is a plain Handler, a channel registered with HandleTx loses its transactional idempotency marking. A
+// Subscription for channel becomes inactive as if another handler had been set. ReplaceHandler returns an error
+// wrapping ErrNotRegistered if no handler is registered for channel.
+func (l *Listener) ReplaceHandler(channel string, handler Handler) error {
+	channel = l.channelName(channel)
+
+	l.handlersMu.Lock()
+	defer l.handlersMu.Unlock()
+
+	old, ok := l.handlers[channel]
+	if !ok {
+		return fmt.Errorf("ReplaceHandler: %w: %s", ErrNotRegistered, channel)
+	}
+	reg := *old
+	reg.handler = handler
+	reg.marksSeen = false
+	l.handlers[channel] = &reg
+	return nil
+}
+
+// currentBacklog updates b to the handler registered for channel if it has been replaced since b was scheduled. It
+// reports false if that handler does not handle backlogs.
+func (l *Listener) currentBacklog(channel string, b *backlogSchedule) bool {
+	if l.Router != nil {
+		return true
+	}
+
+	l.handlersMu.RLock()
+	reg, ok := l.handlers[channel]
+	l.handlersMu.RUnlock()
+	if !ok || reg == b.reg {
+		return true
+	}
+	handler, ok := reg.handler.(BacklogHandler)
+	if !ok {
+		return false
+	}
+	b.reg, b.handler = reg, handler
+	return true
+}
@@ -0,0 +1,110 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// replayBuffer keeps the last Listener.ReplayBuffer notifications of each channel.
+type replayBuffer struct {
+	mu       sync.Mutex
+	channels map[string][]*pgconn.Notification
+}
+
+// add records notification, discarding the oldest one of its channel if there are already size.
+func (b *replayBuffer) add(notification *pgconn.Notification, size int) {
+	if b.channels == nil {
+		b.channels = make(map[string][]*pgconn.Notification)
+	}
+
+	items := b.channels[notification.Channel]
+	if len(items) < size {
+		items = append(items, notification)
+	} else {
+		copy(items, items[len(items)-size+1:])
+		items = items[:size]
+		items[size-1] = notification
+	}
+	b.channels[notification.Channel] = items
+}
+
+// routeAndRecord routes notification like route and, if ReplayBuffer is set, records it. Both happen under the
+// buffer's lock so a handler added by AddHandlerReplay either has notification replayed or routed to it, never both.
+func (l *Listener) routeAndRecord(notification *pgconn.Notification) *registration {
+	if l.ReplayBuffer <= 0 {
+		return l.route(notification)
+	}
+
+	l.replay.mu.Lock()
+	defer l.replay.mu.Unlock()
+	l.replay.add(notification, l.ReplayBuffer)
+	return l.route(notification)
+}
+
+// AddHandlerReplay adds handler for channel like AddHandler and first calls it with the notifications of channel kept
+// by ReplayBuffer, oldest first, so a component that attaches late still sees recent notifications. Notifications can
+// only have been kept if channel was already listened to, e.g. through ChannelsFunc and DefaultHandler or a handler
+// that handler replaces. While Listen is connected the replay runs on the receive loop before any newer notification
+// is handled. While Listen is running but between connections, AddHandlerReplay does not add handler and returns an
+// error wrapping ErrNotConnected, since the replay could overlap the notifications of the next connection; it can be
+// retried once Listen has reconnected. If Listen is not running, the replay runs before AddHandlerReplay returns, with
+// a nil conn. Errors from handler are reported like those of live notifications.
+func (l *Listener) AddHandlerReplay(ctx context.Context, channel string, handler Handler) (*Subscription, error) {
+	channel = l.channelName(channel)
+
+	if l.Router != nil {
+		return nil, errors.New("AddHandlerReplay: Router is set")
+	}
+	if err := l.validateChannel(channel); err != nil {
+		return nil, fmt.Errorf("AddHandlerReplay: %w", err)
+	}
+
+	sub := &Subscription{l: l, channel: channel, reg: &registration{handler: handler}}
+	sub.active.Store(true)
+
+	var once sync.Once
+	var replayed []*pgconn.Notification
+	attach := func() {
+		once.Do(func() {
+			l.replay.mu.Lock()
+			defer l.replay.mu.Unlock()
+			l.register(channel, sub.reg)
+			replayed = append(replayed, l.replay.channels[channel]...)
+		})
+	}
+
+	err := l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		attach()
+		l.replayTo(ctx, sub.reg, replayed, conn)
+		return l.listenChannel(ctx, l.currentSession(), channel)
+	})
+	if errors.Is(err, ErrNotConnected) {
+		if l.running.Load() {
+			return nil, fmt.Errorf("AddHandlerReplay: %w", err)
+		}
+		attach()
+		l.replayTo(ctx, sub.reg, replayed, nil)
+		return sub, nil
+	}
+	if err != nil {
+		// Make sure the handler is registered even if the request did not get to run.
+		attach()
+		return sub, fmt.Errorf("AddHandlerReplay: %w", err)
+	}
+
+	return sub, nil
+}
+
+// replayTo calls the handler of reg with each of notifications.
+func (l *Listener) replayTo(ctx context.Context, reg *registration, notifications []*pgconn.Notification, conn *pgx.Conn) {
+	for _, notification := range notifications {
+		if _, err := l.callHandler(ctx, reg, notification, conn); err != nil {
+			l.handlerError(ctx, reg, notification, fmt.Errorf("replay %s notification: %w", notification.Channel, err))
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// HandleRetryable sets the handler for notifications sent to channel like Handle, and classifies its errors for
+// HandlerRetries. A failed notification is only handled again if isRetryable reports true for the error, so permanent
+// errors such as an invalid payload are reported right away instead of using up the retries. If isRetryable is nil,
+// all errors are retryable like for handlers registered with Handle.
+func (l *Listener) HandleRetryable(channel string, handler Handler, isRetryable func(error) bool) {
+	l.register(channel, &registration{handler: handler, isRetryable: isRetryable})
+}
+
+// retryable reports whether err returned by the handler of reg may be retried.
+func (reg *registration) retryable(err error) bool {
+	if errors.Is(err, ErrHandlerAbandoned) {
+		return false
+	}
+	return reg.isRetryable == nil || reg.isRetryable(err)
+}
+
+// callHandlerRetrying calls the handler of reg like callHandler, and calls it again up to HandlerRetries times while it
+// returns a retryable error and ctx is not done.
+func (l *Listener) callHandlerRetrying(ctx context.Context, reg *registration, notification *pgconn.Notification, conn *pgx.Conn) (HandlerResult, error) {
+	for attempt := 0; ; attempt++ {
+		result, err := l.callHandler(ctx, reg, notification, conn)
+		if err == nil || attempt >= l.HandlerRetries || ctx.Err() != nil || !reg.retryable(err) {
+			return result, err
+		}
+
+		l.logDebug(ctx, fmt.Sprintf("retrying %s notification after error: %v", notification.Channel, err))
+		if l.HandlerRetryDelay > 0 {
+			timer := time.NewTimer(l.HandlerRetryDelay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return result, err
+			}
+		}
+	}
+}
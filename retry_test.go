@@ -0,0 +1,76 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerHandleRetryable(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	errNetwork := errors.New("network")
+	errInvalid := errors.New("invalid payload")
+
+	var errs []error
+	listener := &pgxlisten.Listener{
+		LogError: func(ctx context.Context, err error) {
+			errs = append(errs, err)
+		},
+		HandlerRetries:    3,
+		HandlerRetryDelay: time.Millisecond,
+	}
+
+	calls := make(map[string]int)
+	handler := pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		calls[notification.Payload]++
+		switch notification.Payload {
+		case "network":
+			return errNetwork
+		case "invalid":
+			return errInvalid
+		case "flaky":
+			if calls["flaky"] < 2 {
+				return errNetwork
+			}
+		}
+		return nil
+	})
+	listener.HandleRetryable("foo", handler, func(err error) bool {
+		return errors.Is(err, errNetwork)
+	})
+	listener.Handle("bar", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		calls["bar"]++
+		return errInvalid
+	}))
+
+	receiver := &scriptedReceiver{
+		notifications: []*pgconn.Notification{
+			{Channel: "foo", Payload: "network"},
+			{Channel: "foo", Payload: "invalid"},
+			{Channel: "foo", Payload: "flaky"},
+			{Channel: "bar", Payload: "bar"},
+		},
+		err: io.EOF,
+	}
+
+	err := listener.ListenReceiver(ctx, receiver)
+	require.NoError(t, err)
+
+	// Retryable errors use up the retries, permanent ones fail on the first call, and handlers registered with Handle
+	// retry every error.
+	require.Equal(t, map[string]int{"network": 4, "invalid": 1, "flaky": 2, "bar": 4}, calls)
+	require.Len(t, errs, 3)
+	require.ErrorIs(t, errs[0], errNetwork)
+	require.ErrorIs(t, errs[1], errInvalid)
+	require.ErrorIs(t, errs[2], errInvalid)
+}
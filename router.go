@@ -0,0 +1,137 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Router decides how notifications are dispatched. It can be used in place of Listener.Handle to implement arbitrary
+// dispatch policies such as routing by payload content or by channel prefix.
+type Router interface {
+	// Channels returns the channels to listen to. It is called each time Listen connects.
+	Channels() []string
+
+	// Route returns the handler for notification or nil if there is none. notification.PID identifies the backend that
+	// sent it, e.g. to route by origin, but PIDs are reused over time. When a connection is established Route is also
+	// called with a notification that has only Channel set for each channel returned by Channels to find the
+	// BacklogHandler for that channel, if any.
+	Route(notification *pgconn.Notification) Handler
+}
+
+// channels returns the channels to listen to on conn.
+func (l *Listener) channels(ctx context.Context, conn *pgx.Conn) ([]string, error) {
+	var channels []string
+	if l.Router != nil {
+		for _, channel := range l.Router.Channels() {
+			channels = append(channels, l.channelName(channel))
+		}
+	} else {
+		l.handlersMu.RLock()
+		channels = make([]string, 0, len(l.handlers))
+		for channel := range l.handlers {
+			channels = append(channels, channel)
+		}
+		l.handlersMu.RUnlock()
+	}
+
+	if l.ChannelsFunc != nil {
+		dynamic, err := l.ChannelsFunc(ctx, conn)
+		if err != nil {
+			return nil, fmt.Errorf("channels func: %w", err)
+		}
+		for _, channel := range dynamic {
+			channel = l.channelName(channel)
+			if !slices.Contains(channels, channel) {
+				channels = append(channels, channel)
+			}
+		}
+	}
+
+	if l.ShardFilter != nil {
+		// channels may belong to Router.
+		channels = slices.DeleteFunc(slices.Clone(channels), func(channel string) bool {
+			return !l.ShardFilter(channel)
+		})
+	}
+
+	return channels, nil
+}
+
+// RefreshChannels computes the channels to listen to again, from the handlers, Router, and ChannelsFunc as Listen does
+// when it connects, and applies the difference to the current connection, e.g. after a tenant was added or removed.
+// Channels that were added are listened to and their backlogs handled like on connect, and channels that are no longer
+// returned are unlistened. It runs on the receive loop like WithConn. RefreshChannels returns ErrNotConnected if
+// Listen does not currently have a connection; the next connection uses the new set anyway.
+func (l *Listener) RefreshChannels(ctx context.Context) error {
+	return l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		s := l.currentSession()
+		channels, err := l.channels(ctx, conn)
+		if err != nil {
+			return err
+		}
+		l.channelsChanged(ctx, channels)
+
+		for _, channel := range s.listeningChannels() {
+			if !slices.Contains(channels, channel) {
+				if err := l.unlistenChannel(ctx, s, channel); err != nil {
+					return err
+				}
+			}
+		}
+		for _, channel := range channels {
+			if !s.listening[channel] {
+				if err := l.listenChannel(ctx, s, channel); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// channelsChanged logs how channels differs from the channels computed for the previous connection, or by the
+// previous RefreshChannels. A new connection starts without any subscriptions, so Listen only listens to channels and
+// has nothing to unlisten; RefreshChannels unlistens the removed channels on the current connection itself.
+func (l *Listener) channelsChanged(ctx context.Context, channels []string) {
+	var added, removed []string
+	for _, channel := range channels {
+		if !slices.Contains(l.prevChannels, channel) {
+			added = append(added, channel)
+		}
+	}
+	for _, channel := range l.prevChannels {
+		if !slices.Contains(channels, channel) {
+			removed = append(removed, channel)
+		}
+	}
+	l.prevChannels = channels
+
+	if len(added) > 0 || len(removed) > 0 {
+		l.logDebug(ctx, fmt.Sprintf("channels changed: added %q removed %q", added, removed))
+	}
+}
+
+// route returns the registration that should handle notification or nil if there is none.
+func (l *Listener) route(notification *pgconn.Notification) *registration {
+	if l.Router != nil {
+		if handler := l.Router.Route(notification); handler != nil {
+			return &registration{handler: handler}
+		}
+	} else {
+		l.handlersMu.RLock()
+		reg, ok := l.handlers[notification.Channel]
+		l.handlersMu.RUnlock()
+		if ok {
+			return reg
+		}
+	}
+
+	if l.DefaultHandler != nil {
+		return &registration{handler: l.DefaultHandler}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const defaultSelfTestTimeout = 5 * time.Second
+
+// ErrSelfTest is reported through LogError when Listener.SelfTestOnConnect is set and a new connection did not
+// receive its own test notification.
+var ErrSelfTest = errors.New("self-test failed")
+
+func (l *Listener) selfTestTimeout() time.Duration {
+	if l.SelfTestTimeout == 0 {
+		return defaultSelfTestTimeout
+	}
+	return l.SelfTestTimeout
+}
+
+// selfTest sends a notification to a channel private to s and waits for it, proving that notifications are delivered
+// on s. It runs before s listens to any other channel, so the test notification is the only one s can receive.
+func (l *Listener) selfTest(ctx context.Context, s *session) error {
+	channel := "pgxlisten_self_test_" + strconv.FormatUint(uint64(s.conn.PgConn().PID()), 10)
+	payload := strconv.Itoa(l.generation)
+	identifier := pgx.Identifier{channel}.Sanitize()
+
+	if _, err := l.exec(ctx, s.conn, "listen "+identifier); err != nil {
+		return fmt.Errorf("%w: listen %q: %w", ErrSelfTest, channel, err)
+	}
+	if _, err := l.exec(ctx, s.conn, "select pg_notify($1, $2)", channel, payload); err != nil {
+		return fmt.Errorf("%w: notify %q: %w", ErrSelfTest, channel, err)
+	}
+
+	timeout := l.selfTestTimeout()
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	notification, err := s.conn.WaitForNotification(waitCtx)
+	if err != nil {
+		if waitCtx.Err() != nil && ctx.Err() == nil {
+			return fmt.Errorf("%w: no notification on %q within %v", ErrSelfTest, channel, timeout)
+		}
+		return fmt.Errorf("%w: wait for notification: %w", ErrSelfTest, err)
+	}
+	if notification.Channel != channel || notification.Payload != payload {
+		return fmt.Errorf("%w: unexpected notification on %q with payload %q", ErrSelfTest, notification.Channel, notification.Payload)
+	}
+
+	if _, err := l.exec(ctx, s.conn, "unlisten "+identifier); err != nil {
+		return fmt.Errorf("%w: unlisten %q: %w", ErrSelfTest, channel, err)
+	}
+	if l.tracing() {
+		l.logDebug(ctx, fmt.Sprintf("trace: self-test notification received on %q", channel))
+	}
+	return nil
+}
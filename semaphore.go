@@ -0,0 +1,34 @@
+package pgxlisten
+
+import "context"
+
+// Semaphore limits how many handlers run at once. See Listener.Semaphore. A *semaphore.Weighted from
+// golang.org/x/sync can be adapted by acquiring and releasing a weight of 1.
+type Semaphore interface {
+	// Acquire blocks until a unit is available or ctx is done, in which case it returns ctx.Err().
+	Acquire(ctx context.Context) error
+
+	// Release returns a unit acquired by Acquire.
+	Release()
+}
+
+// NewSemaphore returns a Semaphore with n units. It can be shared between Listeners to limit their combined
+// concurrency.
+func NewSemaphore(n int) Semaphore {
+	return make(chanSemaphore, n)
+}
+
+type chanSemaphore chan struct{}
+
+func (s chanSemaphore) Acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s chanSemaphore) Release() {
+	<-s
+}
@@ -0,0 +1,35 @@
+package pgxlisten
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+)
+
+// ErrInvalidShard is returned by ModuloShard when the shard index or total is out of range.
+var ErrInvalidShard = errors.New("invalid shard")
+
+// ModuloShard returns a filter for Listener.ShardFilter that selects shard index out of total, where index is from 0
+// to total-1. Channels are assigned by the FNV-1a hash of their name modulo total, so total Listeners configured with
+// the indexes 0 to total-1 listen to every channel exactly once without coordinating. The filter is passed channel
+// names after folding by ChannelCaseMode, so all Listeners of a fleet must use the same ChannelCaseMode. It returns an
+// error wrapping ErrInvalidShard if total is not positive or index is not from 0 to total-1.
+//
+// Changing total reassigns most channels. While a fleet is being resized or restarted, Listeners with the old and the
+// new configuration run side by side, so some channels may be listened to twice or not at all for a while.
+// Notifications are only delivered to sessions listening at the time they are sent, so handlers should be idempotent
+// and use a BacklogHandler to catch up on anything missed.
+func ModuloShard(index, total int) (func(channel string) bool, error) {
+	if total <= 0 {
+		return nil, fmt.Errorf("%w: total %d is not positive", ErrInvalidShard, total)
+	}
+	if index < 0 || index >= total {
+		return nil, fmt.Errorf("%w: index %d is not from 0 to %d", ErrInvalidShard, index, total-1)
+	}
+
+	return func(channel string) bool {
+		h := fnv.New32a()
+		h.Write([]byte(channel))
+		return int(h.Sum32()%uint32(total)) == index
+	}, nil
+}
@@ -0,0 +1,53 @@
+package pgxlisten_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestModuloShard(t *testing.T) {
+	const total = 3
+	shards := make([]func(string) bool, total)
+	for i := range shards {
+		var err error
+		shards[i], err = pgxlisten.ModuloShard(i, total)
+		require.NoError(t, err)
+	}
+
+	counts := make([]int, total)
+	for i := 0; i < 300; i++ {
+		channel := fmt.Sprintf("tenant_%d", i)
+		matches := 0
+		for shard, filter := range shards {
+			if filter(channel) {
+				matches++
+				counts[shard]++
+			}
+		}
+		require.Equal(t, 1, matches, channel)
+	}
+
+	// Every shard gets a share of the channels.
+	for shard, count := range counts {
+		require.Greater(t, count, 50, "shard %d", shard)
+	}
+}
+
+func TestModuloShardInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		index, total int
+	}{
+		{index: 0, total: 0},
+		{index: 0, total: -1},
+		{index: -1, total: 3},
+		{index: 3, total: 3},
+	} {
+		filter, err := pgxlisten.ModuloShard(tt.index, tt.total)
+		require.ErrorIs(t, err, pgxlisten.ErrInvalidShard, "index %d total %d", tt.index, tt.total)
+		require.Nil(t, filter)
+	}
+}
@@ -0,0 +1,131 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ErrListenerShutdown is returned by Listen when it stops because Shutdown was called.
+var ErrListenerShutdown = errors.New("listener shut down")
+
+// listenRun is a call to Listen in progress.
+type listenRun struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// startRun records that Listen is running with cancel stopping it. The returned function must be called when Listen
+// returns.
+func (l *Listener) startRun(cancel context.CancelCauseFunc) func() {
+	run := &listenRun{cancel: cancel, done: make(chan struct{})}
+
+	l.mu.Lock()
+	l.run = run
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		if l.run == run {
+			l.run = nil
+		}
+		l.mu.Unlock()
+		close(run.done)
+	}
+}
+
+// Shutdown stops Listen as if its ctx had been cancelled, so DrainOnCancel applies, and waits for it to return. Listen
+// then returns ErrListenerShutdown. If ctx is done first, Shutdown returns ctx.Err() and Listen continues to shut down
+// in the background. Shutdown does nothing if Listen is not running.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	run := l.run
+	l.mu.Unlock()
+	if run == nil {
+		return nil
+	}
+
+	run.cancel(ErrListenerShutdown)
+
+	select {
+	case <-run.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// abort stops Listen, if it is running, as Shutdown does but without waiting, and makes it return err. Only the first
+// cause a run is stopped with is returned.
+func (l *Listener) abort(err error) {
+	l.mu.Lock()
+	run := l.run
+	l.mu.Unlock()
+	if run != nil {
+		run.cancel(err)
+	}
+}
+
+// Group runs functions in goroutines and collects their errors. It is implemented by *errgroup.Group from
+// golang.org/x/sync/errgroup.
+type Group interface {
+	Go(f func() error)
+}
+
+// ListenGroup runs Listen in g. A clean shutdown, because ctx was cancelled or Shutdown was called, is reported to g
+// as nil, so only failures of the Listener cancel the rest of a group created with errgroup.WithContext. Pass the
+// group's context as ctx so the Listener stops when another task in the group fails. Shutdown can be used to stop the
+// Listener on its own without affecting the group.
+func (l *Listener) ListenGroup(ctx context.Context, g Group) {
+	g.Go(func() error {
+		err := l.Listen(ctx)
+		if errors.Is(err, ErrListenerShutdown) || (ctx.Err() != nil && errors.Is(err, ctx.Err())) {
+			return nil
+		}
+		return err
+	})
+}
+
+// ListenWithSignals runs Listen until one of signals is received, then shuts the Listener down as Shutdown does,
+// including DrainOnCancel, and returns nil. If no signals are given SIGINT and SIGTERM are used. Once the first signal
+// has been received the default behavior of the signals is restored, so a second one terminates the program without
+// waiting for shutdown to finish. If ctx is cancelled or Listen fails, its error is returned as is.
+//
+// ListenWithSignals is meant for the main function of programs. Libraries should call Listen and leave signal handling
+// to the program.
+func (l *Listener) ListenWithSignals(ctx context.Context, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	signalCtx, stop := signal.NotifyContext(ctx, signals...)
+	defer stop()
+
+	// Cancel with the cause Shutdown uses rather than calling it, which would do nothing if the signal arrived before
+	// Listen started.
+	listenCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- l.Listen(listenCtx)
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-signalCtx.Done():
+	}
+	if ctx.Err() != nil {
+		return <-errChan
+	}
+
+	stop()
+	cancel(ErrListenerShutdown)
+	if err := <-errChan; !errors.Is(err, ErrListenerShutdown) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+//go:build unix
+
+package pgxlisten_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerListenWithSignals(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	defaultConnTestRunner.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := defaultConnTestRunner.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError: func(ctx context.Context, err error) {},
+		}
+		listener.Handle("foo", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		// SIGUSR1 rather than the defaults so a failure does not interrupt the test binary.
+		listenerErrChan := make(chan error, 1)
+		go func() {
+			listenerErrChan <- listener.ListenWithSignals(ctx, syscall.SIGUSR1)
+		}()
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		_, ok := listener.BackendPID()
+		require.True(t, ok)
+
+		err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+		require.NoError(t, err)
+
+		select {
+		case err := <-listenerErrChan:
+			require.NoError(t, err)
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for ListenWithSignals() to return: %v", ctx.Err())
+		}
+
+		_, ok = listener.BackendPID()
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,84 @@
+package pgxlisten
+
+import (
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DropReason describes why a notification was dropped.
+type DropReason string
+
+const (
+	// DropPayloadTooLarge means the payload exceeded Listener.MaxPayloadBytes.
+	DropPayloadTooLarge DropReason = "payload_too_large"
+
+	// DropShutdown means the notification was still queued when Listen returned.
+	DropShutdown DropReason = "shutdown"
+
+	// DropDuplicate means the notification was a duplicate within Listener.DedupWindow.
+	DropDuplicate DropReason = "duplicate"
+
+	// DropQueueFull means the channel's queue bounded by Listener.HandleQueue was full.
+	DropQueueFull DropReason = "queue_full"
+
+	// DropUnlistened means the notification was received after its channel was unlistened with
+	// Subscription.Unlisten.
+	DropUnlistened DropReason = "unlistened"
+
+	// DropSuppressed means the notification's channel was suppressed with Listener.Suppress and
+	// Listener.SuppressQueueSize notifications were already held.
+	DropSuppressed DropReason = "suppressed"
+)
+
+// Stats are counters of a Listener's activity.
+type Stats struct {
+	// Received is the number of notifications received.
+	Received uint64
+
+	// Dropped is the number of notifications discarded without being handled.
+	Dropped uint64
+
+	// Abandoned is the number of handlers that did not return within Listener.HandlerTimeout and were left running.
+	Abandoned uint64
+
+	// BacklogFiltered is the number of backlog rows skipped by Listener.BacklogFilter.
+	BacklogFiltered uint64
+}
+
+type counters struct {
+	received        atomic.Uint64
+	dropped         atomic.Uint64
+	abandoned       atomic.Uint64
+	backlogFiltered atomic.Uint64
+}
+
+// Stats returns a snapshot of the Listener's counters. It is safe to call concurrently with Listen.
+func (l *Listener) Stats() Stats {
+	return Stats{
+		Received:        l.stats.received.Load(),
+		Dropped:         l.stats.dropped.Load(),
+		Abandoned:       l.stats.abandoned.Load(),
+		BacklogFiltered: l.stats.backlogFiltered.Load(),
+	}
+}
+
+// drop counts notification as dropped for reason.
+func (l *Listener) drop(notification *pgconn.Notification, reason DropReason) {
+	l.stats.dropped.Add(1)
+	if m := l.metrics(); m != nil {
+		m.NotificationDropped(notification.Channel, reason)
+	}
+}
+
+// ResetStats zeroes the Listener's counters and returns their values from just before, e.g. to report deltas
+// periodically. Each counter is swapped atomically, so increments made concurrently are counted either in the returned
+// snapshot or after the reset, never lost. It is safe to call concurrently with Listen.
+func (l *Listener) ResetStats() Stats {
+	return Stats{
+		Received:        l.stats.received.Swap(0),
+		Dropped:         l.stats.dropped.Swap(0),
+		Abandoned:       l.stats.abandoned.Swap(0),
+		BacklogFiltered: l.stats.backlogFiltered.Swap(0),
+	}
+}
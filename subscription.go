@@ -0,0 +1,151 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Subscription is a handler added with AddHandler. It can be used to remove the handler again without keeping track
+// of its channel separately.
+type Subscription struct {
+	l       *Listener
+	channel string
+	reg     *registration
+	active  atomic.Bool
+}
+
+// AddHandler sets the handler for notifications sent to channel like Handle, but may also be called while Listen is
+// running, in which case the channel is listened to on the current connection before AddHandler returns and its
+// backlog is handled if handler is a BacklogHandler. If Listen is not connected the channel is listened to when it
+// next connects. If LISTEN fails the handler stays registered, the channel is listened to on the next connection, and
+// both the Subscription and the error are returned. AddHandler cannot be used when Router is set, and fails without
+// registering handler if channel is invalid and AllowInvalidChannels is not set.
+func (l *Listener) AddHandler(ctx context.Context, channel string, handler Handler) (*Subscription, error) {
+	channel = l.channelName(channel)
+
+	if l.Router != nil {
+		return nil, errors.New("AddHandler: Router is set")
+	}
+	if err := l.validateChannel(channel); err != nil {
+		return nil, fmt.Errorf("AddHandler: %w", err)
+	}
+
+	sub := &Subscription{l: l, channel: channel, reg: &registration{handler: handler}}
+	sub.active.Store(true)
+	l.register(channel, sub.reg)
+
+	err := l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		return l.listenChannel(ctx, l.currentSession(), channel)
+	})
+	if err != nil && !errors.Is(err, ErrNotConnected) {
+		return sub, fmt.Errorf("AddHandler: %w", err)
+	}
+
+	return sub, nil
+}
+
+// Channel returns the channel the subscription's handler was added for.
+func (s *Subscription) Channel() string {
+	return s.channel
+}
+
+// Active reports whether the subscription's handler is still registered. It is false after Unlisten and when another
+// handler has since been set for the channel.
+func (s *Subscription) Active() bool {
+	if !s.active.Load() {
+		return false
+	}
+
+	s.l.handlersMu.RLock()
+	defer s.l.handlersMu.RUnlock()
+	return s.l.handlers[s.channel] == s.reg
+}
+
+// Unlisten removes the subscription's handler and stops listening to its channel on the current connection, if any.
+// It does nothing if another handler has since been set for the channel. Calling Unlisten more than once is allowed.
+//
+// Notifications received on the channel before UNLISTEN completed, e.g. those still queued for MaxConcurrency or
+// Semaphore, are still handled by the removed handler, since they were valid when received. Notifications on the
+// channel that Listen receives afterwards, e.g. ones the server sent before it processed UNLISTEN but that had not yet
+// been read, are dropped with DropUnlistened rather than passed to DefaultHandler. Setting a handler for the channel
+// again ends this.
+func (s *Subscription) Unlisten(ctx context.Context) error {
+	if !s.active.Swap(false) {
+		return nil
+	}
+
+	l := s.l
+	l.handlersMu.RLock()
+	registered := l.handlers[s.channel] == s.reg
+	l.handlersMu.RUnlock()
+	if !registered {
+		return nil
+	}
+
+	err := l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		err := l.unlistenChannel(ctx, l.currentSession(), s.channel)
+		// Still on the receive loop, so nothing has been received since UNLISTEN completed.
+		s.retire()
+		return err
+	})
+	s.retire()
+	if err != nil && !errors.Is(err, ErrNotConnected) {
+		return err
+	}
+
+	return nil
+}
+
+// unlistenedChannel is the handler of a channel removed by Subscription.Unlisten and the number of the last
+// notification received before.
+type unlistenedChannel struct {
+	reg *registration
+	seq uint64
+}
+
+// retire removes the subscription's handler if it is still registered, keeping it for the notifications received up to
+// now.
+func (s *Subscription) retire() {
+	l := s.l
+	l.handlersMu.Lock()
+	defer l.handlersMu.Unlock()
+
+	if l.handlers[s.channel] != s.reg {
+		return
+	}
+	delete(l.handlers, s.channel)
+	if l.unlistened == nil {
+		l.unlistened = make(map[string]unlistenedChannel)
+	}
+	l.unlistened[s.channel] = unlistenedChannel{reg: s.reg, seq: l.receivedSeq.Load()}
+}
+
+// routeUnlistened returns the removed handler of the channel of notification if it was unlistened after notification
+// was received. It reports true if the channel was unlistened before notification was received. Notifications that
+// were not received by the Listener, e.g. those passed to Dispatch, count as received after the channel was
+// unlistened.
+func (l *Listener) routeUnlistened(ctx context.Context, notification *pgconn.Notification) (*registration, bool) {
+	l.handlersMu.RLock()
+	u, ok := l.unlistened[notification.Channel]
+	l.handlersMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	if seq := receivedSeq(ctx); seq == 0 || seq > u.seq {
+		return nil, true
+	}
+	return u.reg, false
+}
+
+type receivedSeqCtxKey struct{}
+
+// receivedSeq returns the number dispatch gave the notification handled with ctx, or 0 if it has none.
+func receivedSeq(ctx context.Context) uint64 {
+	seq, _ := ctx.Value(receivedSeqCtxKey{}).(uint64)
+	return seq
+}
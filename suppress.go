@@ -0,0 +1,147 @@
+package pgxlisten
+
+import (
+	"context"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// suppressedChannel holds the notifications of a channel received while it is suppressed.
+type suppressedChannel struct {
+	held []queuedNotification
+
+	// lifted is set by Unsuppress until held is released by releaseSuppressed. Notifications received meanwhile are
+	// still held so they are handled after those received before.
+	lifted bool
+}
+
+// Suppress stops handling notifications sent to channel without unlistening it, e.g. while a feature flag is off.
+// While channel is suppressed up to SuppressQueueSize of its notifications are held for Unsuppress and the others are
+// dropped with DropSuppressed, and its backlog is not handled. Notifications already being handled are not affected.
+// Suppressing a suppressed channel does nothing.
+func (l *Listener) Suppress(channel string) {
+	channel = l.channelName(channel)
+
+	l.suppressMu.Lock()
+	defer l.suppressMu.Unlock()
+
+	if l.suppressed == nil {
+		l.suppressed = make(map[string]*suppressedChannel)
+	}
+	if sc, ok := l.suppressed[channel]; ok {
+		sc.lifted = false
+		return
+	}
+	l.suppressed[channel] = &suppressedChannel{}
+}
+
+// Unsuppress resumes handling notifications sent to channel after Suppress. The notifications held while it was
+// suppressed are handled first, in the order they were received, and those received meanwhile are held until then.
+// While Listen or ListenReceiver is running, Unsuppress returns without waiting for them: they are handed back to the
+// receive loop, which handles them like the notifications it receives, once it next waits for a notification, or for
+// ListenReceiver once the Receiver returns the next one. If Listen is between connections, that is after it has
+// reconnected. Otherwise they are handled on the calling goroutine with a nil conn before Unsuppress returns. Its
+// backlog is handled again from the next scheduled run; RunBacklog can be used to catch up immediately.
+// Unsuppressing a channel that is not suppressed does nothing.
+func (l *Listener) Unsuppress(channel string) {
+	channel = l.channelName(channel)
+
+	l.suppressMu.Lock()
+	sc, ok := l.suppressed[channel]
+	if ok {
+		sc.lifted = true
+	}
+	l.suppressMu.Unlock()
+	if !ok {
+		return
+	}
+
+	if !l.running.Load() {
+		l.releaseSuppressed(context.Background(), nil)
+		return
+	}
+	l.mu.Lock()
+	if s := l.current; s != nil && s.waitCancel != nil {
+		s.waitCancel()
+	}
+	l.mu.Unlock()
+}
+
+// releaseSuppressed hands the notifications held for channels unsuppressed since the last call back for handling, in
+// the order they were received. Those the receive loop would hand to the dispatcher are put in front of their
+// channel's queue, and the others are handled with ctx and conn. While Listen or ListenReceiver is running it must
+// only be called from the receive loop.
+func (l *Listener) releaseSuppressed(ctx context.Context, conn *pgx.Conn) {
+	l.suppressMu.Lock()
+	var released [][]queuedNotification
+	for channel, sc := range l.suppressed {
+		if sc.lifted {
+			released = append(released, sc.held)
+			delete(l.suppressed, channel)
+		}
+	}
+	l.suppressMu.Unlock()
+
+	for _, held := range released {
+		if len(held) > 0 && l.dispatcher != nil && !l.inline(held[0].notification) {
+			l.dispatcher.requeue(held)
+			continue
+		}
+		for _, item := range held {
+			l.handleHeld(item.context(ctx), item.notification, conn)
+		}
+	}
+}
+
+// handleHeld handles notification, which was held by Suppress after it went through the Interceptors and
+// DedupWindow. It is held again if its channel was suppressed again meanwhile.
+func (l *Listener) handleHeld(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) {
+	if l.suppress(ctx, notification) {
+		return
+	}
+	reg, err := l.deliver(ctx, notification, conn)
+	l.reportHandled(ctx, reg, notification, err)
+}
+
+// Suppressed reports whether channel is suppressed by Suppress.
+func (l *Listener) Suppressed(channel string) bool {
+	channel = l.channelName(channel)
+
+	l.suppressMu.Lock()
+	defer l.suppressMu.Unlock()
+	sc, ok := l.suppressed[channel]
+	return ok && !sc.lifted
+}
+
+// suppress holds or drops notification if its channel is suppressed and reports whether it did.
+func (l *Listener) suppress(ctx context.Context, notification *pgconn.Notification) bool {
+	l.suppressMu.Lock()
+	sc, ok := l.suppressed[notification.Channel]
+	if ok && len(sc.held) < l.SuppressQueueSize {
+		item := queuedNotification{
+			notification: notification,
+			mode:         ModeFromContext(ctx),
+			generation:   GenerationFromContext(ctx),
+			seq:          receivedSeq(ctx),
+			queuedAt:     l.now(),
+			held:         true,
+		}
+		// Handlers running concurrently can reach this out of order, so notifications are kept in the order they
+		// were received. Those passed to Dispatch are not numbered and go last.
+		i := len(sc.held)
+		for item.seq != 0 && i > 0 && sc.held[i-1].seq > item.seq {
+			i--
+		}
+		sc.held = slices.Insert(sc.held, i, item)
+		l.suppressMu.Unlock()
+		return true
+	}
+	l.suppressMu.Unlock()
+
+	if ok {
+		l.drop(notification, DropSuppressed)
+	}
+	return ok
+}
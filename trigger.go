@@ -0,0 +1,101 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// defaultBacklogTriggerMaxDelayFactor is the multiple of the window HandleBacklogTrigger waits at most by default.
+const defaultBacklogTriggerMaxDelayFactor = 10
+
+// HandleBacklogTrigger sets a handler for notifications sent to channel that only treats them as a signal to handle
+// the backlog of channel with backlog, for channels where a notification means that the backlog should be scanned
+// again. A burst of notifications is coalesced into a single run: every notification restarts window, and once no
+// notification has arrived for window the backlog is handled once. So that a steady stream of notifications cannot
+// postpone the run forever, it is handled at the latest maxDelay after the first notification that is still pending.
+// If maxDelay is 0, it is 10 times window. Unlike HandleRefresh, which runs at most once per interval while
+// notifications keep arriving, the run is delayed until the burst is over.
+//
+// The triggered run is handled on the listening connection like WithConn and like the scheduled runs of any
+// BacklogHandler: it honors DisableBacklog, Suppress, BacklogTimeout, BacklogMaxPerRun, and the metadata of
+// HandleWithMeta, its errors other than ErrBacklogEmpty are handled like those of other backlog runs, and it restarts
+// BacklogInterval. The backlog is also handled when Listen connects and every BacklogInterval. If Listen is between
+// connections when a run is due, the run after reconnecting takes care of it.
+func (l *Listener) HandleBacklogTrigger(channel string, window, maxDelay time.Duration, backlog BacklogHandler) {
+	if maxDelay == 0 {
+		maxDelay = defaultBacklogTriggerMaxDelayFactor * window
+	}
+	l.Handle(channel, &backlogTriggerHandler{
+		l:        l,
+		channel:  l.channelName(channel),
+		window:   window,
+		maxDelay: max(maxDelay, window),
+		backlog:  backlog,
+	})
+}
+
+type backlogTriggerHandler struct {
+	l        *Listener
+	channel  string
+	window   time.Duration
+	maxDelay time.Duration
+	backlog  BacklogHandler
+
+	mu    sync.Mutex
+	timer *time.Timer
+	// pendingSince is when the first notification not yet covered by a run arrived, or zero if there is none.
+	pendingSince time.Time
+}
+
+func (h *backlogTriggerHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.l.now()
+	if h.pendingSince.IsZero() {
+		h.pendingSince = now
+	}
+	delay := min(h.window, max(h.pendingSince.Add(h.maxDelay).Sub(now), 0))
+
+	if h.timer != nil {
+		// If the run has already started this schedules another one, since the notification may not be covered by it.
+		h.timer.Reset(delay)
+		return nil
+	}
+	laterCtx := detachedContext(ctx)
+	h.timer = time.AfterFunc(delay, func() { h.handleLater(laterCtx) })
+	return nil
+}
+
+func (h *backlogTriggerHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	return h.backlog.HandleBacklog(ctx, channel, conn)
+}
+
+// handleLater handles the backlog once it is due after a burst of notifications.
+func (h *backlogTriggerHandler) handleLater(ctx context.Context) {
+	h.mu.Lock()
+	h.pendingSince = time.Time{}
+	h.mu.Unlock()
+
+	err := h.l.withConn(ctx, func(ctx context.Context, conn *pgx.Conn) error {
+		s := h.l.currentSession()
+		h.l.mu.Lock()
+		b := s.backlogs[h.channel]
+		h.l.mu.Unlock()
+		if b == nil {
+			// The backlog is disabled or the channel is not listened to on this connection.
+			return nil
+		}
+		h.l.handleBacklog(ctx, s, conn, h.channel, b)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrNotConnected) {
+		h.l.logError(ctx, fmt.Errorf("handle backlog %q: %w", h.channel, err))
+	}
+}
@@ -0,0 +1,58 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// txMaxAttempts is how many times HandleTx tries a transaction that fails with a serialization failure.
+const txMaxAttempts = 3
+
+// TxBeginner begins transactions. It is implemented by *pgx.Conn, *pgxpool.Pool, and pgx.Tx.
+type TxBeginner interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// HandleTx sets fn as the handler for notifications sent to channel and runs it in a transaction begun on DB. The
+// transaction is committed if fn returns nil and rolled back if it returns an error or panics. If the transaction
+// fails with a serialization failure (SQLSTATE 40001) fn is retried in a new transaction, up to 3 attempts in total,
+// so fn must not have side effects outside the transaction. If Seen is a TxSeen the notification's idempotency key is
+// marked seen in the same transaction, so a crash cannot leave the work committed but the key unmarked or vice versa.
+func (l *Listener) HandleTx(channel string, fn func(ctx context.Context, notification *pgconn.Notification, tx pgx.Tx) error) {
+	handler := HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+		return l.handleTx(ctx, notification, conn, fn)
+	})
+	l.register(channel, &registration{handler: handler, marksSeen: true})
+}
+
+func (l *Listener) handleTx(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn, fn func(context.Context, *pgconn.Notification, pgx.Tx) error) error {
+	var db TxBeginner
+	switch {
+	case l.DB != nil:
+		db = l.DB
+	case conn != nil:
+		db = conn
+	default:
+		return errors.New("HandleTx: no connection available, set DB")
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := pgx.BeginFunc(ctx, db, func(tx pgx.Tx) error {
+			if err := fn(ctx, notification, tx); err != nil {
+				return err
+			}
+			return l.markSeenTx(ctx, tx)
+		})
+
+		var pgErr *pgconn.PgError
+		if attempt < txMaxAttempts && errors.As(err, &pgErr) && pgErr.Code == "40001" {
+			l.logDebug(ctx, fmt.Sprintf("retrying %s notification transaction after serialization failure", notification.Channel))
+			continue
+		}
+		return err
+	}
+}
@@ -0,0 +1,88 @@
+package pgxlisten
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// HandleUnified sets handler as the handler for notifications sent to channel and handles the channel's backlog with
+// the same handler, so processing is written once. Whenever the backlog is handled query is run on the listening
+// connection and rowToNotification converts each row it returns into a notification, which is then handled exactly
+// as if it had been received on channel: interceptors, deduplication, retries, timeouts, and error handling all
+// apply. The Channel of a notification returned with none is set to channel.
+//
+// query should return the rows that still need processing in the order they should be handled, and stop returning a
+// row once its notification has been handled, so the next run does not handle it again. At most
+// BacklogLimitFromContext rows are handled per run if that is set. Rows rejected by Listener.BacklogFilter are skipped.
+// handler is called with the listening connection for backlog rows, even when MaxConcurrency or Semaphore is set.
+func (l *Listener) HandleUnified(channel string, query string, rowToNotification func(pgx.Rows) (*pgconn.Notification, error), handler Handler) {
+	l.Handle(channel, &unifiedHandler{l: l, query: query, rowToNotification: rowToNotification, handler: handler})
+}
+
+type unifiedHandler struct {
+	l                 *Listener
+	query             string
+	rowToNotification func(pgx.Rows) (*pgconn.Notification, error)
+	handler           Handler
+}
+
+func (h *unifiedHandler) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	return h.handler.HandleNotification(ctx, notification, conn)
+}
+
+func (h *unifiedHandler) needsListeningConn() bool {
+	return true
+}
+
+// HandleBacklog converts the rows returned by query into notifications and handles them. It returns ErrBacklogEmpty
+// if there were none.
+func (h *unifiedHandler) HandleBacklog(ctx context.Context, channel string, conn *pgx.Conn) error {
+	limit := BacklogLimitFromContext(ctx)
+
+	// The rows are read before any is handled, since handler may use conn.
+	var notifications []*pgconn.Notification
+	rows, err := conn.Query(ctx, h.query)
+	if err != nil {
+		return fmt.Errorf("query backlog: %w", err)
+	}
+	for rows.Next() && (limit == 0 || len(notifications) < limit) {
+		if h.l.BacklogFilter != nil {
+			ok, err := h.l.BacklogFilter(channel, rows)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("filter backlog row: %w", err)
+			}
+			if !ok {
+				h.l.stats.backlogFiltered.Add(1)
+				continue
+			}
+		}
+		notification, err := h.rowToNotification(rows)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("convert backlog row: %w", err)
+		}
+		if notification.Channel == "" {
+			notification.Channel = channel
+		}
+		notifications = append(notifications, notification)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("query backlog: %w", err)
+	}
+
+	if len(notifications) == 0 {
+		return ErrBacklogEmpty
+	}
+	for _, notification := range notifications {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		h.l.process(ctx, notification, conn)
+	}
+	return nil
+}
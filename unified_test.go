@@ -0,0 +1,359 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestListenerHandleUnified(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_unified_test;
+create table pgxlisten_unified_test (id bigint primary key generated by default as identity, processed bool not null default false);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_unified_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		insert := func(notify bool) string {
+			var id int64
+			err := conn.QueryRow(ctx, `insert into pgxlisten_unified_test default values returning id`).Scan(&id)
+			require.NoError(t, err)
+			if notify {
+				_, err = conn.Exec(ctx, `select pg_notify('unified', $1::text)`, id)
+				require.NoError(t, err)
+			}
+			return strconv.FormatInt(id, 10)
+		}
+
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+
+		type handled struct {
+			payload string
+			live    bool
+		}
+		handledChan := make(chan handled, 8)
+		listener.HandleUnified("unified", `select id from pgxlisten_unified_test where not processed order by id`,
+			func(rows pgx.Rows) (*pgconn.Notification, error) {
+				var id int64
+				if err := rows.Scan(&id); err != nil {
+					return nil, err
+				}
+				return &pgconn.Notification{Payload: strconv.FormatInt(id, 10)}, nil
+			},
+			pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				require.Equal(t, "unified", notification.Channel)
+				_, err := conn.Exec(ctx, `update pgxlisten_unified_test set processed = true where id = $1`, notification.Payload)
+				if err != nil {
+					return err
+				}
+				handledChan <- handled{payload: notification.Payload, live: notification.PID != 0}
+				return nil
+			}),
+		)
+
+		receive := func(expected handled) {
+			select {
+			case h := <-handledChan:
+				require.Equal(t, expected, h)
+			case <-ctx.Done():
+				t.Fatalf("%s. %v", expected.payload, ctx.Err())
+			}
+		}
+
+		// Rows written while the Listener was not running are handled as backlog.
+		first := insert(false)
+		second := insert(true)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		receive(handled{payload: first})
+		receive(handled{payload: second})
+
+		// No way to know when Listener is ready so wait a little.
+		time.Sleep(2 * time.Second)
+
+		live := insert(true)
+		receive(handled{payload: live, live: true})
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
+
+func TestListenerBacklogFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_filter_test;
+create table pgxlisten_filter_test (id bigint primary key, deleted bool not null);
+insert into pgxlisten_filter_test values (1, false), (2, true), (3, false), (4, true);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_filter_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		var filteredChannels []string
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			BacklogFilter: func(channel string, row pgx.Rows) (bool, error) {
+				values, err := row.Values()
+				if err != nil {
+					return false, err
+				}
+				filteredChannels = append(filteredChannels, channel)
+				return !values[1].(bool), nil
+			},
+		}
+
+		handledChan := make(chan string, 8)
+		listener.HandleUnified("filter", `select id, deleted from pgxlisten_filter_test order by id`,
+			func(rows pgx.Rows) (*pgconn.Notification, error) {
+				var id int64
+				var deleted bool
+				if err := rows.Scan(&id, &deleted); err != nil {
+					return nil, err
+				}
+				return &pgconn.Notification{Payload: strconv.FormatInt(id, 10)}, nil
+			},
+			pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				handledChan <- notification.Payload
+				return nil
+			}),
+		)
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		for _, expected := range []string{"1", "3"} {
+			select {
+			case payload := <-handledChan:
+				require.Equal(t, expected, payload)
+			case <-ctx.Done():
+				t.Fatalf("%s. %v", expected, ctx.Err())
+			}
+		}
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+
+		require.Empty(t, handledChan)
+		require.Equal(t, []string{"filter", "filter", "filter", "filter"}, filteredChannels)
+		require.Equal(t, uint64(2), listener.Stats().BacklogFiltered)
+	})
+}
+
+func TestListenerBacklogChannel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_stream_test;
+create table pgxlisten_stream_test (id bigint primary key);
+insert into pgxlisten_stream_test select generate_series(1, 250);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_stream_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+		}
+		listener.HandleUnified("stream", `select id from pgxlisten_stream_test order by id`,
+			func(rows pgx.Rows) (*pgconn.Notification, error) {
+				var id int64
+				if err := rows.Scan(&id); err != nil {
+					return nil, err
+				}
+				return &pgconn.Notification{Payload: strconv.FormatInt(id, 10)}, nil
+			},
+			pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+				return errors.New("unexpected handler call")
+			}),
+		)
+		listener.Handle("plain", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		var expected int64
+		for row := range listener.BacklogChannel(ctx, "stream") {
+			require.NoError(t, row.Err)
+			expected++
+			require.Equal(t, []any{expected}, row.Values)
+			require.Equal(t, "stream", row.Notification.Channel)
+			require.Equal(t, strconv.FormatInt(expected, 10), row.Notification.Payload)
+		}
+		require.Equal(t, int64(250), expected)
+
+		// A caller that stops early cancels ctx and the channel is closed.
+		streamCtx, streamCancel := context.WithCancel(ctx)
+		rowChan := listener.BacklogChannel(streamCtx, "stream")
+		row := <-rowChan
+		require.NoError(t, row.Err)
+		streamCancel()
+		for range rowChan {
+		}
+
+		var rows []pgxlisten.BacklogRow
+		for row := range listener.BacklogChannel(ctx, "plain") {
+			rows = append(rows, row)
+		}
+		require.Len(t, rows, 1)
+		require.ErrorIs(t, rows[0].Err, pgxlisten.ErrNoBacklogHandler)
+	})
+}
+
+func TestListenerHandleUnifiedBacklogConcurrency(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	ctr := defaultConnTestRunner
+	ctr.AfterConnect = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_unified_concurrency_test;
+create table pgxlisten_unified_concurrency_test (id bigint primary key);
+insert into pgxlisten_unified_concurrency_test values (1), (2);
+`)
+		require.NoError(t, err)
+	}
+	ctr.AfterTest = func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		_, err := conn.Exec(ctx, `drop table if exists pgxlisten_unified_concurrency_test;`)
+		require.NoError(t, err)
+	}
+
+	ctr.RunTest(ctx, t, func(ctx context.Context, t testing.TB, conn *pgx.Conn) {
+		listener := &pgxlisten.Listener{
+			Connect: func(ctx context.Context) (*pgx.Conn, error) {
+				config := ctr.CreateConfig(ctx, t)
+				return pgx.ConnectConfig(ctx, config)
+			},
+			LogError:           func(ctx context.Context, err error) {},
+			BacklogConcurrency: 3,
+		}
+
+		type handled struct {
+			channel string
+			payload string
+			conn    bool
+		}
+		handledChan := make(chan handled, 8)
+		for _, channel := range []string{"unified0", "unified1"} {
+			listener.HandleUnified(channel, `select id from pgxlisten_unified_concurrency_test order by id`,
+				func(rows pgx.Rows) (*pgconn.Notification, error) {
+					var id int64
+					if err := rows.Scan(&id); err != nil {
+						return nil, err
+					}
+					return &pgconn.Notification{Payload: strconv.FormatInt(id, 10)}, nil
+				},
+				pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+					handledChan <- handled{channel: notification.Channel, payload: notification.Payload, conn: conn != nil}
+					return nil
+				}),
+			)
+		}
+		listener.Handle("plain", pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			return nil
+		}))
+
+		listenerCtx, listenerCtxCancel := context.WithCancel(ctx)
+		defer listenerCtxCancel()
+		listenerDoneChan := make(chan struct{})
+
+		go func() {
+			listener.Listen(listenerCtx)
+			close(listenerDoneChan)
+		}()
+
+		// The unified backlogs are handled on the listening connection, one channel after the other.
+		for _, expected := range []handled{
+			{channel: "unified0", payload: "1", conn: true},
+			{channel: "unified0", payload: "2", conn: true},
+			{channel: "unified1", payload: "1", conn: true},
+			{channel: "unified1", payload: "2", conn: true},
+		} {
+			select {
+			case h := <-handledChan:
+				require.Equal(t, expected, h)
+			case <-ctx.Done():
+				t.Fatalf("%v. %v", expected, ctx.Err())
+			}
+		}
+
+		// BacklogChannel uses a connection of its own regardless of BacklogConcurrency.
+		var payloads []string
+		for row := range listener.BacklogChannel(ctx, "unified0") {
+			require.NoError(t, row.Err)
+			payloads = append(payloads, row.Notification.Payload)
+		}
+		require.Equal(t, []string{"1", "2"}, payloads)
+
+		listenerCtxCancel()
+
+		select {
+		case <-listenerDoneChan:
+		case <-ctx.Done():
+			t.Fatalf("ctx cancelled while waiting for Listen() to return: %v", ctx.Err())
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package pgxlisten
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	defaultVisibilityRetries = 5
+	defaultVisibilityDelay   = 20 * time.Millisecond
+)
+
+// ErrNotVisible is returned by WaitForVisibility when the row a notification refers to still could not be found after
+// all retries.
+var ErrNotVisible = errors.New("row not visible")
+
+// WaitForVisibility is a Handler for the notify-then-fetch pattern, where the payload identifies a row that Handler
+// queries. A notification is delivered when the notifying transaction commits, but a query issued right after it may
+// not see the row yet, e.g. when it runs on a replica that has not replayed the commit. WaitForVisibility retries
+// Handler while it reports the row as not found, assuming the row is about to become visible.
+//
+// Handler reports that the row was not found by returning an error that wraps pgx.ErrNoRows, as QueryRow.Scan and
+// CollectOneRow do. Any other result is returned as is. If the row is still not found after Retries retries,
+// WaitForVisibility returns an error wrapping both ErrNotVisible and Handler's error. WaitForVisibility is not a
+// BacklogHandler even if Handler is; rows found by a backlog scan are already visible.
+type WaitForVisibility struct {
+	// Handler fetches and handles the row. Handler is required.
+	Handler Handler
+
+	// Retries is the number of times Handler is retried after the row was not found. If set to 0, the default of 5 is
+	// used. A negative value disables retries.
+	Retries int
+
+	// Delay is how long to wait before each retry. If set to 0, the default of 20ms is used.
+	Delay time.Duration
+}
+
+// HandleNotification implements Handler.
+func (h *WaitForVisibility) HandleNotification(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+	retries := h.Retries
+	if retries == 0 {
+		retries = defaultVisibilityRetries
+	}
+	delay := h.Delay
+	if delay == 0 {
+		delay = defaultVisibilityDelay
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := h.Handler.HandleNotification(ctx, notification, conn)
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return err
+		}
+		if attempt >= retries {
+			return fmt.Errorf("%w after %d attempts: %w", ErrNotVisible, attempt+1, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %w", ErrNotVisible, ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package pgxlisten_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+
+	"github.com/pagerguild/pgxlisten"
+)
+
+func TestWaitForVisibility(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	// The row becomes visible on the third fetch.
+	attempts := 0
+	handler := &pgxlisten.WaitForVisibility{
+		Handler: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			attempts++
+			if attempts < 3 {
+				return fmt.Errorf("fetch %s: %w", notification.Payload, pgx.ErrNoRows)
+			}
+			return nil
+		}),
+		Retries: 10,
+		Delay:   time.Millisecond,
+	}
+
+	err := handler.HandleNotification(ctx, &pgconn.Notification{Channel: "foo", Payload: "1"}, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3, attempts)
+}
+
+func TestWaitForVisibilityExhausted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	attempts := 0
+	handler := &pgxlisten.WaitForVisibility{
+		Handler: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			attempts++
+			return pgx.ErrNoRows
+		}),
+		Retries: 2,
+		Delay:   time.Millisecond,
+	}
+
+	err := handler.HandleNotification(ctx, &pgconn.Notification{Channel: "foo", Payload: "1"}, nil)
+	require.ErrorIs(t, err, pgxlisten.ErrNotVisible)
+	require.ErrorIs(t, err, pgx.ErrNoRows)
+	require.Equal(t, 3, attempts)
+}
+
+func TestWaitForVisibilityOtherError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
+	defer cancel()
+
+	attempts := 0
+	handlerErr := fmt.Errorf("boom")
+	handler := &pgxlisten.WaitForVisibility{
+		Handler: pgxlisten.HandlerFunc(func(ctx context.Context, notification *pgconn.Notification, conn *pgx.Conn) error {
+			attempts++
+			return handlerErr
+		}),
+	}
+
+	err := handler.HandleNotification(ctx, &pgconn.Notification{Channel: "foo", Payload: "1"}, nil)
+	require.ErrorIs(t, err, handlerErr)
+	require.Equal(t, 1, attempts)
+}